@@ -2,25 +2,17 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
-)
-
-type Message struct {
-	Topic   string `json:"topic"`
-	Message string `json:"message,omitempty"`
-	ID      uint32 `json:"id,omitempty"`
-}
+	"time"
 
-type Ack struct {
-	Topic  string `json:"topic"`
-	Offset int64  `json:"offset"`
-}
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
 
 func main() {
 	if len(os.Args) < 2 {
@@ -54,63 +46,92 @@ func main() {
 
 		switch command {
 		case "publish":
+			usage := "Uso: publish <tópico> [-h chave=valor]... [-t content-type] <mensagem>"
 			if len(parts) < 3 {
-				fmt.Println("Uso: publish <tópico> <mensagem>")
+				fmt.Println(usage)
 				continue
 			}
-			topic := parts[1]
-			message := strings.Join(parts[2:], " ")
-
-			msg := Message{Topic: topic, Message: message}
-			body, err := json.Marshal(msg)
-			if err != nil {
-				fmt.Println("Erro ao codificar a mensagem:", err)
-				continue
+			msg := protocol.Publish{Message: protocol.Message{Topic: parts[1], ProducerTimestampMs: time.Now().UnixMilli()}, RequestAck: true}
+			rest := parts[2:]
+			valid := true
+			for len(rest) > 2 && (rest[0] == "-h" || rest[0] == "-t") {
+				if rest[0] == "-t" {
+					msg.ContentType = rest[1]
+				} else if name, value, ok := strings.Cut(rest[1], "="); ok {
+					if msg.Headers == nil {
+						msg.Headers = make(map[string]string)
+					}
+					msg.Headers[name] = value
+				} else {
+					valid = false
+				}
+				rest = rest[2:]
 			}
-
-			header := make([]byte, 5)
-			header[0] = 0x01 // PUBLISH
-			binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
-
-			if _, err := conn.Write(header); err != nil {
-				fmt.Println("Erro ao enviar cabeçalho:", err)
+			if !valid || len(rest) == 0 {
+				fmt.Println(usage)
 				continue
 			}
-			if _, err := conn.Write(body); err != nil {
-				fmt.Println("Erro ao enviar corpo:", err)
+			msg.Message.Message = strings.Join(rest, " ")
+
+			if err := writeFrame(conn, protocol.MessageTypePublish, msg); err != nil {
+				fmt.Println("Erro ao enviar o PUBLISH:", err)
 				continue
 			}
 
-		case "subscribe":
+		case "subscribe", "shared", "broadcast":
 			if len(parts) < 2 {
-				fmt.Println("Uso: subscribe <tópico>")
+				fmt.Println("Uso: subscribe <tópico> [grupo] [prefetch] | shared <tópico> [grupo] [prefetch] | broadcast <tópico> [prefetch]")
 				continue
 			}
-			topic := parts[1]
+			sub := protocol.Subscription{Topic: parts[1]}
+			prefetchArg := 3
+			if command == "broadcast" {
+				sub.Mode = "broadcast"
+				prefetchArg = 2
+			} else if len(parts) > 2 {
+				sub.Group = parts[2]
+			}
+			if command == "shared" {
+				sub.Mode = "shared"
+			}
+			if len(parts) > prefetchArg {
+				sub.Prefetch, err = strconv.Atoi(parts[prefetchArg])
+				if err != nil {
+					fmt.Println("prefetch tem de ser um número inteiro")
+					continue
+				}
+			}
 
-			msg := Message{Topic: topic}
-			body, err := json.Marshal(msg)
-			if err != nil {
-				fmt.Println("Erro ao codificar a mensagem:", err)
+			if err := writeFrame(conn, protocol.MessageTypeSubscribe, sub); err != nil {
+				fmt.Println("Erro ao enviar o SUBSCRIBE:", err)
 				continue
 			}
 
-			header := make([]byte, 5)
-			header[0] = 0x02 // SUBSCRIBE
-			binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
-
-			if _, err := conn.Write(header); err != nil {
-				fmt.Println("Erro ao enviar cabeçalho:", err)
+		case "ack":
+			if len(parts) < 3 {
+				fmt.Println("Uso: ack <tópico> <offset>|..<offset>|<de>-<até>[,...] [partição]")
 				continue
 			}
-			if _, err := conn.Write(body); err != nil {
-				fmt.Println("Erro ao enviar corpo:", err)
+			ack, err := parseAck(parts[1], parts[2])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if len(parts) > 3 {
+				ack.Partition, err = strconv.Atoi(parts[3])
+				if err != nil {
+					fmt.Println("partição tem de ser um número inteiro")
+					continue
+				}
+			}
+			if err := writeFrame(conn, protocol.MessageTypeAck, ack); err != nil {
+				fmt.Println("Erro ao enviar o ACK:", err)
 				continue
 			}
 
-		case "ack":
+		case "nack":
 			if len(parts) < 3 {
-				fmt.Println("Uso: ack <tópico> <offset>")
+				fmt.Println("Uso: nack <tópico> <offset> [partição] [atraso em ms] [motivo]")
 				continue
 			}
 			topic := parts[1]
@@ -119,21 +140,143 @@ func main() {
 				fmt.Println("offset tem de ser um número inteiro")
 				continue
 			}
-			ack := Ack{Topic: topic, Offset: offset}
-			body, err := json.Marshal(ack)
-			if err != nil {
-				fmt.Println("Erro ao codificar o ACK:", err)
+			nack := protocol.Nack{Topic: topic, Offset: offset}
+			if len(parts) > 3 {
+				nack.Partition, err = strconv.Atoi(parts[3])
+				if err != nil {
+					fmt.Println("partição tem de ser um número inteiro")
+					continue
+				}
+			}
+			if len(parts) > 4 {
+				nack.DelayMs, err = strconv.ParseInt(parts[4], 10, 64)
+				if err != nil {
+					fmt.Println("atraso tem de ser um número inteiro")
+					continue
+				}
+			}
+			if len(parts) > 5 {
+				nack.Reason = strings.Join(parts[5:], " ")
+			}
+			if err := writeFrame(conn, protocol.MessageTypeNack, nack); err != nil {
+				fmt.Println("Erro ao enviar o NACK:", err)
 				continue
 			}
-			header := make([]byte, 5)
-			header[0] = 0x03 // ACK
-			binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
-			if _, err := conn.Write(header); err != nil {
-				fmt.Println("Erro ao enviar cabeçalho:", err)
+
+		case "seek":
+			if len(parts) < 4 {
+				fmt.Println("Uso: seek <tópico> <grupo> <earliest|latest|offset|data RFC3339> [partição]")
 				continue
 			}
-			if _, err := conn.Write(body); err != nil {
-				fmt.Println("Erro ao enviar corpo:", err)
+			seek := protocol.Seek{Topic: parts[1], Group: parts[2]}
+			if parts[3] == "earliest" || parts[3] == "latest" {
+				seek.Position = parts[3]
+			} else if offset, err := strconv.ParseInt(parts[3], 10, 64); err == nil {
+				seek.Position = "offset"
+				seek.Offset = offset
+			} else if t, err := time.Parse(time.RFC3339, parts[3]); err == nil {
+				seek.Position = "timestamp"
+				seek.TimestampMs = t.UnixMilli()
+			} else {
+				fmt.Println("posição tem de ser earliest, latest, um offset ou uma data RFC3339")
+				continue
+			}
+			if len(parts) > 4 {
+				partition, err := strconv.Atoi(parts[4])
+				if err != nil {
+					fmt.Println("partição tem de ser um número inteiro")
+					continue
+				}
+				seek.Partitions = []int{partition}
+			}
+			if err := writeFrame(conn, protocol.MessageTypeSeek, seek); err != nil {
+				fmt.Println("Erro ao enviar o SEEK:", err)
+				continue
+			}
+
+		case "create":
+			usage := "Uso: create <tópico> [-p partições] [-r retenção em ms] [-b bytes] [-m mensagens] [-s bytes por mensagem] [-c delete|compact] [-d always|interval|messages|os] [-i intervalo de sync em ms] [-n mensagens por sync] [-e entregas máximas] [-q tópico de dead-letter] [-a principal:publish|subscribe|admin:allow|deny]"
+			if len(parts) < 2 || len(parts)%2 != 0 {
+				fmt.Println(usage)
+				continue
+			}
+			create := protocol.CreateTopic{Topic: parts[1]}
+			valid := true
+			for rest := parts[2:]; len(rest) > 0; rest = rest[2:] {
+				if rest[0] == "-c" {
+					create.Config.CleanupPolicy = rest[1]
+					continue
+				}
+				if rest[0] == "-d" {
+					create.Config.Durability = rest[1]
+					continue
+				}
+				if rest[0] == "-q" {
+					create.Config.DeadLetterTopic = rest[1]
+					continue
+				}
+				if rest[0] == "-a" {
+					acl := strings.Split(rest[1], ":")
+					if len(acl) != 3 {
+						valid = false
+						break
+					}
+					create.ACLs = append(create.ACLs, protocol.ACLBinding{Principal: acl[0], Operation: acl[1], Permission: acl[2]})
+					continue
+				}
+				value, err := strconv.ParseInt(rest[1], 10, 64)
+				if err != nil {
+					valid = false
+					break
+				}
+				switch rest[0] {
+				case "-p":
+					create.Config.Partitions = int(value)
+				case "-r":
+					create.Config.RetentionMs = value
+				case "-b":
+					create.Config.RetentionBytes = value
+				case "-m":
+					create.Config.RetentionMessages = value
+				case "-s":
+					create.Config.MaxMessageBytes = int(value)
+				case "-i":
+					create.Config.SyncIntervalMs = value
+				case "-n":
+					create.Config.SyncMessages = int(value)
+				case "-e":
+					create.Config.MaxDeliveries = int(value)
+				default:
+					valid = false
+				}
+			}
+			if !valid {
+				fmt.Println(usage)
+				continue
+			}
+			if err := writeFrame(conn, protocol.MessageTypeCreateTopic, create); err != nil {
+				fmt.Println("Erro ao enviar o CREATE_TOPIC:", err)
+				continue
+			}
+
+		case "delete", "describe":
+			if len(parts) < 2 {
+				fmt.Println("Uso: delete <tópico> | describe <tópico>")
+				continue
+			}
+			var messageType byte = protocol.MessageTypeDeleteTopic
+			var req any = protocol.DeleteTopic{Topic: parts[1]}
+			if command == "describe" {
+				messageType, req = protocol.MessageTypeDescribeTopic, protocol.DescribeTopic{Topic: parts[1]}
+			}
+			if err := writeFrame(conn, messageType, req); err != nil {
+				fmt.Printf("Erro ao enviar o %s: %v\n", strings.ToUpper(command), err)
+				continue
+			}
+
+		case "topics":
+			if err := writeFrame(conn, protocol.MessageTypeListTopics, struct{}{}); err != nil {
+				fmt.Println("Erro ao enviar o LIST_TOPICS:", err)
 				continue
 			}
 
@@ -145,39 +288,148 @@ func main() {
 	}
 }
 
+// writeFrame sends v encoded as JSON in a version 1 frame of the given type,
+// which is what the broker expects from clients that skip HELLO
+func writeFrame(conn net.Conn, messageType byte, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	frame := protocol.AppendHeader(nil, protocol.Header{
+		Version: protocol.FrameVersion1,
+		Type:    messageType,
+		Length:  uint32(len(body)),
+	})
+	_, err = conn.Write(append(frame, body...))
+	return err
+}
+
+// parseAck builds an ACK from an offset, "..N" for every offset up to N, or
+// a comma-separated list of offsets and ranges such as "2-4,7"
+func parseAck(topic, spec string) (protocol.Ack, error) {
+	ack := protocol.Ack{Topic: topic}
+	errInvalid := fmt.Errorf("offset inválido: %s", spec)
+
+	if strings.HasPrefix(spec, "..") {
+		offset, err := strconv.ParseInt(spec[2:], 10, 64)
+		if err != nil {
+			return ack, errInvalid
+		}
+		ack.Offset = offset
+		ack.Cumulative = true
+		return ack, nil
+	}
+
+	if offset, err := strconv.ParseInt(spec, 10, 64); err == nil {
+		ack.Offset = offset
+		return ack, nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		from, to, isRange := strings.Cut(item, "-")
+		if !isRange {
+			to = from
+		}
+		var r protocol.AckRange
+		var err1, err2 error
+		r.From, err1 = strconv.ParseInt(from, 10, 64)
+		r.To, err2 = strconv.ParseInt(to, 10, 64)
+		if err1 != nil || err2 != nil {
+			return ack, errInvalid
+		}
+		ack.Ranges = append(ack.Ranges, r)
+	}
+	return ack, nil
+}
+
 func readMessages(conn net.Conn) {
 	reader := bufio.NewReader(conn)
 	for {
-		header := make([]byte, 5)
-		_, err := reader.Read(header)
+		header, err := protocol.ReadHeader(reader, protocol.FrameVersion1)
 		if err != nil {
 			fmt.Println("Erro ao ler o cabeçalho:", err)
 			return
 		}
 
-		messageType := header[0]
-		bodyLength := binary.BigEndian.Uint32(header[1:])
-
-		body := make([]byte, bodyLength)
-		_, err = reader.Read(body)
-		if err != nil {
+		body := make([]byte, header.Length)
+		if _, err := io.ReadFull(reader, body); err != nil {
 			fmt.Println("Erro ao ler o corpo:", err)
 			return
 		}
 
-		switch messageType {
-		case 0x03: // MESSAGE
-			var msg Message
+		switch header.Type {
+		case protocol.MessageTypeMessageV1:
+			var msg protocol.Message
 			err = json.Unmarshal(body, &msg)
 			if err != nil {
 				fmt.Println("Erro ao decodificar a mensagem:", err)
 				return
 			}
-			fmt.Printf("Mensagem recebida do tópico '%s' (id=%d): %s\n", msg.Topic, msg.ID, msg.Message)
-		case 0xFF: // Error
-			fmt.Printf("Erro do servidor: %s\n", string(body))
+			fmt.Printf("Mensagem recebida do tópico '%s' (partição=%d, id=%d, reentregas=%d, %s): %s\n", msg.Topic, msg.Partition, msg.ID, msg.Redeliveries, time.UnixMilli(msg.TimestampMs).Format(time.RFC3339), msg.Message)
+			if len(msg.Payload) > 0 {
+				fmt.Printf("  Payload (%s, %d bytes): %q\n", msg.ContentType, len(msg.Payload), msg.Payload)
+			}
+			for name, value := range msg.Headers {
+				fmt.Printf("  %s: %s\n", name, value)
+			}
+			if dl := msg.DeadLetter; dl != nil {
+				fmt.Printf("  Original: tópico '%s' (partição=%d, offset=%d), grupo '%s', %d entregas: %s\n", dl.Topic, dl.Partition, dl.Offset, dl.Group, dl.Deliveries, dl.Reason)
+			}
+		case protocol.MessageTypePublishAck:
+			var ack protocol.PublishAck
+			err = json.Unmarshal(body, &ack)
+			if err != nil {
+				fmt.Println("Erro ao decodificar a confirmação:", err)
+				return
+			}
+			if ack.Error != nil {
+				fmt.Printf("Erro ao publicar no tópico '%s' (%s): %s\n", ack.Topic, ack.Error.Code, ack.Error.Message)
+				continue
+			}
+			fmt.Printf("Mensagem publicada no tópico '%s' (partição=%d, offset=%d)\n", ack.Topic, ack.Partition, ack.Offset)
+		case protocol.MessageTypeTopicList:
+			var list protocol.TopicList
+			if err := json.Unmarshal(body, &list); err != nil {
+				fmt.Println("Erro ao decodificar a lista de tópicos:", err)
+				return
+			}
+			if len(list.Topics) == 0 {
+				fmt.Println("Nenhum tópico")
+			}
+			for _, t := range list.Topics {
+				// Only the reply to DELETE_TOPIC has topics without
+				// partitions
+				if t.Config.Partitions == 0 {
+					fmt.Printf("Tópico '%s' apagado\n", t.Topic)
+					continue
+				}
+				c := t.Config
+				fmt.Printf("Tópico '%s': %d partições, %d bytes, limpeza=%s, retenção: %d ms, %d bytes, %d mensagens, máximo por mensagem: %d bytes, durabilidade=%s (sync a cada %d ms ou %d mensagens), entregas máximas: %d, dead-letter: '%s'\n", t.Topic, c.Partitions, t.SizeBytes, c.CleanupPolicy, c.RetentionMs, c.RetentionBytes, c.RetentionMessages, c.MaxMessageBytes, c.Durability, c.SyncIntervalMs, c.SyncMessages, c.MaxDeliveries, c.DeadLetterTopic)
+				for _, p := range t.Partitions {
+					fmt.Printf("  Partição %d: offsets %d-%d, %d bytes\n", p.Partition, p.StartOffset, p.NextOffset, p.SizeBytes)
+				}
+				for _, sub := range t.Subscribers {
+					fmt.Printf("  Subscritor %s '%s': %d membros, offsets %v\n", sub.Mode, sub.Group, sub.Members, sub.Offsets)
+				}
+				for _, acl := range t.ACLs {
+					fmt.Printf("  ACL: %s %s %s\n", acl.Permission, acl.Principal, acl.Operation)
+				}
+			}
+		case protocol.MessageTypeError:
+			var e protocol.Error
+			if err := json.Unmarshal(body, &e); err != nil {
+				fmt.Printf("Erro do servidor: %s\n", string(body))
+				continue
+			}
+			fmt.Printf("Erro do servidor (%s): %s\n", e.Code, e.Message)
+			if e.Retryable {
+				fmt.Println("O pedido pode ser repetido.")
+			}
+			if e.Fatal {
+				fmt.Println("O servidor vai fechar a ligação.")
+			}
 		default:
-			fmt.Printf("Mensagem desconhecida do servidor (tipo %d): %s\n", messageType, string(body))
+			fmt.Printf("Mensagem desconhecida do servidor (tipo %d): %s\n", header.Type, string(body))
 		}
 	}
 }
\ No newline at end of file
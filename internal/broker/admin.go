@@ -0,0 +1,312 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+	"github.com/tiagomorais/simple-message-broker/internal/storage"
+	"github.com/tiagomorais/simple-message-broker/internal/wal"
+)
+
+func (b *Broker) handleCreateTopic(f frame, sess *session) {
+	var req protocol.CreateTopic
+	if err := sess.codec.Unmarshal(f.body, &req); err != nil {
+		log.Printf("Error decoding CREATE_TOPIC message: %v\n", err)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Invalid CREATE_TOPIC body: "+err.Error())
+		return
+	}
+	if err := protocol.ValidateTopic(req.Topic); err != nil {
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeInvalidTopic, err.Error())
+		return
+	}
+
+	cfg, err := overrideConfig(b.wal.TopicConfig(req.Topic), req.Config)
+	if err == nil && cfg.DeadLetterTopic == req.Topic {
+		err = errors.New("a topic can't be its own dead-letter topic")
+	}
+	if err == nil {
+		err = validateACLs(req.ACLs)
+	}
+	if err != nil {
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeBadRequest, fmt.Sprintf("Invalid configuration for topic %s: %v", req.Topic, err))
+		return
+	}
+	if err := b.wal.CreateTopic(req.Topic, cfg); err != nil {
+		if errors.Is(err, wal.ErrTopicExists) {
+			sess.sendError(f.CorrelationID, protocol.ErrorCodeTopicExists, "Topic "+req.Topic+" already exists")
+			return
+		}
+		log.Printf("Error creating topic %s: %v\n", req.Topic, err)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeStorage, err.Error())
+		return
+	}
+	stored := req.Config
+	stored.Partitions = cfg.Partitions
+	if err := b.storeConfig(req.Topic, storage.TopicMetadata{TopicConfig: stored, ACLs: req.ACLs}); err != nil {
+		// A topic whose configuration would be lost on restart is not
+		// created
+		log.Printf("Error storing the configuration of topic %s: %v\n", req.Topic, err)
+		if err := b.wal.DeleteTopic(req.Topic); err != nil {
+			log.Printf("Error deleting topic %s: %v\n", req.Topic, err)
+		}
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeStorage, err.Error())
+		return
+	}
+	log.Printf("Created topic %s with %d partitions\n", req.Topic, b.wal.Partitions(req.Topic))
+
+	list := protocol.TopicList{Topics: []protocol.TopicInfo{b.describe(req.Topic)}}
+	if err := sess.sendTopicList(f.CorrelationID, list); err != nil {
+		log.Printf("Error writing topic list: %v\n", err)
+	}
+}
+
+// overrideConfig returns cfg with the settings c sets, as in CREATE_TOPIC:
+// zero values keep the ones in cfg and negative limits remove them
+func overrideConfig(cfg wal.TopicConfig, c protocol.TopicConfig) (wal.TopicConfig, error) {
+	if c.Partitions < 0 {
+		return cfg, errors.New("partitions must not be negative")
+	}
+	if c.Partitions > 0 {
+		cfg.Partitions = c.Partitions
+	}
+	switch c.CleanupPolicy {
+	case "":
+	case wal.CleanupPolicyDelete, wal.CleanupPolicyCompact:
+		cfg.CleanupPolicy = c.CleanupPolicy
+	default:
+		return cfg, fmt.Errorf("unknown cleanup policy %q", c.CleanupPolicy)
+	}
+
+	// Negative limits remove the default ones
+	if c.RetentionMs != 0 {
+		cfg.Retention.MaxAge = time.Duration(max(c.RetentionMs, 0)) * time.Millisecond
+	}
+	if c.RetentionBytes != 0 {
+		cfg.Retention.MaxBytes = max(c.RetentionBytes, 0)
+	}
+	if c.RetentionMessages != 0 {
+		cfg.Retention.MaxMessages = max(c.RetentionMessages, 0)
+	}
+	if c.TombstoneRetentionMs != 0 {
+		cfg.TombstoneRetention = time.Duration(max(c.TombstoneRetentionMs, 0)) * time.Millisecond
+	}
+	if c.MaxMessageBytes != 0 {
+		cfg.MaxMessageBytes = max(c.MaxMessageBytes, 0)
+	}
+	if c.MaxDeliveries != 0 {
+		cfg.MaxDeliveries = max(c.MaxDeliveries, 0)
+	}
+	if c.DeadLetterTopic != "" {
+		if err := protocol.ValidateTopic(c.DeadLetterTopic); err != nil {
+			return cfg, fmt.Errorf("dead-letter topic: %w", err)
+		}
+		cfg.DeadLetterTopic = c.DeadLetterTopic
+	}
+
+	switch c.Durability {
+	case "":
+	case wal.DurabilityAlways, wal.DurabilityInterval, wal.DurabilityMessages, wal.DurabilityOS:
+		cfg.Durability.Mode = c.Durability
+	default:
+		return cfg, fmt.Errorf("unknown durability %q", c.Durability)
+	}
+	if c.SyncIntervalMs < 0 || c.SyncMessages < 0 {
+		return cfg, errors.New("sync interval and messages must not be negative")
+	}
+	if c.SyncIntervalMs > 0 {
+		cfg.Durability.Interval = time.Duration(c.SyncIntervalMs) * time.Millisecond
+	}
+	if c.SyncMessages > 0 {
+		cfg.Durability.Messages = c.SyncMessages
+	}
+	return cfg, nil
+}
+
+// validateACLs checks the operation and permission of every ACL binding
+func validateACLs(acls []protocol.ACLBinding) error {
+	for i, acl := range acls {
+		switch {
+		case acl.Principal == "":
+			return fmt.Errorf("ACL binding %d has no principal", i)
+		case acl.Operation != protocol.ACLOperationPublish && acl.Operation != protocol.ACLOperationSubscribe && acl.Operation != protocol.ACLOperationAdmin:
+			return fmt.Errorf("ACL binding %d has unknown operation %q", i, acl.Operation)
+		case acl.Permission != protocol.ACLPermissionAllow && acl.Permission != protocol.ACLPermissionDeny:
+			return fmt.Errorf("ACL binding %d has unknown permission %q", i, acl.Permission)
+		}
+	}
+	return nil
+}
+
+// rememberTopic persists the number of partitions of a topic created by
+// publishing to it, so it keeps them across restarts. Topics that already
+// have stored settings keep them.
+func (b *Broker) rememberTopic(topic string) {
+	if b.opts.Topics == nil {
+		return
+	}
+	if _, ok := b.opts.Topics.Get(topic); ok {
+		return
+	}
+	md := storage.TopicMetadata{TopicConfig: protocol.TopicConfig{Partitions: b.wal.Partitions(topic)}}
+	if err := b.opts.Topics.Add(topic, md); err != nil {
+		log.Printf("Error storing the configuration of topic %s: %v\n", topic, err)
+	}
+}
+
+// storeConfig persists the settings of a topic
+func (b *Broker) storeConfig(topic string, md storage.TopicMetadata) error {
+	if b.opts.Topics == nil {
+		return nil
+	}
+	return b.opts.Topics.Put(topic, md)
+}
+
+// storedConfig returns the configuration of a topic stored as md. The
+// settings it doesn't set keep the values the topic would have without it.
+func (b *Broker) storedConfig(topic string, md storage.TopicMetadata) (wal.TopicConfig, error) {
+	return overrideConfig(b.wal.TopicConfig(topic), md.TopicConfig)
+}
+
+func (b *Broker) handleDeleteTopic(f frame, sess *session) {
+	var req protocol.DeleteTopic
+	if err := sess.codec.Unmarshal(f.body, &req); err != nil {
+		log.Printf("Error decoding DELETE_TOPIC message: %v\n", err)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Invalid DELETE_TOPIC body: "+err.Error())
+		return
+	}
+
+	// Holding the lock keeps subscriptions from being made while the topic
+	// is deleted, so no group is left at a position in the old log
+	b.subscriptions.Lock()
+	_, inUse := b.subscriptions.m[req.Topic]
+	var err error
+	if !inUse {
+		err = b.wal.DeleteTopic(req.Topic)
+		if err == nil {
+			b.offsetStore.DeleteTopic(req.Topic)
+		}
+	}
+	b.subscriptions.Unlock()
+
+	switch {
+	case inUse:
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeTopicInUse, "Topic "+req.Topic+" has subscribers")
+		return
+	case errors.Is(err, wal.ErrUnknownTopic):
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeUnknownTopic, "Topic "+req.Topic+" does not exist")
+		return
+	case err != nil:
+		log.Printf("Error deleting topic %s: %v\n", req.Topic, err)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeStorage, err.Error())
+		return
+	}
+	log.Printf("Deleted topic %s\n", req.Topic)
+	if b.opts.Topics != nil {
+		if err := b.opts.Topics.Delete(req.Topic); err != nil {
+			log.Printf("Error deleting the stored configuration of topic %s: %v\n", req.Topic, err)
+		}
+	}
+	if err := b.offsetStore.Save(); err != nil {
+		log.Printf("Error saving offsets: %v\n", err)
+	}
+
+	list := protocol.TopicList{Topics: []protocol.TopicInfo{{Topic: req.Topic}}}
+	if err := sess.sendTopicList(f.CorrelationID, list); err != nil {
+		log.Printf("Error writing topic list: %v\n", err)
+	}
+}
+
+func (b *Broker) handleListTopics(f frame, sess *session) {
+	list := protocol.TopicList{Topics: []protocol.TopicInfo{}}
+	for _, topic := range b.wal.Topics() {
+		info := protocol.TopicInfo{Topic: topic, Config: b.configInfo(topic)}
+		for partition := 0; partition < info.Config.Partitions; partition++ {
+			info.SizeBytes += b.wal.Size(topic, partition)
+		}
+		list.Topics = append(list.Topics, info)
+	}
+	if err := sess.sendTopicList(f.CorrelationID, list); err != nil {
+		log.Printf("Error writing topic list: %v\n", err)
+	}
+}
+
+func (b *Broker) handleDescribeTopic(f frame, sess *session) {
+	var req protocol.DescribeTopic
+	if err := sess.codec.Unmarshal(f.body, &req); err != nil {
+		log.Printf("Error decoding DESCRIBE_TOPIC message: %v\n", err)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Invalid DESCRIBE_TOPIC body: "+err.Error())
+		return
+	}
+	if !b.wal.HasTopic(req.Topic) {
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeUnknownTopic, "Topic "+req.Topic+" does not exist")
+		return
+	}
+
+	list := protocol.TopicList{Topics: []protocol.TopicInfo{b.describe(req.Topic)}}
+	if err := sess.sendTopicList(f.CorrelationID, list); err != nil {
+		log.Printf("Error writing topic list: %v\n", err)
+	}
+}
+
+// describe returns the configuration, partitions, subscribers and ACL
+// bindings of a topic
+func (b *Broker) describe(topic string) protocol.TopicInfo {
+	info := protocol.TopicInfo{Topic: topic, Config: b.configInfo(topic)}
+	for partition := 0; partition < info.Config.Partitions; partition++ {
+		p := protocol.PartitionInfo{
+			Partition:   partition,
+			StartOffset: b.wal.StartOffset(topic, partition),
+			NextOffset:  b.wal.NextOffset(topic, partition),
+			SizeBytes:   b.wal.Size(topic, partition),
+		}
+		info.Partitions = append(info.Partitions, p)
+		info.SizeBytes += p.SizeBytes
+	}
+
+	var groups []*consumerGroup
+	b.subscriptions.RLock()
+	if subs, ok := b.subscriptions.m[topic]; ok {
+		groups = subs.all()
+	}
+	b.subscriptions.RUnlock()
+
+	for _, g := range groups {
+		info.Subscribers = append(info.Subscribers, g.describe())
+	}
+	if b.opts.Topics != nil {
+		md, _ := b.opts.Topics.Get(topic)
+		info.ACLs = md.ACLs
+	}
+	slices.SortStableFunc(info.Subscribers, func(a, b protocol.SubscriberInfo) int {
+		return strings.Compare(a.Group, b.Group)
+	})
+	return info
+}
+
+// configInfo returns the configuration in effect for a topic as reported
+// in TOPIC_LIST
+func (b *Broker) configInfo(topic string) protocol.TopicConfig {
+	cfg := b.wal.TopicConfig(topic)
+	if cfg.CleanupPolicy == "" {
+		cfg.CleanupPolicy = wal.CleanupPolicyDelete
+	}
+	return protocol.TopicConfig{
+		Partitions:           b.wal.Partitions(topic),
+		RetentionMs:          cfg.Retention.MaxAge.Milliseconds(),
+		RetentionBytes:       cfg.Retention.MaxBytes,
+		RetentionMessages:    cfg.Retention.MaxMessages,
+		CleanupPolicy:        cfg.CleanupPolicy,
+		TombstoneRetentionMs: cfg.TombstoneRetention.Milliseconds(),
+		MaxMessageBytes:      cfg.MaxMessageBytes,
+		Durability:           cfg.Durability.Mode,
+		SyncIntervalMs:       cfg.Durability.Interval.Milliseconds(),
+		SyncMessages:         cfg.Durability.Messages,
+		MaxDeliveries:        cfg.MaxDeliveries,
+		DeadLetterTopic:      cfg.DeadLetterTopic,
+	}
+}
@@ -2,12 +2,17 @@ package broker
 
 import (
 	"bufio"
-	"encoding/binary"
+	"cmp"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tiagomorais/simple-message-broker/internal/protocol"
 	"github.com/tiagomorais/simple-message-broker/internal/storage"
@@ -18,60 +23,136 @@ import (
 type Broker struct {
 	wal           *wal.WAL
 	offsetStore   *storage.OffsetStore
+	opts          Options
+	roundRobin    atomic.Uint64 // partition counter for messages without a key
 	subscriptions struct {
 		sync.RWMutex
-		m map[string][]net.Conn
+		m map[string]*topicSubscriptions
 	}
 }
 
+// topicSubscriptions holds the subscriptions of one topic
+type topicSubscriptions struct {
+	groups    map[string]*consumerGroup   // queue subscriptions by group name
+	broadcast map[*session]*consumerGroup // broadcast subscriptions
+}
+
+// all returns every group subscribed to the topic
+func (t *topicSubscriptions) all() []*consumerGroup {
+	groups := make([]*consumerGroup, 0, len(t.groups)+len(t.broadcast))
+	for _, g := range t.groups {
+		groups = append(groups, g)
+	}
+	for _, g := range t.broadcast {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// Options configures a Broker
+type Options struct {
+	// DisableAutoCreate makes publishes to topics that don't exist fail
+	// instead of creating the topic, so topics must be created with
+	// CREATE_TOPIC first. Dead-letter topics are still created as needed.
+	DisableAutoCreate bool
+	// Topics persists the configuration and ACL bindings of topics, whether
+	// created with CREATE_TOPIC or on their first publish. The
+	// configurations it holds are applied to the WAL when the broker is
+	// created. Without it they only last until a restart.
+	Topics *storage.TopicStore
+	// WriteTimeout is how long a client may take to read the frames
+	// written to it before its connection is closed, so a consumer that
+	// stops reading hands its messages to the rest of its group. Zero means
+	// 30 seconds.
+	WriteTimeout time.Duration
+}
+
 // NewBroker creates a new Broker instance
-func NewBroker(w *wal.WAL, store *storage.OffsetStore) *Broker {
+func NewBroker(w *wal.WAL, store *storage.OffsetStore, opts Options) *Broker {
 	b := &Broker{
 		wal:         w,
 		offsetStore: store,
+		opts:        opts,
+	}
+	b.subscriptions.m = make(map[string]*topicSubscriptions)
+	if opts.Topics != nil {
+		for topic, md := range opts.Topics.All() {
+			cfg, err := b.storedConfig(topic, md)
+			if err != nil {
+				log.Printf("Error in the stored settings of topic %s, using the defaults: %v\n", topic, err)
+				cfg = w.TopicConfig(topic)
+				cfg.Partitions = md.Partitions
+			}
+			w.SetTopicConfig(topic, cfg)
+		}
 	}
-	b.subscriptions.m = make(map[string][]net.Conn)
 	return b
 }
 
-// readHeader reads and parses the message header from a connection.
-// Returns the message type, body length, and any error encountered.
-func readHeader(reader *bufio.Reader) (messageType byte, bodyLength uint32, err error) {
-	header := make([]byte, 5)
-	_, err = io.ReadFull(reader, header)
-	if err != nil {
-		return 0, 0, err
-	}
+// ServerVersion is the broker release reported in HELLO
+const ServerVersion = "1.0.0"
+
+// features lists the optional parts of the protocol the broker supports,
+// reported in HELLO
+var features = []string{
+	protocol.FeatureBinaryCodec,
+	protocol.FeaturePublishAck,
+	protocol.FeatureNack,
+	protocol.FeatureSeek,
+	protocol.FeaturePrefetch,
+	protocol.FeatureAckRanges,
+	protocol.FeatureDeadLetter,
+	protocol.FeatureBroadcast,
+	protocol.FeaturePublishBatch,
+	protocol.FeatureTopicAdmin,
+}
 
-	messageType = header[0]
-	bodyLength = binary.BigEndian.Uint32(header[1:])
-	return messageType, bodyLength, nil
+// frame is a frame received from a client
+type frame struct {
+	protocol.Header
+	body []byte
 }
 
 // HandleConnection handles a client connection
 func (b *Broker) HandleConnection(conn net.Conn) {
 	defer conn.Close()
 	reader := bufio.NewReader(conn)
+	sess := newSession(conn, cmp.Or(b.opts.WriteTimeout, defaultWriteTimeout))
+	// The frames queued before the connection closes, such as a fatal
+	// error, are written first
+	defer sess.close()
+	defer b.unsubscribeAll(sess)
 
-	for {
-		messageType, bodyLength, err := readHeader(reader)
+	for first := true; ; first = false {
+		if !sess.waitQueue() {
+			return
+		}
+		header, err := protocol.ReadHeader(reader, sess.version)
 		if err != nil {
 			if err == io.EOF {
 				return
 			}
 			log.Println("Error reading header:", err)
+			if errors.Is(err, protocol.ErrFrameVersion) {
+				sess.sendFatalError(header.CorrelationID, protocol.ErrorCodeProtocol, err.Error())
+			}
 			return
 		}
 
-		// Check body size limit
-		if bodyLength > protocol.MaxBodySize {
+		// Check body size limit, skipping the body of frames over it
+		if header.Length > protocol.MaxBodySize {
 			log.Println("Body size exceeds 1MB limit.")
-			return
+			if _, err := io.CopyN(io.Discard, reader, int64(header.Length)); err != nil {
+				log.Println("Error reading body:", err)
+				return
+			}
+			sess.sendError(header.CorrelationID, protocol.ErrorCodeFrameTooLarge, fmt.Sprintf("Body of %d bytes exceeds the limit of %d bytes", header.Length, protocol.MaxBodySize))
+			continue
 		}
 
 		// Read body
-		body := make([]byte, bodyLength)
-		_, err = io.ReadFull(reader, body)
+		f := frame{Header: header, body: make([]byte, header.Length)}
+		_, err = io.ReadFull(reader, f.body)
 		if err != nil {
 			if err == io.EOF {
 				return
@@ -81,63 +162,348 @@ func (b *Broker) HandleConnection(conn net.Conn) {
 		}
 
 		// Process message
-		switch messageType {
+		switch f.Type {
+		case protocol.MessageTypeHello:
+			if !b.handleHello(f, sess, first) {
+				return
+			}
 		case protocol.MessageTypePublish:
-			b.handlePublish(body)
+			b.handlePublish(f, sess)
+		case protocol.MessageTypePublishBatch:
+			b.handlePublishBatch(f, sess)
 		case protocol.MessageTypeSubscribe:
-			if !b.handleSubscribe(body, conn) {
+			if !b.handleSubscribe(f, sess) {
 				return
 			}
 		case protocol.MessageTypeAck:
-			b.handleAck(body, conn)
+			b.handleAck(f, sess)
+		case protocol.MessageTypeNack:
+			b.handleNack(f, sess)
+		case protocol.MessageTypeSeek:
+			b.handleSeek(f, sess)
+		case protocol.MessageTypeCreateTopic:
+			b.handleCreateTopic(f, sess)
+		case protocol.MessageTypeDeleteTopic:
+			b.handleDeleteTopic(f, sess)
+		case protocol.MessageTypeListTopics:
+			b.handleListTopics(f, sess)
+		case protocol.MessageTypeDescribeTopic:
+			b.handleDescribeTopic(f, sess)
 		default:
-			log.Println("Unknown message type:", messageType)
-			return
+			log.Println("Unknown message type:", f.Type)
+			sess.sendError(f.CorrelationID, protocol.ErrorCodeUnknownType, fmt.Sprintf("Unknown frame type %#x", f.Type))
+		}
+	}
+}
+
+// handleHello agrees on the protocol version and switches the connection
+// to the first codec in the client's list that the broker supports. It must
+// be the connection's first frame, so neither changes once other frames
+// have been exchanged. The reply uses the version 1 frame layout, like the
+// request, and the connection switches layout after it.
+func (b *Broker) handleHello(f frame, sess *session, first bool) bool {
+	var hello protocol.Hello
+	if err := json.Unmarshal(f.body, &hello); err != nil {
+		log.Printf("Error decoding HELLO message: %v\n", err)
+		sess.sendFatalError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Invalid HELLO body: "+err.Error())
+		return false
+	}
+	if !first {
+		log.Printf("HELLO rejected: not the first frame of the connection\n")
+		sess.sendFatalError(f.CorrelationID, protocol.ErrorCodeProtocol, "HELLO must be the first frame of the connection")
+		return false
+	}
+	if hello.Version < protocol.FrameVersion1 {
+		log.Printf("HELLO rejected: unsupported version %d\n", hello.Version)
+		sess.sendFatalError(f.CorrelationID, protocol.ErrorCodeUnsupported, fmt.Sprintf("Unsupported protocol version %d", hello.Version))
+		return false
+	}
+	version := min(hello.Version, protocol.Version)
+
+	codec := protocol.JSON
+	if len(hello.Codecs) > 0 {
+		codec = nil
+		for _, name := range hello.Codecs {
+			if c, ok := protocol.CodecByName(name); ok {
+				codec = c
+				break
+			}
+		}
+		if codec == nil {
+			log.Printf("HELLO rejected: no supported codec in %v\n", hello.Codecs)
+			sess.sendFatalError(f.CorrelationID, protocol.ErrorCodeUnsupported, fmt.Sprintf("No supported codec in %v", hello.Codecs))
+			return false
 		}
 	}
+
+	reply, err := json.Marshal(protocol.Hello{
+		Version:       version,
+		Codec:         codec.Name(),
+		ServerVersion: ServerVersion,
+		Features:      features,
+	})
+	if err != nil {
+		log.Printf("Error encoding HELLO message: %v\n", err)
+		return false
+	}
+	if err := sess.send(protocol.MessageTypeHello, f.CorrelationID, reply); err != nil {
+		log.Printf("Error writing HELLO message: %v\n", err)
+		return false
+	}
+	sess.version = byte(version)
+	sess.codec = codec
+	return true
 }
 
-func (b *Broker) handlePublish(body []byte) {
-	var msg protocol.Message
-	if err := json.Unmarshal(body, &msg); err != nil {
+func (b *Broker) handlePublish(f frame, sess *session) {
+	var pub protocol.Publish
+	if err := sess.codec.Unmarshal(f.body, &pub); err != nil {
 		log.Printf("Error decoding PUBLISH message: %v\n", err)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Invalid PUBLISH body: "+err.Error())
+		return
+	}
+	msg := pub.Message
+	msg.Redeliveries = 0
+	if err := protocol.ValidateTopic(msg.Topic); err != nil {
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeInvalidTopic, err.Error())
+		return
+	}
+	if !b.canPublish(msg.Topic) {
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeUnknownTopic, "Topic "+msg.Topic+" does not exist")
 		return
 	}
+	if err := b.checkSize(msg); err != nil {
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeMessageTooLarge, err.Error())
+		return
+	}
+
+	// Keep messages with the same key in one partition, and spread the
+	// others evenly
+	partitions := b.wal.Partitions(msg.Topic)
+	if msg.Key != "" {
+		msg.Partition = protocol.PartitionForKey(msg.Key, partitions)
+	} else {
+		msg.Partition = int((b.roundRobin.Add(1) - 1) % uint64(partitions))
+	}
 
-	if _, err := b.wal.Append(msg); err != nil {
+	ack := protocol.PublishAck{Topic: msg.Topic, Partition: msg.Partition}
+	offset, err := b.wal.Append(msg)
+	if err != nil {
 		log.Printf("Error writing to WAL for topic %s: %v\n", msg.Topic, err)
+		ack.Error = protocol.NewError(protocol.ErrorCodeStorage, err.Error())
+		ack.Error.CorrelationID = f.CorrelationID
+	} else {
+		ack.Offset = int64(offset)
+	}
+
+	// Producers that didn't ask for an acknowledgement still learn about
+	// failures
+	switch {
+	case pub.RequestAck:
+		if err := sess.sendPublishAck(f.CorrelationID, ack); err != nil {
+			log.Printf("Error writing publish acknowledgement: %v\n", err)
+		}
+	case ack.Error != nil:
+		sess.writeError(f.CorrelationID, ack.Error)
+	}
+	if ack.Error != nil {
 		return
 	}
 
-	// Notify subscriber if one exists and is waiting
+	b.published(msg.Topic)
+}
+
+func (b *Broker) handlePublishBatch(f frame, sess *session) {
+	var batch protocol.PublishBatch
+	if err := sess.codec.Unmarshal(f.body, &batch); err != nil {
+		log.Printf("Error decoding PUBLISH_BATCH message: %v\n", err)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Invalid PUBLISH_BATCH body: "+err.Error())
+		return
+	}
+	if len(batch.Messages) == 0 {
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeBadRequest, "PUBLISH_BATCH has no messages")
+		return
+	}
+	for i, msg := range batch.Messages {
+		if err := protocol.ValidateTopic(msg.Topic); err != nil {
+			sess.sendError(f.CorrelationID, protocol.ErrorCodeInvalidTopic, fmt.Sprintf("Message %d: %v", i, err))
+			return
+		}
+		if !b.canPublish(msg.Topic) {
+			sess.sendError(f.CorrelationID, protocol.ErrorCodeUnknownTopic, fmt.Sprintf("Message %d: topic %s does not exist", i, msg.Topic))
+			return
+		}
+		if err := b.checkSize(msg); err != nil {
+			sess.sendError(f.CorrelationID, protocol.ErrorCodeMessageTooLarge, fmt.Sprintf("Message %d: %v", i, err))
+			return
+		}
+	}
+
+	// Route keyed messages as PUBLISH does, and send the others for each
+	// topic to one partition so they stay in order
+	var topics []string
+	keyless := make(map[string]int)
+	ack := protocol.PublishBatchAck{Partitions: make([]int, len(batch.Messages))}
+	for i := range batch.Messages {
+		msg := &batch.Messages[i]
+		msg.Redeliveries = 0
+
+		partitions := b.wal.Partitions(msg.Topic)
+		partition, ok := keyless[msg.Topic]
+		switch {
+		case msg.Key != "":
+			msg.Partition = protocol.PartitionForKey(msg.Key, partitions)
+		case ok:
+			msg.Partition = partition
+		default:
+			msg.Partition = int((b.roundRobin.Add(1) - 1) % uint64(partitions))
+			keyless[msg.Topic] = msg.Partition
+		}
+		ack.Partitions[i] = msg.Partition
+		if !slices.Contains(topics, msg.Topic) {
+			topics = append(topics, msg.Topic)
+		}
+	}
+
+	offsets, err := b.wal.AppendBatch(batch.Messages)
+	if err != nil {
+		log.Printf("Error writing batch to WAL: %v\n", err)
+		ack = protocol.PublishBatchAck{Error: protocol.NewError(protocol.ErrorCodeStorage, err.Error())}
+		ack.Error.CorrelationID = f.CorrelationID
+		// Sending the batch again would store part of it twice
+		if errors.Is(err, wal.ErrPartialBatch) {
+			ack.Error.Retryable = false
+		}
+	} else {
+		ack.Ranges = offsetRanges(batch.Messages, offsets)
+	}
+
+	// Producers that didn't ask for an acknowledgement still learn about
+	// failures
+	switch {
+	case batch.RequestAck:
+		if err := sess.sendPublishBatchAck(f.CorrelationID, ack); err != nil {
+			log.Printf("Error writing publish batch acknowledgement: %v\n", err)
+		}
+	case ack.Error != nil:
+		sess.writeError(f.CorrelationID, ack.Error)
+	}
+	if ack.Error != nil {
+		return
+	}
+
+	for _, topic := range topics {
+		b.published(topic)
+	}
+}
+
+// canPublish reports whether messages may be published to topic, which
+// is created on publish unless the broker was configured not to
+func (b *Broker) canPublish(topic string) bool {
+	return !b.opts.DisableAutoCreate || b.wal.HasTopic(topic)
+}
+
+// checkSize returns an error if msg is over its topic's maximum message
+// size
+func (b *Broker) checkSize(msg protocol.Message) error {
+	limit := b.wal.TopicConfig(msg.Topic).MaxMessageBytes
+	if size := len(msg.Message) + len(msg.Payload); limit > 0 && size > limit {
+		return fmt.Errorf("message of %d bytes exceeds the limit of %d bytes of topic %s", size, limit, msg.Topic)
+	}
+	return nil
+}
+
+// offsetRanges returns the range of offsets given to the messages of each
+// partition, in the order the partitions first appear in msgs
+func offsetRanges(msgs []protocol.Message, offsets []int64) []protocol.OffsetRange {
+	var ranges []protocol.OffsetRange
+	for i, msg := range msgs {
+		j := slices.IndexFunc(ranges, func(r protocol.OffsetRange) bool {
+			return r.Topic == msg.Topic && r.Partition == msg.Partition
+		})
+		if j < 0 {
+			ranges = append(ranges, protocol.OffsetRange{
+				Topic:       msg.Topic,
+				Partition:   msg.Partition,
+				FirstOffset: offsets[i],
+			})
+			j = len(ranges) - 1
+		}
+		ranges[j].LastOffset = offsets[i]
+	}
+	return ranges
+}
+
+// published delivers the messages appended to a topic to every group
+// subscribed to it, and persists the configuration of the topic if the
+// append created it
+func (b *Broker) published(topic string) {
+	b.rememberTopic(topic)
+
+	var groups []*consumerGroup
 	b.subscriptions.RLock()
-	defer b.subscriptions.RUnlock()
-	if conns, ok := b.subscriptions.m[msg.Topic]; ok && len(conns) > 0 {
-		offset := b.offsetStore.Get(msg.Topic)
-		b.sendMessageFromWALAtOffset(conns[0], msg.Topic, offset)
+	if subs, ok := b.subscriptions.m[topic]; ok {
+		groups = subs.all()
+	}
+	b.subscriptions.RUnlock()
+
+	for _, g := range groups {
+		g.dispatch()
 	}
 }
 
-func (b *Broker) handleSubscribe(body []byte, conn net.Conn) bool {
+func (b *Broker) handleSubscribe(f frame, sess *session) bool {
 	var sub protocol.Subscription
-	if err := json.Unmarshal(body, &sub); err != nil {
+	if err := sess.codec.Unmarshal(f.body, &sub); err != nil {
 		log.Printf("Error decoding SUBSCRIBE message: %v\n", err)
+		sess.sendFatalError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Invalid SUBSCRIBE body: "+err.Error())
+		return false
+	}
+	if err := protocol.ValidateTopic(sub.Topic); err != nil {
+		log.Printf("Subscription rejected: %v\n", err)
+		sess.sendFatalError(f.CorrelationID, protocol.ErrorCodeInvalidTopic, err.Error())
+		return false
+	}
+	if sub.Group == "" {
+		sub.Group = protocol.DefaultGroup
+	}
+	if sub.Mode == "" {
+		sub.Mode = protocol.SubscriptionModeQueue
+	}
+	if sub.Mode != protocol.SubscriptionModeQueue && sub.Mode != protocol.SubscriptionModeShared && sub.Mode != protocol.SubscriptionModeBroadcast {
+		log.Printf("Subscription rejected for topic %s: unknown mode %s\n", sub.Topic, sub.Mode)
+		sess.sendFatalError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Unknown subscription mode "+sub.Mode)
 		return false
 	}
-	sub.Conn = conn
 
-	if !b.subscribe(sub) {
-		log.Printf("Subscription rejected for topic %s: already has a consumer\n", sub.Topic)
-		b.sendErrorToClient(conn, "Topic already has a consumer")
+	if sub.Prefetch == 0 {
+		sub.Prefetch = defaultPrefetch
+	}
+	if sub.Prefetch < 0 || sub.Prefetch > maxPrefetch {
+		log.Printf("Subscription rejected for topic %s: invalid prefetch %d\n", sub.Topic, sub.Prefetch)
+		sess.sendFatalError(f.CorrelationID, protocol.ErrorCodeBadRequest, fmt.Sprintf("Prefetch must be between 1 and %d", maxPrefetch))
 		return false
 	}
 
-	log.Printf("New subscription for topic: %s\n", sub.Topic)
+	if _, ok := sess.groups[sub.Topic]; ok {
+		log.Printf("Subscription rejected for topic %s: connection already subscribed\n", sub.Topic)
+		sess.sendFatalError(f.CorrelationID, protocol.ErrorCodeAlreadySubscribed, "Already subscribed to topic "+sub.Topic)
+		return false
+	}
 
-	// Initialize topic offset if needed
-	b.offsetStore.InitTopic(sub.Topic)
-	offset := b.offsetStore.Get(sub.Topic)
-	b.sendMessageFromWALAtOffset(conn, sub.Topic, offset)
+	g, err := b.subscribe(sub, sess)
+	if err != nil {
+		log.Printf("Subscription rejected for topic %s: %v\n", sub.Topic, err)
+		sess.sendFatalError(f.CorrelationID, protocol.ErrorCodeBadRequest, err.Error())
+		return false
+	}
+	if sub.Mode == protocol.SubscriptionModeBroadcast {
+		log.Printf("New broadcast subscription for topic %s\n", sub.Topic)
+	} else {
+		log.Printf("New %s subscription for topic %s in group %s\n", sub.Mode, sub.Topic, sub.Group)
+	}
+
+	g.dispatch()
 	if err := b.offsetStore.Save(); err != nil {
 		log.Printf("Error saving offsets: %v\n", err)
 	}
@@ -145,64 +511,229 @@ func (b *Broker) handleSubscribe(body []byte, conn net.Conn) bool {
 	return true
 }
 
-func (b *Broker) handleAck(body []byte, conn net.Conn) {
+func (b *Broker) handleAck(f frame, sess *session) {
 	var ack protocol.Ack
-	if err := json.Unmarshal(body, &ack); err != nil {
+	if err := sess.codec.Unmarshal(f.body, &ack); err != nil {
 		log.Printf("Error decoding ACK message: %v\n", err)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Invalid ACK body: "+err.Error())
+		return
+	}
+
+	g, ok := sess.groups[ack.Topic]
+	if !ok {
+		log.Printf("ACK received for topic %s without a subscription\n", ack.Topic)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeNotSubscribed, "Not subscribed to topic "+ack.Topic)
 		return
 	}
 
-	log.Printf("ACK received for topic %s, offset %d\n", ack.Topic, ack.Offset)
+	ranges := ack.Ranges
+	switch {
+	case len(ranges) > 0:
+	case ack.Cumulative:
+		ranges = []protocol.AckRange{{From: 0, To: ack.Offset}}
+	default:
+		ranges = []protocol.AckRange{{From: ack.Offset, To: ack.Offset}}
+	}
+
+	acked := false
+	for _, r := range ranges {
+		log.Printf("ACK received for topic %s partition %d in group %s, offsets %d-%d\n", ack.Topic, ack.Partition, g.name, r.From, r.To)
+		if err := g.ack(sess, ack.Partition, r.From, r.To); err != nil {
+			log.Printf("ACK rejected for topic %s partition %d: %v\n", ack.Topic, ack.Partition, err)
+			sess.sendError(f.CorrelationID, protocol.ErrorCodeInvalidOffset, fmt.Sprintf("ACK rejected for topic %s partition %d: %v", ack.Topic, ack.Partition, err))
+			continue
+		}
+		acked = true
+	}
+	if !acked {
+		return
+	}
 
-	// Advance offset and send next message
-	offset := b.offsetStore.Increment(ack.Topic)
-	b.sendMessageFromWALAtOffset(conn, ack.Topic, offset)
+	// Refill the consumer's prefetch window and persist the group's new
+	// position
+	g.dispatch()
 	if err := b.offsetStore.Save(); err != nil {
 		log.Printf("Error saving offsets: %v\n", err)
 	}
 }
 
-func (b *Broker) subscribe(sub protocol.Subscription) bool {
-	b.subscriptions.Lock()
-	defer b.subscriptions.Unlock()
-	if len(b.subscriptions.m[sub.Topic]) > 0 {
-		return false
+func (b *Broker) handleNack(f frame, sess *session) {
+	var nack protocol.Nack
+	if err := sess.codec.Unmarshal(f.body, &nack); err != nil {
+		log.Printf("Error decoding NACK message: %v\n", err)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Invalid NACK body: "+err.Error())
+		return
 	}
-	b.subscriptions.m[sub.Topic] = []net.Conn{sub.Conn}
-	return true
-}
 
-func (b *Broker) sendMessageFromWALAtOffset(conn net.Conn, topic string, offset int64) {
-	msg, err := b.wal.ReadAt(topic, offset)
-	if err != nil || msg == nil {
+	g, ok := sess.groups[nack.Topic]
+	if !ok {
+		log.Printf("NACK received for topic %s without a subscription\n", nack.Topic)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeNotSubscribed, "Not subscribed to topic "+nack.Topic)
 		return
 	}
 
-	body, _ := json.Marshal(msg)
-	header := make([]byte, 5)
-	header[0] = protocol.MessageTypeMessage
-	binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
+	log.Printf("NACK received for topic %s partition %d in group %s, offset %d\n", nack.Topic, nack.Partition, g.name, nack.Offset)
 
-	if _, err := conn.Write(header); err != nil {
-		log.Printf("Error writing message header: %v\n", err)
+	delay := time.Duration(nack.DelayMs) * time.Millisecond
+	if !g.nack(sess, nack.Partition, nack.Offset, delay, nack.Reason) {
+		log.Printf("NACK for offset %d of topic %s partition %d does not match a message delivered to this consumer\n", nack.Offset, nack.Topic, nack.Partition)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeInvalidOffset, fmt.Sprintf("NACK rejected for topic %s partition %d: offset %d is not awaiting an ACK from this consumer", nack.Topic, nack.Partition, nack.Offset))
 		return
 	}
-	if _, err := conn.Write(body); err != nil {
-		log.Printf("Error writing message body: %v\n", err)
-	}
+
+	g.dispatch()
 }
 
-func (b *Broker) sendErrorToClient(conn net.Conn, errMsg string) {
-	header := make([]byte, 5)
-	header[0] = protocol.MessageTypeError
-	msg := []byte(errMsg)
-	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+func (b *Broker) handleSeek(f frame, sess *session) {
+	var seek protocol.Seek
+	if err := sess.codec.Unmarshal(f.body, &seek); err != nil {
+		log.Printf("Error decoding SEEK message: %v\n", err)
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeBadRequest, "Invalid SEEK body: "+err.Error())
+		return
+	}
+	if err := protocol.ValidateTopic(seek.Topic); err != nil {
+		sess.sendError(f.CorrelationID, protocol.ErrorCodeInvalidTopic, err.Error())
+		return
+	}
+	if seek.Group == "" {
+		seek.Group = protocol.DefaultGroup
+	}
 
-	if _, err := conn.Write(header); err != nil {
-		log.Printf("Error writing error header: %v\n", err)
+	offsets, err := b.seekOffsets(seek)
+	if err != nil {
+		log.Printf("SEEK rejected for topic %s in group %s: %v\n", seek.Topic, seek.Group, err)
+		sess.sendError(f.CorrelationID, err.Code, fmt.Sprintf("SEEK rejected for topic %s: %s", seek.Topic, err.Message))
 		return
 	}
-	if _, err := conn.Write(msg); err != nil {
-		log.Printf("Error writing error message: %v\n", err)
+	log.Printf("Moving group %s on topic %s to %v\n", seek.Group, seek.Topic, offsets)
+
+	// Holding the lock keeps the group from being created or removed while
+	// its position changes
+	b.subscriptions.RLock()
+	var g *consumerGroup
+	if subs, ok := b.subscriptions.m[seek.Topic]; ok {
+		g = subs.groups[seek.Group]
+	}
+	if g != nil {
+		g.seek(offsets)
+	} else {
+		for partition, offset := range offsets {
+			b.offsetStore.Set(seek.Group, seek.Topic, partition, offset)
+		}
+	}
+	b.subscriptions.RUnlock()
+
+	if g != nil {
+		g.dispatch()
+	}
+	if err := b.offsetStore.Save(); err != nil {
+		log.Printf("Error saving offsets: %v\n", err)
+	}
+}
+
+// seekOffsets resolves the offset a SEEK moves each partition to, or
+// returns the error to report to the client
+func (b *Broker) seekOffsets(seek protocol.Seek) (map[int]int64, *protocol.Error) {
+	count := b.wal.Partitions(seek.Topic)
+	partitions := seek.Partitions
+	if len(partitions) == 0 {
+		for i := 0; i < count; i++ {
+			partitions = append(partitions, i)
+		}
+	}
+
+	offsets := make(map[int]int64, len(partitions))
+	for _, partition := range partitions {
+		if partition < 0 || partition >= count {
+			return nil, protocol.NewError(protocol.ErrorCodeBadRequest, fmt.Sprintf("partition %d does not exist", partition))
+		}
+		start, next := b.wal.StartOffset(seek.Topic, partition), b.wal.NextOffset(seek.Topic, partition)
+
+		switch seek.Position {
+		case protocol.SeekEarliest:
+			offsets[partition] = start
+		case protocol.SeekLatest:
+			offsets[partition] = next
+		case protocol.SeekOffset:
+			if seek.Offset < start || seek.Offset > next {
+				return nil, protocol.NewError(protocol.ErrorCodeInvalidOffset, fmt.Sprintf("offset %d of partition %d must be between %d and %d", seek.Offset, partition, start, next))
+			}
+			offsets[partition] = seek.Offset
+		case protocol.SeekTimestamp:
+			offset, err := b.wal.OffsetForTime(seek.Topic, partition, time.UnixMilli(seek.TimestampMs))
+			if err != nil {
+				return nil, protocol.NewError(protocol.ErrorCodeStorage, err.Error())
+			}
+			offsets[partition] = offset
+		default:
+			return nil, protocol.NewError(protocol.ErrorCodeBadRequest, fmt.Sprintf("unknown position %q", seek.Position))
+		}
+	}
+	return offsets, nil
+}
+
+// subscribe adds sess to the subscription's consumer group, creating the
+// group if it has no members yet. Broadcast subscriptions get a group of
+// their own. A group's members must all be shared or all be queue members.
+func (b *Broker) subscribe(sub protocol.Subscription, sess *session) (*consumerGroup, error) {
+	b.subscriptions.Lock()
+	defer b.subscriptions.Unlock()
+
+	subs, ok := b.subscriptions.m[sub.Topic]
+	if !ok {
+		subs = &topicSubscriptions{
+			groups:    make(map[string]*consumerGroup),
+			broadcast: make(map[*session]*consumerGroup),
+		}
+		b.subscriptions.m[sub.Topic] = subs
+	}
+
+	var g *consumerGroup
+	shared := sub.Mode == protocol.SubscriptionModeShared
+	if sub.Mode == protocol.SubscriptionModeBroadcast {
+		g = newBroadcastGroup(sub.Topic, b.wal, b.published)
+		subs.broadcast[sess] = g
+	} else if g, ok = subs.groups[sub.Group]; !ok {
+		g = newConsumerGroup(sub.Group, sub.Topic, shared, b.wal, b.offsetStore, b.published)
+		subs.groups[sub.Group] = g
+	} else if g.shared != shared {
+		// Members of a queue group count on having their partitions to
+		// themselves
+		return nil, fmt.Errorf("group %s on topic %s has members in another mode than %s", sub.Group, sub.Topic, sub.Mode)
+	}
+	timeout := defaultVisibilityTimeout
+	if sub.VisibilityTimeoutMs > 0 {
+		timeout = time.Duration(sub.VisibilityTimeoutMs) * time.Millisecond
+	}
+	g.join(sess, timeout, sub.Prefetch)
+	sess.groups[sub.Topic] = g
+	return g, nil
+}
+
+// unsubscribeAll removes sess from every group it joined and hands the
+// messages it was holding to the remaining members
+func (b *Broker) unsubscribeAll(sess *session) {
+	var remaining []*consumerGroup
+
+	b.subscriptions.Lock()
+	for topic, g := range sess.groups {
+		if !g.leave(sess) {
+			remaining = append(remaining, g)
+			continue
+		}
+		subs := b.subscriptions.m[topic]
+		if subs.broadcast[sess] == g {
+			delete(subs.broadcast, sess)
+		} else {
+			delete(subs.groups, g.name)
+		}
+		if len(subs.groups) == 0 && len(subs.broadcast) == 0 {
+			delete(b.subscriptions.m, topic)
+		}
+	}
+	b.subscriptions.Unlock()
+
+	for _, g := range remaining {
+		g.dispatch()
 	}
 }
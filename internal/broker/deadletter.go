@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"log"
+	"slices"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+// exhausted reports whether the message at offset has been delivered as
+// many times as the topic allows
+func (g *consumerGroup) exhausted(p *partitionState, offset int64) bool {
+	limit := g.wal.TopicConfig(g.topic).MaxDeliveries
+	return limit > 0 && p.deliveries[offset] >= limit
+}
+
+// deadLetter moves msg to the topic's dead-letter topic, recording where it
+// came from and why its last delivery failed, and commits the group's
+// position past it. It reports false if the message could not be written,
+// in which case it is delivered again rather than lost.
+func (g *consumerGroup) deadLetter(p *partitionState, msg *protocol.Message) bool {
+	offset := int64(msg.ID)
+	topic := g.wal.TopicConfig(g.topic).DeadLetterTopic
+
+	// A dead-letter topic whose own dead-letter topic would have too long a
+	// name ends the chain: the message is dropped rather than delivered
+	// forever
+	if err := protocol.ValidateTopic(topic); err != nil {
+		log.Printf("Dropping offset %d of topic %s partition %d after %d deliveries to group %s, dead-letter topic is invalid: %v\n", offset, g.topic, p.partition, p.deliveries[offset], g.name, err)
+		g.skip(p, offset)
+		return true
+	}
+
+	dead := *msg
+	dead.Topic = topic
+	dead.ID = 0
+	dead.TimestampMs = 0
+	dead.Redeliveries = 0
+	dead.DeadLetter = &protocol.DeadLetter{
+		Topic:       g.topic,
+		Partition:   p.partition,
+		Offset:      offset,
+		TimestampMs: msg.TimestampMs,
+		Group:       g.name,
+		Deliveries:  p.deliveries[offset],
+		Reason:      p.failures[offset],
+	}
+
+	// Keep the message's key routing, and otherwise mirror its partition
+	partitions := g.wal.Partitions(topic)
+	if dead.Key != "" {
+		dead.Partition = protocol.PartitionForKey(dead.Key, partitions)
+	} else {
+		dead.Partition = p.partition % partitions
+	}
+
+	if _, err := g.wal.Append(dead); err != nil {
+		log.Printf("Error moving offset %d of topic %s partition %d to dead-letter topic %s: %v\n", offset, g.topic, p.partition, topic, err)
+		return false
+	}
+	log.Printf("Moved offset %d of topic %s partition %d to dead-letter topic %s after %d deliveries to group %s: %s\n", offset, g.topic, p.partition, topic, dead.DeadLetter.Deliveries, g.name, dead.DeadLetter.Reason)
+
+	g.skip(p, offset)
+	if !slices.Contains(g.deadLettered, topic) {
+		g.deadLettered = append(g.deadLettered, topic)
+	}
+	return true
+}
+
+// skip forgets the message at offset and commits the group's position past
+// it
+func (g *consumerGroup) skip(p *partitionState, offset int64) {
+	p.forget(offset)
+	if g.store != nil {
+		g.store.Set(g.name, g.topic, p.partition, p.committed())
+	}
+}
@@ -0,0 +1,509 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+	"github.com/tiagomorais/simple-message-broker/internal/storage"
+	"github.com/tiagomorais/simple-message-broker/internal/wal"
+)
+
+// Number of unacknowledged messages a member may hold
+const (
+	defaultPrefetch = 1
+	maxPrefetch     = 10000
+)
+
+// defaultVisibilityTimeout is how long a member may hold a message without
+// acknowledging it when its subscription doesn't say
+const defaultVisibilityTimeout = 30 * time.Second
+
+// consumerGroup tracks the members of a consumer group on one topic.
+// Every message is delivered to one member. Partitions are spread round
+// robin over the members in the order they joined, and each partition is
+// consumed by a single member, so messages with the same key are consumed
+// in order. Members beyond the number of partitions get no messages until
+// another member leaves. A shared group instead gives every partition to
+// every member, which delivers each message to whichever member has room
+// for it, at the cost of per-key ordering. When a member stops consuming a
+// partition, the messages it had in flight are delivered again by the
+// partition's remaining members. Messages a member rejects or doesn't
+// acknowledge within its visibility timeout are delivered again as well,
+// until they reach the topic's maximum number of deliveries and are moved
+// to its dead-letter topic.
+//
+// A broadcast subscription is a group with a single member and no store,
+// so its position only lives as long as the connection.
+type consumerGroup struct {
+	name  string
+	topic string
+	wal   *wal.WAL
+	store *storage.OffsetStore // nil for broadcast subscriptions
+	// shared gives every partition to every member, see
+	// protocol.SubscriptionModeShared
+	shared bool
+
+	// published delivers the messages appended to a topic to its
+	// subscribers. It is called for dead-letter topics.
+	published func(topic string)
+
+	mu           sync.Mutex
+	members      []*member
+	cursor       int // round robin position in members
+	partitions   []*partitionState
+	deadLettered []string // dead-letter topics appended to while dispatching
+}
+
+// member is a session consuming a topic through a group
+type member struct {
+	sess              *session
+	visibilityTimeout time.Duration
+	prefetch          int               // messages the member may hold at once
+	partitions        []*partitionState // partitions assigned to the member
+	cursor            int               // round robin position in partitions
+	inflight          int               // messages delivered and not acknowledged
+}
+
+// partitionState tracks the delivery of one partition to a group
+type partitionState struct {
+	partition  int
+	owners     []*member
+	nextOffset int64               // first offset never delivered to the group
+	inflight   map[int64]*delivery // delivered offsets awaiting an ACK
+	redeliver  []int64             // sorted offsets to deliver again
+	delayed    map[int64]time.Time // offsets in redeliver held back until a time
+	deliveries map[int64]int       // times each unacknowledged offset was delivered
+	failures   map[int64]string    // why the last delivery of each requeued offset failed
+}
+
+// delivery is a message held by a member
+type delivery struct {
+	member *member
+	timer  *time.Timer // redelivers the message when the visibility timeout expires
+}
+
+// newConsumerGroup creates the group state, resuming each partition from
+// the group's committed offset
+func newConsumerGroup(name, topic string, shared bool, w *wal.WAL, store *storage.OffsetStore, published func(topic string)) *consumerGroup {
+	g := &consumerGroup{name: name, topic: topic, shared: shared, wal: w, store: store, published: published}
+	g.addPartitions()
+	return g
+}
+
+// newBroadcastGroup creates the state of a broadcast subscription, which
+// starts at the end of every partition
+func newBroadcastGroup(topic string, w *wal.WAL, published func(topic string)) *consumerGroup {
+	g := &consumerGroup{name: protocol.SubscriptionModeBroadcast, topic: topic, wal: w, published: published}
+	g.addPartitions()
+	return g
+}
+
+// addPartitions starts tracking partitions the topic has gained since the
+// group was created, reporting whether there were any
+func (g *consumerGroup) addPartitions() bool {
+	count := g.wal.Partitions(g.topic)
+	if count <= len(g.partitions) {
+		return false
+	}
+	for i := len(g.partitions); i < count; i++ {
+		p := &partitionState{
+			partition:  i,
+			inflight:   make(map[int64]*delivery),
+			delayed:    make(map[int64]time.Time),
+			deliveries: make(map[int64]int),
+			failures:   make(map[int64]string),
+		}
+		if g.store != nil {
+			g.store.InitPartition(g.name, g.topic, i)
+			p.nextOffset = g.store.Get(g.name, g.topic, i)
+
+			// An offset past the end of the log would skip the messages
+			// published next, so it is moved back to the end
+			if next := g.wal.NextOffset(g.topic, i); p.nextOffset > next {
+				log.Printf("Offset %d of group %s on topic %s partition %d is past the end of the log, moving it back to %d\n", p.nextOffset, g.name, g.topic, i, next)
+				p.nextOffset = next
+				g.store.Set(g.name, g.topic, i, next)
+			}
+		} else {
+			p.nextOffset = g.wal.NextOffset(g.topic, i)
+		}
+		g.partitions = append(g.partitions, p)
+	}
+	return true
+}
+
+// join adds sess as a member of the group, holding up to prefetch messages
+// at a time. Messages it doesn't acknowledge within visibilityTimeout are
+// delivered again.
+func (g *consumerGroup) join(sess *session, visibilityTimeout time.Duration, prefetch int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members = append(g.members, &member{sess: sess, visibilityTimeout: visibilityTimeout, prefetch: prefetch})
+	g.rebalance()
+}
+
+// leave removes sess from the group, handing its partitions to the other
+// members. It reports whether the group has no members left.
+func (g *consumerGroup) leave(sess *session) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, m := range g.members {
+		if m.sess == sess {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.rebalance()
+	return len(g.members) == 0
+}
+
+// rebalance assigns partition i to member i modulo the number of members,
+// or every partition to every member in a shared group
+func (g *consumerGroup) rebalance() {
+	for _, m := range g.members {
+		m.partitions = m.partitions[:0]
+		m.cursor = 0
+	}
+	for i, p := range g.partitions {
+		p.owners = p.owners[:0]
+		switch {
+		case len(g.members) == 0:
+		case g.shared:
+			p.owners = append(p.owners, g.members...)
+		default:
+			p.owners = append(p.owners, g.members[i%len(g.members)])
+		}
+		for _, m := range p.owners {
+			m.partitions = append(m.partitions, p)
+		}
+	}
+	for _, p := range g.partitions {
+		if n := p.revoke(); n > 0 {
+			log.Printf("Reassigning %d in-flight messages of topic %s partition %d in group %s\n", n, g.topic, p.partition, g.name)
+		}
+	}
+}
+
+// revoke queues the in-flight messages of members that no longer consume
+// the partition for redelivery and returns how many there were
+func (p *partitionState) revoke() int {
+	n := 0
+	for offset, d := range p.inflight {
+		if !slices.Contains(p.owners, d.member) {
+			p.requeue(offset, "partition reassigned to another consumer")
+			n++
+		}
+	}
+	return n
+}
+
+// release takes the message at offset away from the member holding it
+func (p *partitionState) release(offset int64) {
+	d := p.inflight[offset]
+	d.timer.Stop()
+	d.member.inflight--
+	delete(p.inflight, offset)
+}
+
+// requeue takes the message at offset away from the member holding it and
+// queues it for redelivery, recording why the delivery failed
+func (p *partitionState) requeue(offset int64, reason string) {
+	p.release(offset)
+	p.failures[offset] = reason
+	i, _ := slices.BinarySearch(p.redeliver, offset)
+	p.redeliver = slices.Insert(p.redeliver, i, offset)
+}
+
+// forget drops the delivery history of an offset the group is done with
+func (p *partitionState) forget(offset int64) {
+	delete(p.deliveries, offset)
+	delete(p.failures, offset)
+}
+
+// holding returns the partition if sess holds its message at offset, or nil
+func (g *consumerGroup) holding(sess *session, partition int, offset int64) *partitionState {
+	if partition < 0 || partition >= len(g.partitions) {
+		return nil
+	}
+	p := g.partitions[partition]
+	d, ok := p.inflight[offset]
+	if !ok || d.member.sess != sess {
+		return nil
+	}
+	return p
+}
+
+// ack marks the messages sess holds in a partition between from and to,
+// inclusive, as processed and commits the group's new position. It fails
+// if the range reaches offsets never delivered to the group or sess holds
+// none of the messages in it.
+func (g *consumerGroup) ack(sess *session, partition int, from, to int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if partition < 0 || partition >= len(g.partitions) {
+		return fmt.Errorf("partition %d does not exist", partition)
+	}
+	p := g.partitions[partition]
+	if from > to {
+		return fmt.Errorf("invalid range %d-%d", from, to)
+	}
+	if to >= p.nextOffset {
+		return fmt.Errorf("offset %d was never delivered", to)
+	}
+
+	var acked []int64
+	for offset, d := range p.inflight {
+		if offset >= from && offset <= to && d.member.sess == sess {
+			acked = append(acked, offset)
+		}
+	}
+	if len(acked) == 0 {
+		if from == to {
+			return fmt.Errorf("offset %d is not awaiting an ACK from this consumer", from)
+		}
+		return fmt.Errorf("no offset between %d and %d is awaiting an ACK from this consumer", from, to)
+	}
+
+	for _, offset := range acked {
+		p.release(offset)
+		p.forget(offset)
+	}
+	if g.store != nil {
+		g.store.Set(g.name, g.topic, partition, p.committed())
+	}
+	return nil
+}
+
+// nack hands the message at offset back to the group, to be delivered again
+// once delay has passed. It reports false if sess was not holding offset.
+func (g *consumerGroup) nack(sess *session, partition int, offset int64, delay time.Duration, reason string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	p := g.holding(sess, partition, offset)
+	if p == nil {
+		return false
+	}
+	if reason == "" {
+		reason = "rejected by consumer"
+	}
+	p.requeue(offset, reason)
+	if delay > 0 {
+		p.delayed[offset] = time.Now().Add(delay)
+		time.AfterFunc(delay, g.dispatch)
+	}
+	return true
+}
+
+// seek moves the group to the given offset of each partition, dropping the
+// messages in flight or waiting for redelivery there
+func (g *consumerGroup) seek(offsets map[int]int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.addPartitions() {
+		g.rebalance()
+	}
+	for partition, offset := range offsets {
+		if partition >= len(g.partitions) {
+			continue
+		}
+		p := g.partitions[partition]
+		for inflight := range p.inflight {
+			p.release(inflight)
+		}
+		p.redeliver = nil
+		clear(p.delayed)
+		clear(p.deliveries)
+		clear(p.failures)
+		p.nextOffset = offset
+		if g.store != nil {
+			g.store.Set(g.name, g.topic, partition, offset)
+		}
+	}
+}
+
+// expire queues a message for redelivery when the member holding it did
+// not acknowledge it in time
+func (g *consumerGroup) expire(p *partitionState, offset int64, d *delivery) {
+	g.mu.Lock()
+	if p.inflight[offset] != d {
+		// Acknowledged or handed back in the meantime
+		g.mu.Unlock()
+		return
+	}
+	log.Printf("Visibility timeout expired for offset %d of topic %s partition %d in group %s\n", offset, g.topic, p.partition, g.name)
+	p.requeue(offset, "visibility timeout expired")
+	g.mu.Unlock()
+
+	g.dispatch()
+}
+
+// dispatch delivers messages to members until every member is full or
+// there is nothing left to deliver
+func (g *consumerGroup) dispatch() {
+	g.mu.Lock()
+	g.fill()
+	deadLettered := g.deadLettered
+	g.deadLettered = nil
+	g.mu.Unlock()
+
+	// The dead-letter topic's groups are dispatched without holding this
+	// group's lock, as a misconfigured topic may be its own dead-letter topic
+	for _, topic := range deadLettered {
+		g.published(topic)
+	}
+	if len(deadLettered) > 0 && g.store != nil {
+		if err := g.store.Save(); err != nil {
+			log.Printf("Error saving offsets: %v\n", err)
+		}
+	}
+}
+
+// fill delivers messages to members until every member is full or there is
+// nothing left to deliver. The caller must hold the group's lock.
+func (g *consumerGroup) fill() {
+	if g.addPartitions() {
+		g.rebalance()
+	}
+
+	for {
+		m, p, msg := g.next()
+		if msg == nil {
+			return
+		}
+
+		offset := int64(msg.ID)
+		d := &delivery{member: m}
+		d.timer = time.AfterFunc(m.visibilityTimeout, func() { g.expire(p, offset, d) })
+		p.inflight[offset] = d
+		m.inflight++
+		msg.Redeliveries = p.deliveries[offset]
+		p.deliveries[offset]++
+		// A failed write is not retried here: the member's connection is
+		// closing, and leaving the group requeues the message
+		if err := m.sess.sendMessage(msg); err != nil {
+			log.Printf("Error writing message: %v\n", err)
+		}
+	}
+}
+
+// next finds the next message to deliver, taking members and each member's
+// partitions in round robin order. It returns a nil message if every
+// member is full or has nothing to deliver.
+func (g *consumerGroup) next() (*member, *partitionState, *protocol.Message) {
+	for i := range g.members {
+		mi := (g.cursor + i) % len(g.members)
+		m := g.members[mi]
+		if m.inflight >= m.prefetch {
+			continue
+		}
+		for j := range m.partitions {
+			pi := (m.cursor + j) % len(m.partitions)
+			p := m.partitions[pi]
+			if msg := g.nextMessage(p, m.sess); msg != nil {
+				g.cursor = (mi + 1) % len(g.members)
+				m.cursor = (pi + 1) % len(m.partitions)
+				return m, p, msg
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+// describe reports the group's members and the offset of each partition
+// it has not acknowledged yet
+func (g *consumerGroup) describe() protocol.SubscriberInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	info := protocol.SubscriberInfo{Group: g.name, Mode: protocol.SubscriptionModeQueue, Members: len(g.members)}
+	switch {
+	case g.store == nil:
+		info.Group = ""
+		info.Mode = protocol.SubscriptionModeBroadcast
+	case g.shared:
+		info.Mode = protocol.SubscriptionModeShared
+	}
+	for _, p := range g.partitions {
+		info.Offsets = append(info.Offsets, p.committed())
+	}
+	return info
+}
+
+// committed returns the lowest offset of the partition the group has not
+// acknowledged yet
+func (p *partitionState) committed() int64 {
+	lowest := p.nextOffset
+	for offset := range p.inflight {
+		lowest = min(lowest, offset)
+	}
+	if len(p.redeliver) > 0 {
+		lowest = min(lowest, p.redeliver[0])
+	}
+	return lowest
+}
+
+// nextMessage returns the next message to deliver from a partition,
+// preferring messages waiting for redelivery over new ones. sess is told
+// about offsets lost to retention.
+func (g *consumerGroup) nextMessage(p *partitionState, sess *session) *protocol.Message {
+	now := time.Now()
+	for i := 0; i < len(p.redeliver); {
+		offset := p.redeliver[i]
+		if until, ok := p.delayed[offset]; ok && now.Before(until) {
+			i++
+			continue
+		}
+		p.redeliver = slices.Delete(p.redeliver, i, i+1)
+		delete(p.delayed, offset)
+		msg, err := g.wal.ReadAt(g.topic, p.partition, offset)
+		if err != nil || msg == nil || int64(msg.ID) != offset {
+			// Retention or compaction removed it in the meantime
+			p.forget(offset)
+			continue
+		}
+		if g.exhausted(p, offset) {
+			// A broadcast listener only gives up its own copy, rather than
+			// adding one to the dead-letter topic per listener
+			if g.store == nil {
+				log.Printf("Dropping offset %d of topic %s partition %d for a broadcast subscriber after %d deliveries: %s\n", offset, g.topic, p.partition, p.deliveries[offset], p.failures[offset])
+				p.forget(offset)
+				continue
+			}
+			if g.deadLetter(p, msg) {
+				continue
+			}
+		}
+		return msg
+	}
+
+	msg, err := g.wal.ReadAt(g.topic, p.partition, p.nextOffset)
+	if errors.Is(err, wal.ErrOffsetOutOfRange) {
+		// Retention deleted the group's position, so skip to the oldest
+		// message still stored and tell the consumer what was lost
+		start := g.wal.StartOffset(g.topic, p.partition)
+		log.Printf("Offset %d of topic %s partition %d was deleted by retention, resuming group %s at %d\n", p.nextOffset, g.topic, p.partition, g.name, start)
+		sess.sendError(0, protocol.ErrorCodeOffsetReset, fmt.Sprintf("Offset %d of topic %s partition %d was deleted by retention, resuming at offset %d", p.nextOffset, g.topic, p.partition, start))
+		p.nextOffset = start
+		msg, err = g.wal.ReadAt(g.topic, p.partition, start)
+	}
+	if err != nil {
+		log.Printf("Error reading topic %s partition %d at offset %d: %v\n", g.topic, p.partition, p.nextOffset, err)
+		return nil
+	}
+	if msg == nil {
+		return nil
+	}
+
+	// Compaction may have removed the records before msg
+	p.nextOffset = int64(msg.ID) + 1
+	return msg
+}
@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+// defaultWriteTimeout is how long a client may take to read the frames
+// written to it when Options.WriteTimeout is not set
+const defaultWriteTimeout = 30 * time.Second
+
+// maxQueuedBytes is how many bytes of frames may wait to be written before
+// the broker stops reading the connection's requests
+const maxQueuedBytes = 4 << 20
+
+// errSessionClosed is returned when sending on a session whose connection
+// is closing
+var errSessionClosed = errors.New("connection is closing")
+
+// session holds the state of one client connection
+type session struct {
+	conn         net.Conn
+	writeTimeout time.Duration
+
+	// Frames are queued and written by writeLoop, so publishers delivering
+	// to the connection never wait on the client while holding a group's
+	// lock. Frames are written in the order they were queued.
+	outMu   sync.Mutex
+	outCond *sync.Cond
+	out     [][]byte
+	queued  int           // bytes in out
+	closed  bool          // no more frames are queued
+	written chan struct{} // closed once writeLoop returns
+
+	// version is the frame layout version and codec encodes and decodes
+	// frame bodies. Both are set by HELLO, before the connection subscribes
+	// to anything, and never change afterwards.
+	version byte
+	codec   protocol.Codec
+
+	// groups maps each topic the connection subscribed to to the consumer
+	// group it joined. Only the connection's handler goroutine uses it.
+	groups map[string]*consumerGroup
+}
+
+func newSession(conn net.Conn, writeTimeout time.Duration) *session {
+	s := &session{
+		conn:         conn,
+		writeTimeout: writeTimeout,
+		written:      make(chan struct{}),
+		version:      protocol.FrameVersion1,
+		codec:        protocol.JSON,
+		groups:       make(map[string]*consumerGroup),
+	}
+	s.outCond = sync.NewCond(&s.outMu)
+	go s.writeLoop()
+	return s
+}
+
+// writeLoop writes the queued frames until the session is closed and its
+// queue is empty. If a write fails or times out the connection is closed,
+// which ends the connection's handler.
+func (s *session) writeLoop() {
+	defer close(s.written)
+	for {
+		s.outMu.Lock()
+		for len(s.out) == 0 && !s.closed {
+			s.outCond.Wait()
+		}
+		frames := net.Buffers(s.out)
+		s.out = nil
+		s.queued = 0
+		s.outCond.Broadcast()
+		s.outMu.Unlock()
+		if len(frames) == 0 {
+			return
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		if _, err := frames.WriteTo(s.conn); err != nil {
+			log.Printf("Error writing to %s, closing the connection: %v\n", s.conn.RemoteAddr(), err)
+			s.outMu.Lock()
+			s.closed = true
+			s.out = nil
+			s.outCond.Broadcast()
+			s.outMu.Unlock()
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// waitQueue waits until the frames queued for the connection are under
+// maxQueuedBytes, so a client that doesn't read its replies stops having
+// its requests read. It reports false if the session was closed.
+func (s *session) waitQueue() bool {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	for s.queued >= maxQueuedBytes && !s.closed {
+		s.outCond.Wait()
+	}
+	return !s.closed
+}
+
+// close stops queueing frames and waits, at most the write timeout, for the
+// queued ones to be written
+func (s *session) close() {
+	s.outMu.Lock()
+	s.closed = true
+	s.outCond.Broadcast()
+	s.outMu.Unlock()
+	<-s.written
+}
+
+// send queues a frame with the given type and body for the connection. It
+// never blocks. A non-zero correlation ID marks the frame as the reply to
+// the request with that ID.
+func (s *session) send(messageType byte, correlationID uint32, body []byte) error {
+	header := protocol.Header{
+		Version:       s.version,
+		Type:          messageType,
+		CorrelationID: correlationID,
+		Length:        uint32(len(body)),
+	}
+	if correlationID != 0 {
+		header.Flags |= protocol.FlagResponse
+	}
+	if s.version < protocol.FrameVersion2 && messageType == protocol.MessageTypeMessage {
+		header.Type = protocol.MessageTypeMessageV1
+	}
+	frame := protocol.AppendHeader(make([]byte, 0, protocol.HeaderSizeV2+len(body)), header)
+	frame = append(frame, body...)
+
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	if s.closed {
+		return errSessionClosed
+	}
+	s.out = append(s.out, frame)
+	s.queued += len(frame)
+	s.outCond.Broadcast()
+	return nil
+}
+
+// sendMessage writes a MESSAGE frame carrying msg
+func (s *session) sendMessage(msg *protocol.Message) error {
+	body, err := s.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.send(protocol.MessageTypeMessage, 0, body)
+}
+
+// sendPublishAck writes a PUBLISH_ACK frame carrying ack, in reply to the
+// PUBLISH with the given correlation ID
+func (s *session) sendPublishAck(correlationID uint32, ack protocol.PublishAck) error {
+	body, err := s.codec.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	return s.send(protocol.MessageTypePublishAck, correlationID, body)
+}
+
+// sendPublishBatchAck writes a PUBLISH_BATCH_ACK frame carrying ack, in
+// reply to the PUBLISH_BATCH with the given correlation ID
+func (s *session) sendPublishBatchAck(correlationID uint32, ack protocol.PublishBatchAck) error {
+	body, err := s.codec.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	return s.send(protocol.MessageTypePublishBatchAck, correlationID, body)
+}
+
+// sendTopicList writes a TOPIC_LIST frame carrying list, in reply to the
+// admin frame with the given correlation ID
+func (s *session) sendTopicList(correlationID uint32, list protocol.TopicList) error {
+	body, err := s.codec.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return s.send(protocol.MessageTypeTopicList, correlationID, body)
+}
+
+// sendError writes an ERROR frame answering the request with the given
+// correlation ID
+func (s *session) sendError(correlationID uint32, code, message string) {
+	s.writeError(correlationID, protocol.NewError(code, message))
+}
+
+// sendFatalError writes an ERROR frame telling the client the connection is
+// about to be closed
+func (s *session) sendFatalError(correlationID uint32, code, message string) {
+	e := protocol.NewError(code, message)
+	e.Fatal = true
+	s.writeError(correlationID, e)
+}
+
+// writeError writes an ERROR frame carrying e, logging if that fails
+func (s *session) writeError(correlationID uint32, e *protocol.Error) {
+	e.CorrelationID = correlationID
+	body, err := s.codec.Marshal(e)
+	if err == nil {
+		err = s.send(protocol.MessageTypeError, correlationID, body)
+	}
+	if err != nil {
+		log.Printf("Error writing error message: %v\n", err)
+	}
+}
@@ -0,0 +1,106 @@
+package protocol
+
+// TopicConfig is the configuration of a topic in admin frames. RetentionMs,
+// TombstoneRetentionMs and SyncIntervalMs are in milliseconds, and
+// MaxMessageBytes limits the text and payload of each message. Durability
+// is when appends are synced to disk: "always", "interval" (within
+// SyncIntervalMs), "messages" (every SyncMessages messages) or "os".
+// Messages delivered MaxDeliveries times to a group without being
+// acknowledged are moved to DeadLetterTopic.
+// In CREATE_TOPIC, zero values select the broker's defaults and negative
+// limits mean no limit. In TOPIC_LIST they hold the settings in effect,
+// where zero limits mean no limit.
+type TopicConfig struct {
+	Partitions           int    `json:"partitions,omitempty"`
+	RetentionMs          int64  `json:"retention_ms,omitempty"`
+	RetentionBytes       int64  `json:"retention_bytes,omitempty"`
+	RetentionMessages    int64  `json:"retention_messages,omitempty"`
+	CleanupPolicy        string `json:"cleanup_policy,omitempty"`
+	TombstoneRetentionMs int64  `json:"tombstone_retention_ms,omitempty"`
+	MaxMessageBytes      int    `json:"max_message_bytes,omitempty"`
+	Durability           string `json:"durability,omitempty"`
+	SyncIntervalMs       int64  `json:"sync_interval_ms,omitempty"`
+	SyncMessages         int    `json:"sync_messages,omitempty"`
+	MaxDeliveries        int    `json:"max_deliveries,omitempty"`
+	DeadLetterTopic      string `json:"dead_letter_topic,omitempty"`
+}
+
+// ACL operations and permissions
+const (
+	ACLOperationPublish   = "publish"
+	ACLOperationSubscribe = "subscribe"
+	ACLOperationAdmin     = "admin"
+
+	ACLPermissionAllow = "allow"
+	ACLPermissionDeny  = "deny"
+)
+
+// ACLBinding allows or denies a principal an operation on a topic. The
+// broker doesn't authenticate clients yet, so it stores bindings without
+// enforcing them.
+type ACLBinding struct {
+	Principal  string `json:"principal"`
+	Operation  string `json:"operation"`
+	Permission string `json:"permission"`
+}
+
+// CreateTopic is the body of a CREATE_TOPIC frame, which creates a topic
+// with the given configuration and ACL bindings. The broker answers with a
+// TOPIC_LIST describing the new topic.
+type CreateTopic struct {
+	Topic  string       `json:"topic"`
+	Config TopicConfig  `json:"config"`
+	ACLs   []ACLBinding `json:"acls,omitempty"`
+}
+
+// DeleteTopic is the body of a DELETE_TOPIC frame, which deletes a topic
+// with its messages and the offsets of every consumer group on it. Topics
+// with subscribers can't be deleted. The broker answers with a TOPIC_LIST
+// holding the deleted topic's name.
+type DeleteTopic struct {
+	Topic string `json:"topic"`
+}
+
+// DescribeTopic is the body of a DESCRIBE_TOPIC frame. The broker answers
+// with a TOPIC_LIST holding the topic's configuration, partitions and
+// subscribers.
+type DescribeTopic struct {
+	Topic string `json:"topic"`
+}
+
+// TopicList is the body of the TOPIC_LIST frame that answers every admin
+// frame. LIST_TOPICS, which has no body, gets every topic sorted by name,
+// without their partitions, subscribers and ACL bindings.
+type TopicList struct {
+	Topics []TopicInfo `json:"topics"`
+}
+
+// TopicInfo describes a topic. SizeBytes is the size of its stored log.
+type TopicInfo struct {
+	Topic       string           `json:"topic"`
+	Config      TopicConfig      `json:"config"`
+	SizeBytes   int64            `json:"size_bytes"`
+	Partitions  []PartitionInfo  `json:"partitions,omitempty"`
+	Subscribers []SubscriberInfo `json:"subscribers,omitempty"`
+	ACLs        []ACLBinding     `json:"acls,omitempty"`
+}
+
+// PartitionInfo describes a partition of a topic. StartOffset is the
+// offset of the oldest stored message, and NextOffset the one the next
+// message will get.
+type PartitionInfo struct {
+	Partition   int   `json:"partition"`
+	StartOffset int64 `json:"start_offset"`
+	NextOffset  int64 `json:"next_offset"`
+	SizeBytes   int64 `json:"size_bytes"`
+}
+
+// SubscriberInfo describes a consumer group or broadcast subscription on a
+// topic. Offsets holds the lowest offset of each partition it has not
+// acknowledged yet.
+type SubscriberInfo struct {
+	Group   string  `json:"group,omitempty"`
+	Mode    string  `json:"mode"`
+	Members int     `json:"members"`
+	Offsets []int64 `json:"offsets,omitempty"`
+}
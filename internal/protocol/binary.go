@@ -0,0 +1,747 @@
+package protocol
+
+// Binary codec formats of the frame bodies. Field numbers follow the order
+// of the struct fields and must not be reused once released.
+
+func (m Message) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, m.Topic)
+	w.int(2, int64(m.Partition))
+	w.string(3, m.Key)
+	w.stringMap(4, m.Headers)
+	w.string(5, m.ContentType)
+	w.string(6, m.Message)
+	w.bytes(7, m.Payload)
+	w.int(8, int64(m.ID))
+	w.int(9, m.TimestampMs)
+	w.int(10, m.ProducerTimestampMs)
+	w.int(11, int64(m.Redeliveries))
+	if m.DeadLetter != nil {
+		w.message(12, m.DeadLetter)
+	}
+	return w.result()
+}
+
+func (m *Message) UnmarshalBinary(data []byte) error {
+	*m = Message{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			m.Topic = r.string()
+		case 2:
+			m.Partition = int(r.int())
+		case 3:
+			m.Key = r.string()
+		case 4:
+			if m.Headers == nil {
+				m.Headers = make(map[string]string)
+			}
+			r.mapEntry(m.Headers)
+		case 5:
+			m.ContentType = r.string()
+		case 6:
+			m.Message = r.string()
+		case 7:
+			m.Payload = clone(r.bytes())
+		case 8:
+			m.ID = uint32(r.int())
+		case 9:
+			m.TimestampMs = r.int()
+		case 10:
+			m.ProducerTimestampMs = r.int()
+		case 11:
+			m.Redeliveries = int(r.int())
+		case 12:
+			m.DeadLetter = &DeadLetter{}
+			r.message(m.DeadLetter)
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (d DeadLetter) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, d.Topic)
+	w.int(2, int64(d.Partition))
+	w.int(3, d.Offset)
+	w.int(4, d.TimestampMs)
+	w.string(5, d.Group)
+	w.int(6, int64(d.Deliveries))
+	w.string(7, d.Reason)
+	return w.result()
+}
+
+func (d *DeadLetter) UnmarshalBinary(data []byte) error {
+	*d = DeadLetter{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			d.Topic = r.string()
+		case 2:
+			d.Partition = int(r.int())
+		case 3:
+			d.Offset = r.int()
+		case 4:
+			d.TimestampMs = r.int()
+		case 5:
+			d.Group = r.string()
+		case 6:
+			d.Deliveries = int(r.int())
+		case 7:
+			d.Reason = r.string()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+// MarshalBinary is defined on Publish so it doesn't use the one promoted
+// from the embedded Message
+func (p Publish) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.message(1, p.Message)
+	w.bool(2, p.RequestAck)
+	return w.result()
+}
+
+func (p *Publish) UnmarshalBinary(data []byte) error {
+	*p = Publish{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			r.message(&p.Message)
+		case 2:
+			p.RequestAck = r.bool()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (a PublishAck) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, a.Topic)
+	w.int(2, int64(a.Partition))
+	w.int(3, a.Offset)
+	if a.Error != nil {
+		w.message(4, a.Error)
+	}
+	return w.result()
+}
+
+func (a *PublishAck) UnmarshalBinary(data []byte) error {
+	*a = PublishAck{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			a.Topic = r.string()
+		case 2:
+			a.Partition = int(r.int())
+		case 3:
+			a.Offset = r.int()
+		case 4:
+			a.Error = &Error{}
+			r.message(a.Error)
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (b PublishBatch) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	for _, msg := range b.Messages {
+		w.message(1, msg)
+	}
+	w.bool(2, b.RequestAck)
+	return w.result()
+}
+
+func (b *PublishBatch) UnmarshalBinary(data []byte) error {
+	*b = PublishBatch{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			var msg Message
+			r.message(&msg)
+			b.Messages = append(b.Messages, msg)
+		case 2:
+			b.RequestAck = r.bool()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (a PublishBatchAck) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	for _, rng := range a.Ranges {
+		w.message(1, rng)
+	}
+	w.ints(2, a.Partitions)
+	if a.Error != nil {
+		w.message(3, a.Error)
+	}
+	return w.result()
+}
+
+func (a *PublishBatchAck) UnmarshalBinary(data []byte) error {
+	*a = PublishBatchAck{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			var rng OffsetRange
+			r.message(&rng)
+			a.Ranges = append(a.Ranges, rng)
+		case 2:
+			a.Partitions = append(a.Partitions, r.ints()...)
+		case 3:
+			a.Error = &Error{}
+			r.message(a.Error)
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (o OffsetRange) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, o.Topic)
+	w.int(2, int64(o.Partition))
+	w.int(3, o.FirstOffset)
+	w.int(4, o.LastOffset)
+	return w.result()
+}
+
+func (o *OffsetRange) UnmarshalBinary(data []byte) error {
+	*o = OffsetRange{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			o.Topic = r.string()
+		case 2:
+			o.Partition = int(r.int())
+		case 3:
+			o.FirstOffset = r.int()
+		case 4:
+			o.LastOffset = r.int()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (c TopicConfig) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.int(1, int64(c.Partitions))
+	w.int(2, c.RetentionMs)
+	w.int(3, c.RetentionBytes)
+	w.int(4, c.RetentionMessages)
+	w.string(5, c.CleanupPolicy)
+	w.int(6, c.TombstoneRetentionMs)
+	w.int(7, int64(c.MaxMessageBytes))
+	w.string(8, c.Durability)
+	w.int(9, c.SyncIntervalMs)
+	w.int(10, int64(c.SyncMessages))
+	w.int(11, int64(c.MaxDeliveries))
+	w.string(12, c.DeadLetterTopic)
+	return w.result()
+}
+
+func (c *TopicConfig) UnmarshalBinary(data []byte) error {
+	*c = TopicConfig{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			c.Partitions = int(r.int())
+		case 2:
+			c.RetentionMs = r.int()
+		case 3:
+			c.RetentionBytes = r.int()
+		case 4:
+			c.RetentionMessages = r.int()
+		case 5:
+			c.CleanupPolicy = r.string()
+		case 6:
+			c.TombstoneRetentionMs = r.int()
+		case 7:
+			c.MaxMessageBytes = int(r.int())
+		case 8:
+			c.Durability = r.string()
+		case 9:
+			c.SyncIntervalMs = r.int()
+		case 10:
+			c.SyncMessages = int(r.int())
+		case 11:
+			c.MaxDeliveries = int(r.int())
+		case 12:
+			c.DeadLetterTopic = r.string()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (c CreateTopic) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, c.Topic)
+	w.message(2, c.Config)
+	for _, acl := range c.ACLs {
+		w.message(3, acl)
+	}
+	return w.result()
+}
+
+func (c *CreateTopic) UnmarshalBinary(data []byte) error {
+	*c = CreateTopic{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			c.Topic = r.string()
+		case 2:
+			r.message(&c.Config)
+		case 3:
+			var acl ACLBinding
+			r.message(&acl)
+			c.ACLs = append(c.ACLs, acl)
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (a ACLBinding) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, a.Principal)
+	w.string(2, a.Operation)
+	w.string(3, a.Permission)
+	return w.result()
+}
+
+func (a *ACLBinding) UnmarshalBinary(data []byte) error {
+	*a = ACLBinding{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			a.Principal = r.string()
+		case 2:
+			a.Operation = r.string()
+		case 3:
+			a.Permission = r.string()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (d DeleteTopic) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, d.Topic)
+	return w.result()
+}
+
+func (d *DeleteTopic) UnmarshalBinary(data []byte) error {
+	*d = DeleteTopic{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			d.Topic = r.string()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (d DescribeTopic) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, d.Topic)
+	return w.result()
+}
+
+func (d *DescribeTopic) UnmarshalBinary(data []byte) error {
+	*d = DescribeTopic{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			d.Topic = r.string()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (l TopicList) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	for _, info := range l.Topics {
+		w.message(1, info)
+	}
+	return w.result()
+}
+
+func (l *TopicList) UnmarshalBinary(data []byte) error {
+	*l = TopicList{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			var info TopicInfo
+			r.message(&info)
+			l.Topics = append(l.Topics, info)
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (t TopicInfo) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, t.Topic)
+	w.message(2, t.Config)
+	w.int(3, t.SizeBytes)
+	for _, p := range t.Partitions {
+		w.message(4, p)
+	}
+	for _, s := range t.Subscribers {
+		w.message(5, s)
+	}
+	for _, acl := range t.ACLs {
+		w.message(6, acl)
+	}
+	return w.result()
+}
+
+func (t *TopicInfo) UnmarshalBinary(data []byte) error {
+	*t = TopicInfo{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			t.Topic = r.string()
+		case 2:
+			r.message(&t.Config)
+		case 3:
+			t.SizeBytes = r.int()
+		case 4:
+			var p PartitionInfo
+			r.message(&p)
+			t.Partitions = append(t.Partitions, p)
+		case 5:
+			var s SubscriberInfo
+			r.message(&s)
+			t.Subscribers = append(t.Subscribers, s)
+		case 6:
+			var acl ACLBinding
+			r.message(&acl)
+			t.ACLs = append(t.ACLs, acl)
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (p PartitionInfo) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.int(1, int64(p.Partition))
+	w.int(2, p.StartOffset)
+	w.int(3, p.NextOffset)
+	w.int(4, p.SizeBytes)
+	return w.result()
+}
+
+func (p *PartitionInfo) UnmarshalBinary(data []byte) error {
+	*p = PartitionInfo{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			p.Partition = int(r.int())
+		case 2:
+			p.StartOffset = r.int()
+		case 3:
+			p.NextOffset = r.int()
+		case 4:
+			p.SizeBytes = r.int()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (s SubscriberInfo) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, s.Group)
+	w.string(2, s.Mode)
+	w.int(3, int64(s.Members))
+	w.int64s(4, s.Offsets)
+	return w.result()
+}
+
+func (s *SubscriberInfo) UnmarshalBinary(data []byte) error {
+	*s = SubscriberInfo{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			s.Group = r.string()
+		case 2:
+			s.Mode = r.string()
+		case 3:
+			s.Members = int(r.int())
+		case 4:
+			s.Offsets = append(s.Offsets, r.int64s()...)
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (e Error) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, e.Code)
+	w.string(2, e.Message)
+	w.int(3, int64(e.CorrelationID))
+	w.bool(4, e.Retryable)
+	w.bool(5, e.Fatal)
+	return w.result()
+}
+
+func (e *Error) UnmarshalBinary(data []byte) error {
+	*e = Error{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			e.Code = r.string()
+		case 2:
+			e.Message = r.string()
+		case 3:
+			e.CorrelationID = uint32(r.int())
+		case 4:
+			e.Retryable = r.bool()
+		case 5:
+			e.Fatal = r.bool()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (s Subscription) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, s.Topic)
+	w.string(2, s.Group)
+	w.string(3, s.Mode)
+	w.int(4, s.VisibilityTimeoutMs)
+	w.int(5, int64(s.Prefetch))
+	return w.result()
+}
+
+func (s *Subscription) UnmarshalBinary(data []byte) error {
+	*s = Subscription{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			s.Topic = r.string()
+		case 2:
+			s.Group = r.string()
+		case 3:
+			s.Mode = r.string()
+		case 4:
+			s.VisibilityTimeoutMs = r.int()
+		case 5:
+			s.Prefetch = int(r.int())
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (a Ack) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, a.Topic)
+	w.int(2, int64(a.Partition))
+	w.int(3, a.Offset)
+	w.bool(4, a.Cumulative)
+	for _, rng := range a.Ranges {
+		w.message(5, rng)
+	}
+	return w.result()
+}
+
+func (a *Ack) UnmarshalBinary(data []byte) error {
+	*a = Ack{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			a.Topic = r.string()
+		case 2:
+			a.Partition = int(r.int())
+		case 3:
+			a.Offset = r.int()
+		case 4:
+			a.Cumulative = r.bool()
+		case 5:
+			var rng AckRange
+			r.message(&rng)
+			a.Ranges = append(a.Ranges, rng)
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (a AckRange) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.int(1, a.From)
+	w.int(2, a.To)
+	return w.result()
+}
+
+func (a *AckRange) UnmarshalBinary(data []byte) error {
+	*a = AckRange{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			a.From = r.int()
+		case 2:
+			a.To = r.int()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (n Nack) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, n.Topic)
+	w.int(2, int64(n.Partition))
+	w.int(3, n.Offset)
+	w.int(4, n.DelayMs)
+	w.string(5, n.Reason)
+	return w.result()
+}
+
+func (n *Nack) UnmarshalBinary(data []byte) error {
+	*n = Nack{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			n.Topic = r.string()
+		case 2:
+			n.Partition = int(r.int())
+		case 3:
+			n.Offset = r.int()
+		case 4:
+			n.DelayMs = r.int()
+		case 5:
+			n.Reason = r.string()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (s Seek) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.string(1, s.Topic)
+	w.string(2, s.Group)
+	w.ints(3, s.Partitions)
+	w.string(4, s.Position)
+	w.int(5, s.Offset)
+	w.int(6, s.TimestampMs)
+	return w.result()
+}
+
+func (s *Seek) UnmarshalBinary(data []byte) error {
+	*s = Seek{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			s.Topic = r.string()
+		case 2:
+			s.Group = r.string()
+		case 3:
+			s.Partitions = append(s.Partitions, r.ints()...)
+		case 4:
+			s.Position = r.string()
+		case 5:
+			s.Offset = r.int()
+		case 6:
+			s.TimestampMs = r.int()
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
+
+func (h Hello) MarshalBinary() ([]byte, error) {
+	var w binaryWriter
+	w.int(1, int64(h.Version))
+	w.strings(2, h.Codecs)
+	w.string(3, h.Codec)
+	w.string(4, h.ServerVersion)
+	w.strings(5, h.Features)
+	return w.result()
+}
+
+func (h *Hello) UnmarshalBinary(data []byte) error {
+	*h = Hello{}
+	r := binaryReader{data: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			h.Version = int(r.int())
+		case 2:
+			h.Codecs = append(h.Codecs, r.string())
+		case 3:
+			h.Codec = r.string()
+		case 4:
+			h.ServerVersion = r.string()
+		case 5:
+			h.Features = append(h.Features, r.string())
+		default:
+			r.skip()
+		}
+	}
+	return r.err
+}
@@ -0,0 +1,348 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Codec names negotiated in HELLO
+const (
+	CodecJSON   = "json"
+	CodecBinary = "binary"
+)
+
+// Codec encodes and decodes frame bodies
+type Codec interface {
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// JSON encodes bodies as JSON. It is used until a connection negotiates
+	// another codec.
+	JSON Codec = jsonCodec{}
+	// Binary encodes bodies in a compact tag-length-value format
+	Binary Codec = binaryCodec{}
+)
+
+// CodecByName returns the codec with the given name
+func CodecByName(name string) (Codec, bool) {
+	switch name {
+	case CodecJSON:
+		return JSON, true
+	case CodecBinary:
+		return Binary, true
+	}
+	return nil, false
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return CodecJSON }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// binaryCodec encodes the body types of this package, which implement
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler.
+//
+// Each field is written as a uvarint key holding the field number and wire
+// type, followed by its value: a zigzag varint for integers and booleans,
+// or a uvarint length and the raw bytes for strings, byte slices, nested
+// bodies and packed integer lists. Zero values are left out, and decoders
+// skip fields they don't know, so fields can be added without breaking
+// older peers.
+type binaryCodec struct{}
+
+// ErrUnsupportedType is returned when encoding a value the binary codec
+// has no format for
+var ErrUnsupportedType = errors.New("protocol: type not supported by the binary codec")
+
+func (binaryCodec) Name() string { return CodecBinary }
+
+func (binaryCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+	}
+	return m.MarshalBinary()
+}
+
+func (binaryCodec) Unmarshal(data []byte, v any) error {
+	u, ok := v.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+	}
+	return u.UnmarshalBinary(data)
+}
+
+// Wire types of the binary codec
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// ErrInvalidBinary is returned when a binary body is malformed
+var ErrInvalidBinary = errors.New("protocol: invalid binary body")
+
+// binaryWriter appends fields in the binary codec's format, leaving out
+// zero values
+type binaryWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *binaryWriter) key(field int, wire byte) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field)<<3|uint64(wire))
+}
+
+func (w *binaryWriter) int(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	w.key(field, wireVarint)
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *binaryWriter) bool(field int, v bool) {
+	if v {
+		w.int(field, 1)
+	}
+}
+
+func (w *binaryWriter) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	w.key(field, wireBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *binaryWriter) string(field int, v string) {
+	if v == "" {
+		return
+	}
+	w.key(field, wireBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// ints writes a packed list of integers
+func (w *binaryWriter) ints(field int, v []int) {
+	if len(v) == 0 {
+		return
+	}
+	var packed []byte
+	for _, i := range v {
+		packed = binary.AppendVarint(packed, int64(i))
+	}
+	w.bytes(field, packed)
+}
+
+// int64s writes a packed list of 64-bit integers
+func (w *binaryWriter) int64s(field int, v []int64) {
+	if len(v) == 0 {
+		return
+	}
+	var packed []byte
+	for _, i := range v {
+		packed = binary.AppendVarint(packed, i)
+	}
+	w.bytes(field, packed)
+}
+
+// strings writes each string as a repeated field
+func (w *binaryWriter) strings(field int, v []string) {
+	for _, s := range v {
+		w.string(field, s)
+	}
+}
+
+// stringMap writes each entry, in key order, as a repeated nested field
+// holding the key and the value
+func (w *binaryWriter) stringMap(field int, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry binaryWriter
+		entry.string(1, k)
+		entry.string(2, m[k])
+		w.key(field, wireBytes)
+		w.buf = binary.AppendUvarint(w.buf, uint64(len(entry.buf)))
+		w.buf = append(w.buf, entry.buf...)
+	}
+}
+
+// message writes a nested body, even if it is empty
+func (w *binaryWriter) message(field int, v encoding.BinaryMarshaler) {
+	data, err := v.MarshalBinary()
+	if err != nil {
+		w.err = err
+		return
+	}
+	w.key(field, wireBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(data)))
+	w.buf = append(w.buf, data...)
+}
+
+func (w *binaryWriter) result() ([]byte, error) {
+	return w.buf, w.err
+}
+
+// binaryReader reads the fields of a body in the binary codec's format.
+// next advances to the following field, whose value must then be read
+// with the method matching its type, or skipped.
+type binaryReader struct {
+	data  []byte
+	field int
+	wire  byte
+	err   error
+}
+
+func (r *binaryReader) next() bool {
+	if r.err != nil || len(r.data) == 0 {
+		return false
+	}
+	key, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = ErrInvalidBinary
+		return false
+	}
+	r.data = r.data[n:]
+	r.field = int(key >> 3)
+	r.wire = byte(key & 7)
+	return true
+}
+
+func (r *binaryReader) int() int64 {
+	if r.wire != wireVarint {
+		r.fail()
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) bool() bool {
+	return r.int() != 0
+}
+
+func (r *binaryReader) bytes() []byte {
+	if r.wire != wireBytes {
+		r.fail()
+		return nil
+	}
+	length, n := binary.Uvarint(r.data)
+	if n <= 0 || length > uint64(len(r.data)-n) {
+		r.fail()
+		return nil
+	}
+	v := r.data[n : n+int(length)]
+	r.data = r.data[n+int(length):]
+	return v
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *binaryReader) ints() []int {
+	packed := r.bytes()
+	var v []int
+	for len(packed) > 0 {
+		i, n := binary.Varint(packed)
+		if n <= 0 {
+			r.fail()
+			return nil
+		}
+		v = append(v, int(i))
+		packed = packed[n:]
+	}
+	return v
+}
+
+func (r *binaryReader) int64s() []int64 {
+	packed := r.bytes()
+	var v []int64
+	for len(packed) > 0 {
+		i, n := binary.Varint(packed)
+		if n <= 0 {
+			r.fail()
+			return nil
+		}
+		v = append(v, i)
+		packed = packed[n:]
+	}
+	return v
+}
+
+// mapEntry reads an entry written by binaryWriter.stringMap into m
+func (r *binaryReader) mapEntry(m map[string]string) {
+	entry := binaryReader{data: r.bytes()}
+	var k, v string
+	for entry.next() {
+		switch entry.field {
+		case 1:
+			k = entry.string()
+		case 2:
+			v = entry.string()
+		default:
+			entry.skip()
+		}
+	}
+	if entry.err != nil {
+		r.err = entry.err
+	}
+	m[k] = v
+}
+
+func (r *binaryReader) message(v encoding.BinaryUnmarshaler) {
+	data := r.bytes()
+	if r.err != nil {
+		return
+	}
+	if err := v.UnmarshalBinary(data); err != nil {
+		r.err = err
+	}
+}
+
+// skip discards the value of a field the decoder doesn't know
+func (r *binaryReader) skip() {
+	switch r.wire {
+	case wireVarint:
+		r.int()
+	case wireBytes:
+		r.bytes()
+	default:
+		r.fail()
+	}
+}
+
+func (r *binaryReader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: field %d", ErrInvalidBinary, r.field)
+	}
+}
+
+// clone copies a byte slice read from a body, so the value doesn't keep
+// the whole frame in memory
+func clone(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return bytes.Clone(b)
+}
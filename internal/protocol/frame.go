@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame layout versions.
+//
+// Version 1 frames have a 5 byte header: the frame type and the body length.
+// Version 2 frames have an 11 byte header: the version, the frame type,
+// flags, a correlation ID and the body length. Connections start in
+// version 1 and switch to version 2 after a HELLO exchange that agrees on
+// it; HELLO itself always uses the version 1 layout.
+const (
+	FrameVersion1 = 1
+	FrameVersion2 = 2
+)
+
+// Header sizes of each frame layout version
+const (
+	HeaderSizeV1 = 5
+	HeaderSizeV2 = 11
+)
+
+// Frame flags
+const (
+	// FlagResponse marks a frame sent in reply to a request, carrying the
+	// request's correlation ID
+	FlagResponse = 0x01
+)
+
+// ErrFrameVersion is returned when a frame header doesn't have the layout
+// version agreed for the connection
+var ErrFrameVersion = errors.New("protocol: unexpected frame version")
+
+// Header is a frame header. Version 1 headers only carry Type and Length.
+type Header struct {
+	Version       byte
+	Type          byte
+	Flags         byte
+	CorrelationID uint32
+	Length        uint32
+}
+
+// ReadHeader reads a frame header in the given layout version
+func ReadHeader(r io.Reader, version byte) (Header, error) {
+	if version < FrameVersion2 {
+		buf := make([]byte, HeaderSizeV1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return Header{}, err
+		}
+		return Header{Version: FrameVersion1, Type: buf[0], Length: binary.BigEndian.Uint32(buf[1:])}, nil
+	}
+
+	buf := make([]byte, HeaderSizeV2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Header{}, err
+	}
+	h := Header{
+		Version:       buf[0],
+		Type:          buf[1],
+		Flags:         buf[2],
+		CorrelationID: binary.BigEndian.Uint32(buf[3:]),
+		Length:        binary.BigEndian.Uint32(buf[7:]),
+	}
+	if h.Version != version {
+		return h, fmt.Errorf("%w %d on a version %d connection", ErrFrameVersion, h.Version, version)
+	}
+	return h, nil
+}
+
+// AppendHeader appends h to buf in the layout of h.Version
+func AppendHeader(buf []byte, h Header) []byte {
+	if h.Version < FrameVersion2 {
+		buf = append(buf, h.Type)
+		return binary.BigEndian.AppendUint32(buf, h.Length)
+	}
+	buf = append(buf, h.Version, h.Type, h.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, h.CorrelationID)
+	return binary.BigEndian.AppendUint32(buf, h.Length)
+}
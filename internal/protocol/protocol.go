@@ -1,34 +1,324 @@
 package protocol
 
-import "net"
+import "hash/fnv"
 
 // Message types
 const (
-	MessageTypePublish   = 0x01
-	MessageTypeSubscribe = 0x02
-	MessageTypeAck       = 0x03
-	MessageTypeMessage   = 0x03
-	MessageTypeError     = 0xFF
+	MessageTypePublish         = 0x01
+	MessageTypeSubscribe       = 0x02
+	MessageTypeAck             = 0x03
+	MessageTypePublishAck      = 0x04
+	MessageTypeNack            = 0x05
+	MessageTypeSeek            = 0x06
+	MessageTypeHello           = 0x07
+	MessageTypeMessage         = 0x08
+	MessageTypePublishBatch    = 0x09
+	MessageTypePublishBatchAck = 0x0A
+	MessageTypeCreateTopic     = 0x0B
+	MessageTypeDeleteTopic     = 0x0C
+	MessageTypeListTopics      = 0x0D
+	MessageTypeDescribeTopic   = 0x0E
+	MessageTypeTopicList       = 0x0F
+	MessageTypeError           = 0xFF
 )
 
+// MessageTypeMessageV1 is the type of MESSAGE frames on version 1
+// connections, where it is the same as ACK's
+const MessageTypeMessageV1 = 0x03
+
+// Version is the newest protocol version spoken by the broker. It is also
+// the frame layout version used once HELLO agrees on it.
+const Version = FrameVersion2
+
 // MaxBodySize is the maximum allowed message body size (1MB)
 const MaxBodySize = 1024 * 1024
 
-// Message represents a pub/sub message
+// Message represents a pub/sub message.
+// Partition is assigned by the broker from the key, or round robin for
+// messages without one, and ID is the message's offset in that partition.
+// TimestampMs is the time the broker stored the message, while
+// ProducerTimestampMs is set by the producer; both are Unix milliseconds.
+// Payload carries binary content alongside or instead of the Message text.
+// Redeliveries counts the earlier deliveries of the message to the
+// consumer's group that were not acknowledged.
 type Message struct {
-	Topic   string `json:"topic"`
-	Message string `json:"message"`
-	ID      uint32 `json:"id"`
+	Topic               string            `json:"topic"`
+	Partition           int               `json:"partition"`
+	Key                 string            `json:"key,omitempty"`
+	Headers             map[string]string `json:"headers,omitempty"`
+	ContentType         string            `json:"content_type,omitempty"`
+	Message             string            `json:"message"`
+	Payload             []byte            `json:"payload,omitempty"`
+	ID                  uint32            `json:"id"`
+	TimestampMs         int64             `json:"timestamp_ms,omitempty"`
+	ProducerTimestampMs int64             `json:"producer_timestamp_ms,omitempty"`
+	Redeliveries        int               `json:"redeliveries,omitempty"`
+	// DeadLetter describes where a message in a dead-letter topic came from
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty"`
+}
+
+// IsTombstone reports whether the message deletes its key from a compacted
+// topic, which is marked by a key with an empty payload
+func (m Message) IsTombstone() bool {
+	return m.Key != "" && m.Message == "" && len(m.Payload) == 0
+}
+
+// DeadLetter records why a message was moved to a dead-letter topic, so it
+// can be inspected and published again to its original topic
+type DeadLetter struct {
+	Topic       string `json:"topic"`
+	Partition   int    `json:"partition"`
+	Offset      int64  `json:"offset"`
+	TimestampMs int64  `json:"timestamp_ms"`
+	Group       string `json:"group"`
+	Deliveries  int    `json:"deliveries"`
+	Reason      string `json:"reason"`
+}
+
+// Publish is the body of a PUBLISH frame.
+// A producer that sets RequestAck gets a PUBLISH_ACK frame for the message.
+// Acknowledgements are sent in the order the messages were published.
+type Publish struct {
+	Message
+	RequestAck bool `json:"request_ack,omitempty"`
+}
+
+// PublishAck confirms where a published message was stored, or carries the
+// error that prevented storing it
+type PublishAck struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Error     *Error `json:"error,omitempty"`
+}
+
+// PublishBatch is the body of a PUBLISH_BATCH frame, which publishes
+// messages to one or more topics at once. The batch is stored atomically:
+// either every message is stored or none is. Messages with a key are routed
+// by it as in PUBLISH, while those without one go to a single partition of
+// their topic, so they keep their order. A producer that sets RequestAck
+// gets a PUBLISH_BATCH_ACK frame for the whole batch.
+type PublishBatch struct {
+	Messages   []Message `json:"messages"`
+	RequestAck bool      `json:"request_ack,omitempty"`
 }
 
-// Subscription represents a topic subscription request
+// PublishBatchAck confirms where a batch was stored, or carries the error
+// that prevented storing it. Ranges holds the offsets the batch was given
+// in each partition it was stored in, and Partitions the partition of each
+// message, in the order of the batch. The messages of a partition were
+// given consecutive offsets in the order of the batch.
+type PublishBatchAck struct {
+	Ranges     []OffsetRange `json:"ranges,omitempty"`
+	Partitions []int         `json:"partitions,omitempty"`
+	Error      *Error        `json:"error,omitempty"`
+}
+
+// OffsetRange is an inclusive range of offsets in a partition
+type OffsetRange struct {
+	Topic       string `json:"topic"`
+	Partition   int    `json:"partition"`
+	FirstOffset int64  `json:"first_offset"`
+	LastOffset  int64  `json:"last_offset"`
+}
+
+// Error codes
+const (
+	// ErrorCodeStorage reports a failure to read or write the log. The
+	// request can be retried.
+	ErrorCodeStorage = "storage_error"
+	// ErrorCodeBadRequest reports a body that could not be decoded or holds
+	// invalid values
+	ErrorCodeBadRequest = "bad_request"
+	// ErrorCodeUnknownType reports a frame type the broker doesn't know
+	ErrorCodeUnknownType = "unknown_type"
+	// ErrorCodeFrameTooLarge reports a body over MaxBodySize
+	ErrorCodeFrameTooLarge = "frame_too_large"
+	// ErrorCodeProtocol reports a frame sent out of place, such as a HELLO
+	// that isn't the first frame, or with the wrong layout version
+	ErrorCodeProtocol = "protocol_error"
+	// ErrorCodeUnsupported reports a HELLO asking for a protocol version or
+	// codecs the broker doesn't support
+	ErrorCodeUnsupported = "unsupported"
+	// ErrorCodeNotSubscribed reports an ACK or NACK for a topic the
+	// connection isn't subscribed to
+	ErrorCodeNotSubscribed = "not_subscribed"
+	// ErrorCodeAlreadySubscribed reports a second subscription to a topic on
+	// the same connection
+	ErrorCodeAlreadySubscribed = "already_subscribed"
+	// ErrorCodeInvalidOffset reports an ACK, NACK or SEEK for an offset it
+	// can't apply to
+	ErrorCodeInvalidOffset = "invalid_offset"
+	// ErrorCodeOffsetReset reports that retention deleted messages a group
+	// had not consumed, which were skipped. It answers no request.
+	ErrorCodeOffsetReset = "offset_reset"
+	// ErrorCodeInvalidTopic reports a topic name that doesn't follow the
+	// grammar checked by ValidateTopic
+	ErrorCodeInvalidTopic = "invalid_topic"
+	// ErrorCodeUnknownTopic reports an admin frame for a topic that doesn't
+	// exist, or a publish to one when the broker doesn't create topics on
+	// publish
+	ErrorCodeUnknownTopic = "unknown_topic"
+	// ErrorCodeTopicExists reports a CREATE_TOPIC for a topic that already
+	// exists
+	ErrorCodeTopicExists = "topic_exists"
+	// ErrorCodeTopicInUse reports a DELETE_TOPIC for a topic that still has
+	// subscribers
+	ErrorCodeTopicInUse = "topic_in_use"
+	// ErrorCodeMessageTooLarge reports a published message over its topic's
+	// maximum message size
+	ErrorCodeMessageTooLarge = "message_too_large"
+)
+
+// Error describes a failed request. It is the body of ERROR frames and is
+// carried by PUBLISH_ACK frames for failed publishes.
+// CorrelationID is the correlation ID of the failed request, or zero for
+// errors that answer no request. Retryable errors may succeed if the
+// request is sent again unchanged, and fatal ones are followed by the
+// broker closing the connection.
+type Error struct {
+	Code          string `json:"code"`
+	Message       string `json:"message"`
+	CorrelationID uint32 `json:"correlation_id,omitempty"`
+	Retryable     bool   `json:"retryable,omitempty"`
+	Fatal         bool   `json:"fatal,omitempty"`
+}
+
+// NewError returns an error with the given code, marked retryable if the
+// code is
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message, Retryable: IsRetryable(code)}
+}
+
+// IsRetryable reports whether requests failing with code may succeed if
+// they are sent again
+func IsRetryable(code string) bool {
+	return code == ErrorCodeStorage
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// DefaultGroup is the consumer group used by subscriptions that don't name
+// one
+const DefaultGroup = "default"
+
+// Subscription modes
+const (
+	// SubscriptionModeQueue shares the topic between the members of a
+	// consumer group, delivering each message to one of them. Each
+	// partition is consumed by a single member, so messages with the same
+	// key are consumed in order. It is the default.
+	SubscriptionModeQueue = "queue"
+	// SubscriptionModeShared is like SubscriptionModeQueue, but every
+	// member consumes every partition, so a group may have more busy
+	// members than the topic has partitions. Messages with the same key may
+	// be consumed out of order.
+	SubscriptionModeShared = "shared"
+	// SubscriptionModeBroadcast delivers every message published after the
+	// subscription to the subscriber, independently of any other one
+	SubscriptionModeBroadcast = "broadcast"
+)
+
+// Subscription represents a topic subscription request.
+// Each consumer group keeps its own position on the topic. Broadcast
+// subscriptions have no group and track their position per connection.
+// Messages not acknowledged within VisibilityTimeoutMs milliseconds are
+// delivered again, and the subscriber holds at most Prefetch unacknowledged
+// messages at a time. Zero values select the broker's defaults.
 type Subscription struct {
-	Topic string
-	Conn  net.Conn
+	Topic               string `json:"topic"`
+	Group               string `json:"group,omitempty"`
+	Mode                string `json:"mode,omitempty"`
+	VisibilityTimeoutMs int64  `json:"visibility_timeout_ms,omitempty"`
+	Prefetch            int    `json:"prefetch,omitempty"`
 }
 
-// Ack represents an acknowledgment from a consumer
+// Ack represents an acknowledgment from a consumer.
+// It acknowledges the message at Offset or, if Cumulative is set, every
+// message up to and including Offset that the consumer holds. When Ranges
+// is set, the messages the consumer holds in each range are acknowledged
+// instead.
 type Ack struct {
-	Topic  string `json:"topic"`
-	Offset int64  `json:"offset"`
+	Topic      string     `json:"topic"`
+	Partition  int        `json:"partition"`
+	Offset     int64      `json:"offset"`
+	Cumulative bool       `json:"cumulative,omitempty"`
+	Ranges     []AckRange `json:"ranges,omitempty"`
+}
+
+// AckRange is an inclusive range of offsets
+type AckRange struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// Nack represents a consumer giving up on a message, which is delivered
+// again after DelayMs milliseconds. Reason is recorded if the message ends
+// up in the dead-letter topic.
+type Nack struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	DelayMs   int64  `json:"delay_ms,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Seek positions
+const (
+	SeekEarliest  = "earliest"
+	SeekLatest    = "latest"
+	SeekOffset    = "offset"
+	SeekTimestamp = "timestamp"
+)
+
+// Seek moves a consumer group's position on a topic. The group resumes at
+// the oldest stored message, after the newest one, at Offset, or at the
+// first message published at or after TimestampMs, in Unix milliseconds.
+// It applies to the listed partitions, or to all of them if there are none.
+type Seek struct {
+	Topic       string `json:"topic"`
+	Group       string `json:"group,omitempty"`
+	Partitions  []int  `json:"partitions,omitempty"`
+	Position    string `json:"position"`
+	Offset      int64  `json:"offset,omitempty"`
+	TimestampMs int64  `json:"timestamp_ms,omitempty"`
+}
+
+// Hello is the body of the HELLO frame a client sends as its first frame to
+// agree on the protocol version and the codec of the following frame
+// bodies. The client sends the newest version it speaks and the codecs it
+// supports in order of preference. The broker answers with a HELLO holding
+// the version both speak, the codec it chose, its release and the features
+// it supports. HELLO bodies are always JSON.
+// Connections that don't send HELLO use version 1 and JSON.
+type Hello struct {
+	Version       int      `json:"version"`
+	Codecs        []string `json:"codecs,omitempty"`
+	Codec         string   `json:"codec,omitempty"`
+	ServerVersion string   `json:"server_version,omitempty"`
+	Features      []string `json:"features,omitempty"`
+}
+
+// Features reported in HELLO
+const (
+	FeatureBinaryCodec  = "binary_codec"
+	FeaturePublishAck   = "publish_ack"
+	FeatureNack         = "nack"
+	FeatureSeek         = "seek"
+	FeaturePrefetch     = "prefetch"
+	FeatureAckRanges    = "ack_ranges"
+	FeatureDeadLetter   = "dead_letter"
+	FeatureBroadcast    = "broadcast"
+	FeaturePublishBatch = "publish_batch"
+	FeatureTopicAdmin   = "topic_admin"
+)
+
+// PartitionForKey returns the partition messages with key are routed to,
+// so that all messages with the same key stay in order in one partition
+func PartitionForKey(key string, partitions int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partitions))
 }
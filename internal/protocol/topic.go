@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxTopicLength is the longest topic name allowed
+const MaxTopicLength = 249
+
+// DeadLetterSuffix is appended to a topic's name to form the default name
+// of its dead-letter topic
+const DeadLetterSuffix = ".dlq"
+
+// ErrInvalidTopic is returned for topic names that don't follow the topic
+// name grammar
+var ErrInvalidTopic = errors.New("protocol: invalid topic name")
+
+// ValidateTopic checks that name is a valid topic name: 1 to MaxTopicLength
+// ASCII letters, digits, '.', '_' and '-', other than "." and "..".
+// Topic names are used as directory names by the broker, and the grammar
+// keeps them from naming anything outside the broker's directory.
+// Only names ending in DeadLetterSuffix may use its last characters, so the
+// dead-letter topic of any other topic has a valid name.
+func ValidateTopic(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: empty", ErrInvalidTopic)
+	case len(name) > MaxTopicLength:
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidTopic, MaxTopicLength)
+	case len(name) > MaxTopicLength-len(DeadLetterSuffix) && !strings.HasSuffix(name, DeadLetterSuffix):
+		return fmt.Errorf("%w: longer than %d characters without the %s suffix", ErrInvalidTopic, MaxTopicLength-len(DeadLetterSuffix), DeadLetterSuffix)
+	case name == "." || name == "..":
+		return fmt.Errorf("%w %q", ErrInvalidTopic, name)
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTopicChar(name[i]) {
+			return fmt.Errorf("%w %q: character %q is not allowed", ErrInvalidTopic, name, name[i])
+		}
+	}
+	return nil
+}
+
+// isTopicChar reports whether c may appear in a topic name
+func isTopicChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-'
+}
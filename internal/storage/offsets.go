@@ -7,10 +7,12 @@ import (
 	"sync"
 )
 
-// OffsetStore manages topic offsets with persistence
+// OffsetStore manages consumer group offsets with persistence.
+// Offsets are kept per group, topic and partition, so every group consumes
+// a topic independently of the others.
 type OffsetStore struct {
 	path    string
-	offsets map[string]int64
+	offsets map[string]map[string]map[int]int64 // group -> topic -> partition -> offset
 	mu      sync.RWMutex
 }
 
@@ -18,41 +20,73 @@ type OffsetStore struct {
 func NewOffsetStore(path string) *OffsetStore {
 	return &OffsetStore{
 		path:    path,
-		offsets: make(map[string]int64),
+		offsets: make(map[string]map[string]map[int]int64),
 	}
 }
 
-// Get returns the current offset for a topic
-func (s *OffsetStore) Get(topic string) int64 {
+// Get returns the current offset of a group on a topic partition
+func (s *OffsetStore) Get(group, topic string, partition int) int64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.offsets[topic]
+	return s.offsets[group][topic][partition]
 }
 
-// Set sets the offset for a topic
-func (s *OffsetStore) Set(topic string, offset int64) {
+// Set sets the offset of a group on a topic partition
+func (s *OffsetStore) Set(group, topic string, partition int, offset int64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.offsets[topic] = offset
+	s.partitions(group, topic)[partition] = offset
 }
 
-// Increment increments the offset for a topic and returns the new value
-func (s *OffsetStore) Increment(topic string) int64 {
+// Increment increments the offset of a group on a topic partition and
+// returns the new value
+func (s *OffsetStore) Increment(group, topic string, partition int) int64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.offsets[topic]++
-	return s.offsets[topic]
+	offsets := s.partitions(group, topic)
+	offsets[partition]++
+	return offsets[partition]
 }
 
-// InitTopic initializes a topic offset to 0 if it doesn't exist
-func (s *OffsetStore) InitTopic(topic string) {
+// InitPartition initializes the offset of a group on a topic partition to 0
+// if it doesn't exist
+func (s *OffsetStore) InitPartition(group, topic string, partition int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, exists := s.offsets[topic]; !exists {
-		s.offsets[topic] = 0
+	offsets := s.partitions(group, topic)
+	if _, exists := offsets[partition]; !exists {
+		offsets[partition] = 0
 	}
 }
 
+// DeleteTopic removes the offsets of every group on a topic
+func (s *OffsetStore) DeleteTopic(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for group, topics := range s.offsets {
+		delete(topics, topic)
+		if len(topics) == 0 {
+			delete(s.offsets, group)
+		}
+	}
+}
+
+// partitions returns the offsets of a group on a topic, creating them if
+// needed. The caller must hold the write lock.
+func (s *OffsetStore) partitions(group, topic string) map[int]int64 {
+	topics, ok := s.offsets[group]
+	if !ok {
+		topics = make(map[string]map[int]int64)
+		s.offsets[group] = topics
+	}
+	offsets, ok := topics[topic]
+	if !ok {
+		offsets = make(map[int]int64)
+		topics[topic] = offsets
+	}
+	return offsets
+}
+
 // Save persists the offsets to disk
 func (s *OffsetStore) Save() error {
 	s.mu.RLock()
@@ -72,8 +106,12 @@ func (s *OffsetStore) Save() error {
 	return file.Sync()
 }
 
-// Load reads offsets from disk
-func (s *OffsetStore) Load() error {
+// Load reads offsets from disk.
+// Files written before consumer groups existed hold a single offset per
+// topic; those offsets are loaded into legacyGroup. Files written before
+// partitions existed hold a single offset per group and topic; those are
+// loaded as partition 0.
+func (s *OffsetStore) Load(legacyGroup string) error {
 	file, err := os.Open(s.path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -84,18 +122,61 @@ func (s *OffsetStore) Load() error {
 	}
 	defer file.Close()
 
-	var snapshot map[string]int64
+	var raw map[string]json.RawMessage
 	dec := json.NewDecoder(file)
-	if err := dec.Decode(&snapshot); err != nil {
+	if err := dec.Decode(&raw); err != nil {
 		return err
 	}
 
+	snapshot := make(map[string]map[string]map[int]int64)
+	set := func(group, topic string, partition int, offset int64) {
+		if snapshot[group] == nil {
+			snapshot[group] = make(map[string]map[int]int64)
+		}
+		if snapshot[group][topic] == nil {
+			snapshot[group][topic] = make(map[int]int64)
+		}
+		snapshot[group][topic][partition] = offset
+	}
+
+	for key, value := range raw {
+		var legacyOffset int64
+		if err := json.Unmarshal(value, &legacyOffset); err == nil {
+			set(legacyGroup, key, 0, legacyOffset)
+			continue
+		}
+
+		var topics map[string]json.RawMessage
+		if err := json.Unmarshal(value, &topics); err != nil {
+			return err
+		}
+		for topic, value := range topics {
+			if err := json.Unmarshal(value, &legacyOffset); err == nil {
+				set(key, topic, 0, legacyOffset)
+				continue
+			}
+
+			var partitions map[int]int64
+			if err := json.Unmarshal(value, &partitions); err != nil {
+				return err
+			}
+			for partition, offset := range partitions {
+				set(key, topic, partition, offset)
+			}
+		}
+	}
+
 	s.mu.Lock()
-	for topic, offset := range snapshot {
-		s.offsets[topic] = offset
+	for group, topics := range snapshot {
+		for topic, partitions := range topics {
+			offsets := s.partitions(group, topic)
+			for partition, offset := range partitions {
+				offsets[partition] = offset
+			}
+		}
 	}
 	s.mu.Unlock()
 
-	log.Printf("Topic offsets loaded from disk: %v\n", snapshot)
+	log.Printf("Consumer group offsets loaded from disk: %v\n", snapshot)
 	return nil
 }
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+// TopicStore persists the configuration of topics, so topic settings
+// survive restarts. Every change rewrites the whole file atomically: a
+// crash leaves either the old or the new configuration on disk, never a
+// mix of both.
+type TopicStore struct {
+	path   string
+	topics map[string]TopicMetadata
+	mu     sync.RWMutex
+}
+
+// TopicMetadata holds the stored settings of a topic: its number of
+// partitions and the settings set for it when it was created, as in
+// CREATE_TOPIC. Zero values are left to the broker's defaults when the
+// settings are loaded, so changing a default applies to every topic that
+// didn't set its own value.
+type TopicMetadata struct {
+	protocol.TopicConfig
+	ACLs []protocol.ACLBinding `json:"acls,omitempty"`
+}
+
+// NewTopicStore creates a new TopicStore instance
+func NewTopicStore(path string) *TopicStore {
+	return &TopicStore{
+		path:   path,
+		topics: make(map[string]TopicMetadata),
+	}
+}
+
+// Get returns the stored settings of a topic, reporting false if there are
+// none
+func (s *TopicStore) Get(topic string) (TopicMetadata, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	md, ok := s.topics[topic]
+	md.ACLs = slices.Clone(md.ACLs)
+	return md, ok
+}
+
+// All returns the stored settings of every topic
+func (s *TopicStore) All() map[string]TopicMetadata {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	topics := make(map[string]TopicMetadata, len(s.topics))
+	for topic, md := range s.topics {
+		md.ACLs = slices.Clone(md.ACLs)
+		topics[topic] = md
+	}
+	return topics
+}
+
+// Put stores the settings of a topic and writes the store to disk. If the
+// write fails the store keeps its previous contents.
+func (s *TopicStore) Put(topic string, md TopicMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	topics := maps.Clone(s.topics)
+	md.ACLs = slices.Clone(md.ACLs)
+	topics[topic] = md
+	return s.save(topics)
+}
+
+// Add stores the settings of a topic unless it already has some, and
+// writes the store to disk
+func (s *TopicStore) Add(topic string, md TopicMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.topics[topic]; ok {
+		return nil
+	}
+	topics := maps.Clone(s.topics)
+	md.ACLs = slices.Clone(md.ACLs)
+	topics[topic] = md
+	return s.save(topics)
+}
+
+// Delete removes the settings of a topic and writes the store to disk. If
+// the write fails the store keeps its previous contents.
+func (s *TopicStore) Delete(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.topics[topic]; !ok {
+		return nil
+	}
+	topics := maps.Clone(s.topics)
+	delete(topics, topic)
+	return s.save(topics)
+}
+
+// save writes topics to disk and makes them the store's contents. The
+// caller must hold the write lock.
+func (s *TopicStore) save(topics map[string]TopicMetadata) error {
+	data, err := json.Marshal(topics)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.topics = topics
+	return nil
+}
+
+// Load reads the stored settings from disk
+func (s *TopicStore) Load() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Println("Topics file not found, starting without stored topic settings.")
+			return nil
+		}
+		return err
+	}
+
+	topics := make(map[string]TopicMetadata)
+	if err := json.Unmarshal(data, &topics); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.topics = topics
+	s.mu.Unlock()
+
+	log.Printf("Settings of %d topics loaded from disk\n", len(topics))
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data. The data is written
+// to a temporary file, synced and renamed over path, and the directory is
+// synced so the rename survives a crash.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,213 @@
+package wal
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+// Cleanup policies for TopicConfig.CleanupPolicy
+const (
+	// CleanupPolicyDelete drops whole segments according to the retention
+	// policy. It is the default.
+	CleanupPolicyDelete = "delete"
+	// CleanupPolicyCompact keeps only the latest record for each key
+	CleanupPolicyCompact = "compact"
+)
+
+// cleanedSuffix marks the temporary files written while compacting a segment
+const cleanedSuffix = ".cleaned"
+
+// Compact rewrites the inactive segments of every compacted topic so that
+// only the latest record for each key survives
+func (w *WAL) Compact() error {
+	now := time.Now()
+	for _, t := range w.snapshot() {
+		if t.config.CleanupPolicy != CleanupPolicyCompact {
+			continue
+		}
+		for i, p := range t.partitions {
+			p.mu.Lock()
+			removed, err := p.compact(t.config.TombstoneRetention, now, w.opts.IndexIntervalBytes)
+			p.mu.Unlock()
+			if removed > 0 {
+				log.Printf("WAL: compaction removed %d records from topic %s partition %d\n", removed, t.name, i)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StartCompactor compacts topics every interval in a background goroutine
+// until the returned stop function is called
+func (w *WAL) StartCompactor(interval time.Duration) (stop func()) {
+	return runEvery(interval, func() {
+		if err := w.Compact(); err != nil {
+			log.Printf("WAL: error compacting topics: %v\n", err)
+		}
+	})
+}
+
+// compact removes superseded records from every segment but the active one.
+// Tombstones are removed once they are older than tombstoneRetention.
+func (p *partitionLog) compact(tombstoneRetention time.Duration, now time.Time, indexInterval int64) (int, error) {
+	if p.closed.Load() {
+		return 0, nil // The topic was deleted
+	}
+
+	// Find the latest offset of each key across the whole log, including
+	// the active segment, which may supersede older records
+	latest := make(map[string]int64)
+	for _, s := range p.segments {
+		_, err := s.scan(0, func(rec record, _ int64) bool {
+			if msg, ok := decodeKeyed(rec); ok {
+				latest[msg.Key] = rec.offset
+			}
+			return true
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	keep := func(rec record) bool {
+		msg, ok := decodeKeyed(rec)
+		if !ok {
+			return true
+		}
+		if latest[msg.Key] != rec.offset {
+			return false
+		}
+		if msg.IsTombstone() {
+			return now.Sub(time.Unix(0, rec.timestamp)) <= tombstoneRetention
+		}
+		return true
+	}
+
+	var removed int
+	for _, s := range p.segments[:len(p.segments)-1] {
+		n, err := s.rewrite(keep, indexInterval)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// decodeKeyed decodes the message in rec, reporting false if it has no key
+// or cannot be decoded
+func decodeKeyed(rec record) (protocol.Message, bool) {
+	var msg protocol.Message
+	if err := json.Unmarshal(rec.payload, &msg); err != nil || msg.Key == "" {
+		return msg, false
+	}
+	return msg, true
+}
+
+// rewrite replaces the segment's files with a copy holding only the records
+// keep returns true for. Offsets are preserved, leaving gaps where records
+// were removed. It returns the number of records removed.
+func (s *segment) rewrite(keep func(rec record) bool, indexInterval int64) (int, error) {
+	var (
+		kept    []record
+		removed int
+	)
+	_, err := s.scan(0, func(rec record, _ int64) bool {
+		if keep(rec) {
+			kept = append(kept, rec)
+		} else {
+			removed++
+		}
+		return true
+	})
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+
+	var (
+		data        []byte
+		index       []indexEntry
+		timeIndex   []int64
+		lastIndexed int64
+		newest      int64
+	)
+	for _, rec := range kept {
+		size := int64(len(data))
+		newest = max(newest, rec.timestamp)
+		if size-lastIndexed >= indexInterval {
+			index = append(index, indexEntry{relOffset: uint32(rec.offset - s.baseOffset), position: uint32(size)})
+			timeIndex = append(timeIndex, newest)
+			lastIndexed = size
+		}
+		data = append(data, rec.encode()...)
+	}
+
+	if err := writeFileSync(s.logPath+cleanedSuffix, data); err != nil {
+		return 0, err
+	}
+
+	// Drop the old indexes before swapping in the new log. A segment
+	// without indexes is still read correctly, just more slowly.
+	for _, path := range []string{s.timeIndexPath, s.indexPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	s.timeIndex = nil
+	if err := os.Rename(s.logPath+cleanedSuffix, s.logPath); err != nil {
+		return 0, err
+	}
+	file, err := openLog(s.logPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// Readers still using the old log are sent to the new one when it is
+	// closed
+	old := s.file
+	s.file = file
+	s.size = int64(len(data))
+	s.index = index
+	s.lastIndexed = lastIndexed
+	s.publish()
+	if err := old.Close(); err != nil {
+		log.Printf("WAL: error closing compacted log %s: %v\n", s.logPath, err)
+	}
+
+	if err := writeFileSync(s.indexPath+cleanedSuffix, encodeIndex(index)); err != nil {
+		return removed, err
+	}
+	if err := os.Rename(s.indexPath+cleanedSuffix, s.indexPath); err != nil {
+		return removed, err
+	}
+
+	if err := writeFileSync(s.timeIndexPath+cleanedSuffix, encodeTimeIndex(timeIndex)); err != nil {
+		return removed, err
+	}
+	if err := os.Rename(s.timeIndexPath+cleanedSuffix, s.timeIndexPath); err != nil {
+		return removed, err
+	}
+	s.timeIndex = timeIndex
+	return removed, nil
+}
+
+// writeFileSync writes data to path and syncs it to disk
+func writeFileSync(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,90 @@
+package wal
+
+import (
+	"time"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+// DeadLetterSuffix is appended to a topic's name to form the default name
+// of its dead-letter topic
+const DeadLetterSuffix = protocol.DeadLetterSuffix
+
+// TopicConfig holds the storage and delivery settings of a topic
+type TopicConfig struct {
+	// Partitions is the number of partitions the topic is created with.
+	// Zero means a single partition. Changing it has no effect on a topic
+	// that already exists.
+	Partitions int
+	// Retention applies to topics with the delete cleanup policy
+	Retention RetentionPolicy
+	// CleanupPolicy is either CleanupPolicyDelete or CleanupPolicyCompact.
+	// An empty value means CleanupPolicyDelete.
+	CleanupPolicy string
+	// TombstoneRetention is how long a compacted topic keeps a tombstone
+	// before removing it, giving consumers time to see the deletion. Zero
+	// removes tombstones at the next compaction.
+	TombstoneRetention time.Duration
+	// MaxDeliveries is how many times a message is delivered to a consumer
+	// group without being acknowledged before it is moved to the
+	// dead-letter topic. Zero means no limit.
+	MaxDeliveries int
+	// DeadLetterTopic receives the messages that exceeded MaxDeliveries.
+	// An empty value means the topic's name followed by DeadLetterSuffix.
+	DeadLetterTopic string
+	// Durability controls when appends to the topic are synced to disk
+	Durability DurabilityPolicy
+	// MaxMessageBytes is the largest message, counting its text and
+	// payload, that may be published to the topic. Zero means only the
+	// frame size limits it.
+	MaxMessageBytes int
+}
+
+// SetTopicConfig overrides the default configuration for a topic
+func (w *WAL) SetTopicConfig(topic string, cfg TopicConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.configs[topic] = cfg
+}
+
+// TopicConfig returns the configuration in effect for a topic
+func (w *WAL) TopicConfig(topic string) TopicConfig {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.topicConfig(topic)
+}
+
+func (w *WAL) topicConfig(topic string) TopicConfig {
+	cfg, ok := w.configs[topic]
+	if !ok {
+		cfg = w.opts.DefaultTopicConfig
+	}
+	if cfg.Partitions <= 0 {
+		cfg.Partitions = 1
+	}
+	if cfg.DeadLetterTopic == "" {
+		cfg.DeadLetterTopic = topic + DeadLetterSuffix
+	}
+	cfg.Durability = cfg.Durability.withDefaults()
+	return cfg
+}
+
+// topicSnapshot is a topic's partitions and configuration, captured so
+// background work can run without holding the WAL's lock
+type topicSnapshot struct {
+	name       string
+	config     TopicConfig
+	partitions []*partitionLog
+}
+
+// snapshot returns every topic in the WAL
+func (w *WAL) snapshot() []topicSnapshot {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	topics := make([]topicSnapshot, 0, len(w.topics))
+	for name, t := range w.topics {
+		topics = append(topics, topicSnapshot{name: name, config: w.topicConfig(name), partitions: t.partitions})
+	}
+	return topics
+}
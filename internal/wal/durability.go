@@ -0,0 +1,260 @@
+package wal
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Durability modes for DurabilityPolicy.Mode
+const (
+	// DurabilityAlways syncs appends to disk before they return. Concurrent
+	// appends to a partition share one sync. It is the default.
+	DurabilityAlways = "always"
+	// DurabilityInterval syncs a partition in the background at most
+	// Interval after it is written
+	DurabilityInterval = "interval"
+	// DurabilityMessages syncs a partition in the background once Messages
+	// messages have been written to it since the last sync
+	DurabilityMessages = "messages"
+	// DurabilityOS never syncs, leaving it to the operating system to write
+	// the log to disk
+	DurabilityOS = "os"
+)
+
+// Default values used for zero fields in DurabilityPolicy
+const (
+	DefaultSyncInterval = time.Second
+	DefaultSyncMessages = 1000
+)
+
+// DurabilityPolicy controls when the appends to a topic are synced to disk.
+// Only DurabilityAlways guarantees that an acknowledged message survives a
+// crash of the machine; the other modes trade that for throughput, and may
+// lose the messages written since the last sync.
+type DurabilityPolicy struct {
+	// Mode is one of the Durability constants. An empty value means
+	// DurabilityAlways.
+	Mode string
+	// Interval is the longest written messages wait for a sync in
+	// DurabilityInterval mode
+	Interval time.Duration
+	// Messages is the number of messages written between syncs in
+	// DurabilityMessages mode
+	Messages int
+}
+
+func (d DurabilityPolicy) withDefaults() DurabilityPolicy {
+	if d.Mode == "" {
+		d.Mode = DurabilityAlways
+	}
+	if d.Interval <= 0 {
+		d.Interval = DefaultSyncInterval
+	}
+	if d.Messages <= 0 {
+		d.Messages = DefaultSyncMessages
+	}
+	return d
+}
+
+// committer runs the syncs of a partition one at a time. Appends that join
+// while a sync is running share the next one, so a burst of concurrent
+// appends is made durable by a single sync (group commit).
+type committer struct {
+	mu      sync.Mutex
+	next    *commit // the sync new appends join
+	running bool
+}
+
+// commit is one sync of a partition
+type commit struct {
+	done chan struct{}
+	err  error
+}
+
+// join adds the caller to the next sync, starting it unless one is running
+func (c *committer) join(sync func() error) *commit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.next == nil {
+		c.next = &commit{done: make(chan struct{})}
+	}
+	cm := c.next
+	if !c.running {
+		c.running = true
+		go c.run(sync)
+	}
+	return cm
+}
+
+// run performs syncs until no append is waiting for one
+func (c *committer) run(sync func() error) {
+	c.mu.Lock()
+	for c.next != nil {
+		cm := c.next
+		c.next = nil
+		c.mu.Unlock()
+
+		cm.err = sync()
+		close(cm.done)
+
+		c.mu.Lock()
+	}
+	c.running = false
+	c.mu.Unlock()
+}
+
+// fail fails the next sync with err without running it, for appends whose
+// records were removed. Appends joining afterwards get a new sync.
+func (c *committer) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.next != nil {
+		c.next.err = err
+		close(c.next.done)
+		c.next = nil
+	}
+}
+
+// wait waits for the sync to finish and returns its error
+func (cm *commit) wait() error {
+	<-cm.done
+	return cm.err
+}
+
+// pendingSegment is a segment with records written in DurabilityAlways mode
+// that readers don't see until they are synced. end is the end of the log
+// readers see.
+type pendingSegment struct {
+	s   *segment
+	end segmentEnd
+}
+
+// written records that messages were written to s after end, and starts a
+// sync if policy calls for one. In DurabilityAlways mode the records are
+// published once the sync succeeds, and it returns the sync the append must
+// wait for. Otherwise they are published right away. The caller must hold
+// the partition's lock.
+func (p *partitionLog) written(s *segment, end segmentEnd, messages int, policy DurabilityPolicy) *commit {
+	if len(p.dirty) == 0 || p.dirty[len(p.dirty)-1] != s {
+		p.dirty = append(p.dirty, s)
+	}
+	p.unsynced += messages
+	if policy.Mode != DurabilityAlways {
+		s.publish()
+	}
+
+	switch policy.Mode {
+	case DurabilityAlways:
+		if len(p.pending) == 0 || p.pending[len(p.pending)-1].s != s {
+			p.pending = append(p.pending, pendingSegment{s: s, end: end})
+		}
+		return p.commits.join(p.sync)
+	case DurabilityInterval:
+		if p.syncTimer == nil {
+			p.syncTimer = time.AfterFunc(policy.Interval, p.flush)
+		}
+	case DurabilityMessages:
+		if p.unsynced >= policy.Messages {
+			p.unsynced = 0
+			go p.flush()
+		}
+	}
+	return nil
+}
+
+// flush syncs the partition, logging any error
+func (p *partitionLog) flush() {
+	if err := p.commits.join(p.sync).wait(); err != nil {
+		log.Printf("WAL: error syncing %s: %v\n", p.dir, err)
+	}
+}
+
+// sync syncs the segments written since the last sync, then publishes the
+// records written in DurabilityAlways mode before it started. It only holds
+// the partition's lock to take the lists and publish, so appends carry on
+// meanwhile.
+func (p *partitionLog) sync() error {
+	p.mu.Lock()
+	dirty := p.dirty
+	pending := p.pending
+	p.dirty = nil
+	p.pending = nil
+	p.unsynced = 0
+	if p.syncTimer != nil {
+		p.syncTimer.Stop()
+		p.syncTimer = nil
+	}
+	p.syncs++
+	views := make([]*segmentView, len(pending))
+	for i, ps := range pending {
+		views[i] = ps.s.current()
+	}
+	p.mu.Unlock()
+
+	for i, s := range dirty {
+		// Segments deleted or compacted since they were written have
+		// nothing left to sync
+		if err := p.syncSegment(s); err != nil && !errors.Is(err, os.ErrClosed) {
+			// Keep the segments not synced for the next attempt
+			p.mu.Lock()
+			p.dirty = append(dirty[i:], p.dirty...)
+			if len(pending) > 0 {
+				p.discard(pending, err)
+			}
+			p.mu.Unlock()
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	for i, ps := range pending {
+		// Segments compacted or published past the view since keep
+		// their newer one
+		if v := ps.s.view.Load(); v.file == views[i].file && v.size <= views[i].size {
+			ps.s.view.Store(views[i])
+		}
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// syncSegment syncs the log of s, with Options.SyncFile if it is set
+func (p *partitionLog) syncSegment(s *segment) error {
+	if p.syncFile != nil {
+		return p.syncFile(s.view.Load().file)
+	}
+	return s.sync()
+}
+
+// discard removes the records of the appends a failed sync was for, and of
+// the ones written since, which readers have not seen. The appends waiting
+// for the next sync fail with err too, so no append reports success for
+// removed records. The caller must hold the partition's lock.
+func (p *partitionLog) discard(pending []pendingSegment, err error) {
+	pending = append(pending, p.pending...)
+	p.pending = nil
+	for i := len(pending) - 1; i >= 0; i-- {
+		if err := pending[i].s.undo(pending[i].end); err != nil {
+			log.Printf("WAL: error removing records not synced from %s: %v\n", pending[i].s.logPath, err)
+		}
+	}
+	p.commits.fail(err)
+}
+
+// Syncs returns the number of times partitions were synced to disk
+func (w *WAL) Syncs() int64 {
+	var syncs int64
+	for _, t := range w.snapshot() {
+		for _, p := range t.partitions {
+			p.mu.Lock()
+			syncs += p.syncs
+			p.mu.Unlock()
+		}
+	}
+	return syncs
+}
@@ -0,0 +1,172 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+// migratingSuffix marks the directory a legacy topic is converted into. It
+// is not allowed in topic names, so it can't clash with a topic.
+const migratingSuffix = "~migrating"
+
+// migrateBatchSize is the number of messages written to a segment at once
+// while converting a legacy topic
+const migrateBatchSize = 1000
+
+// migrateLegacyLogs converts the topics stored in the original format, one
+// JSON message per line in <walDir>/<topic>.log, into topics with a single
+// partition. Messages keep their offsets, which are their line numbers.
+func migrateLegacyLogs(walDir string, opts Options) error {
+	entries, err := os.ReadDir(walDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, migratingSuffix) {
+			// Left behind by a conversion that did not finish, and made
+			// again below from the legacy file
+			if err := os.RemoveAll(filepath.Join(walDir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, logSuffix) {
+			continue
+		}
+		topic := strings.TrimSuffix(name, logSuffix)
+		if err := protocol.ValidateTopic(topic); err != nil {
+			return fmt.Errorf("wal: legacy log %s: %w", name, err)
+		}
+		if err := migrateLegacyLog(walDir, topic, opts); err != nil {
+			return fmt.Errorf("wal: converting legacy log %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// migrateLegacyLog converts the legacy log of one topic. The segments are
+// written and synced in a temporary directory that is then renamed to the
+// topic's, and the legacy log is removed last, so a crash leaves either the
+// legacy log or the converted topic.
+func migrateLegacyLog(walDir, topic string, opts Options) error {
+	path := filepath.Join(walDir, topic+logSuffix)
+	dir := topicDir(walDir, topic)
+	if _, err := os.Stat(dir); err == nil {
+		// Converted by an earlier start that did not get to remove it
+		return os.Remove(path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dir + migratingSuffix
+	p, err := openPartitionLog(partitionDir(tmp, 0))
+	if err != nil {
+		return err
+	}
+	defer p.close()
+
+	// The legacy format has no append times, so every message gets the
+	// time the log was last written
+	timestamp := info.ModTime().UnixNano()
+	var recs []record
+	write := func() error {
+		if len(recs) == 0 {
+			return nil
+		}
+		if err := p.roll(opts.SegmentBytes); err != nil {
+			return err
+		}
+		if err := p.active().write(recs, opts.IndexIntervalBytes); err != nil {
+			return err
+		}
+		recs = recs[:0]
+		return nil
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var msg protocol.Message
+			if jsonErr := json.Unmarshal(line, &msg); jsonErr != nil {
+				if err == nil {
+					return fmt.Errorf("line %d: %w", offset+1, jsonErr)
+				}
+				// A last line without its newline was cut short by a
+				// crash while it was appended
+				log.Printf("WAL: dropping incomplete last line of the legacy log of topic %s\n", topic)
+				break
+			}
+			msg.Topic = topic
+			msg.ID = uint32(offset)
+			msg.TimestampMs = 0
+			payload, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			recs = append(recs, record{offset: offset, timestamp: timestamp, payload: payload})
+			offset++
+			if len(recs) == migrateBatchSize {
+				if err := write(); err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	for _, s := range p.segments {
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
+	if err := p.close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	if err := syncDir(walDir); err != nil {
+		return err
+	}
+	log.Printf("WAL: converted %d messages of topic %s from the legacy log\n", offset, topic)
+	return os.Remove(path)
+}
+
+// syncDir syncs a directory, so the entries renamed into it survive a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,177 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+// partitionLog is the ordered list of segments that make up the log of one
+// partition of a topic. Its mutex serializes appends and cleanup, so
+// partitions are written to independently of each other. Reads don't take
+// it: they use the published list of segments and each segment's view.
+type partitionLog struct {
+	mu       sync.Mutex
+	dir      string
+	segments []*segment
+	view     atomic.Pointer[[]*segment] // the segments readers see
+	closed   atomic.Bool
+
+	// Durability state, see durability.go
+	dirty     []*segment       // segments written since the last sync
+	pending   []pendingSegment // segments with records waiting for a sync to be read
+	unsynced  int              // messages written since the last sync
+	syncTimer *time.Timer      // pending sync in DurabilityInterval mode
+	syncs     int64            // syncs performed
+	commits   committer
+	syncFile  func(*os.File) error // see Options.SyncFile
+}
+
+// openPartitionLog loads the segments stored in dir, creating the directory
+// and an initial segment if the partition is new
+func openPartitionLog(dir string) (*partitionLog, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var bases []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, cleanedSuffix) {
+			// Left behind by a compaction that did not finish
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, logSuffix) {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, logSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	p := &partitionLog{dir: dir}
+	for _, base := range bases {
+		s, err := openSegment(dir, base)
+		if err != nil {
+			return nil, err
+		}
+		p.segments = append(p.segments, s)
+	}
+
+	if len(p.segments) == 0 {
+		s, err := newSegment(dir, 0)
+		if err != nil {
+			return nil, err
+		}
+		p.segments = append(p.segments, s)
+	}
+	p.publish()
+	return p, nil
+}
+
+// publish makes the current list of segments visible to readers
+func (p *partitionLog) publish() {
+	segments := p.segments
+	p.view.Store(&segments)
+}
+
+// published returns the segments readers see
+func (p *partitionLog) published() []*segment {
+	return *p.view.Load()
+}
+
+// active returns the segment new records are appended to
+func (p *partitionLog) active() *segment {
+	return p.segments[len(p.segments)-1]
+}
+
+// startOffset returns the offset of the oldest record in the log
+func (p *partitionLog) startOffset() int64 {
+	return p.segments[0].baseOffset
+}
+
+// nextOffset returns the offset the next appended record will get
+func (p *partitionLog) nextOffset() int64 {
+	return p.active().nextOffset
+}
+
+// roll starts a new active segment once the current one reaches
+// segmentBytes
+func (p *partitionLog) roll(segmentBytes int64) error {
+	active := p.active()
+	if active.size < segmentBytes || active.nextOffset == active.baseOffset {
+		return nil
+	}
+	s, err := newSegment(p.dir, active.nextOffset)
+	if err != nil {
+		return err
+	}
+	p.segments = append(p.segments, s)
+	p.publish()
+	return nil
+}
+
+// read returns the message at offset, or the next one after it if
+// compaction removed it. It returns nil if there is none. It runs without
+// the partition's lock, so a segment may be deleted or compacted during the
+// read, which is then retried.
+func (p *partitionLog) read(offset int64) (*protocol.Message, error) {
+	for {
+		msg, err := readSegments(p.published(), offset)
+		if !errors.Is(err, os.ErrClosed) || p.closed.Load() {
+			return msg, err
+		}
+	}
+}
+
+// readSegments returns the message at offset in segments, or the next one
+// after it
+func readSegments(segments []*segment, offset int64) (*protocol.Message, error) {
+	if offset < segments[0].baseOffset {
+		return nil, ErrOffsetOutOfRange
+	}
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].baseOffset > offset
+	}) - 1
+	for ; i >= 0 && i < len(segments); i++ {
+		s := segments[i]
+		msg, err := s.read(max(offset, s.baseOffset))
+		if err != nil || msg != nil {
+			return msg, err
+		}
+	}
+	return nil, nil
+}
+
+// close closes the logs of every segment
+func (p *partitionLog) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed.Store(true)
+	for _, s := range p.segments {
+		if err := s.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
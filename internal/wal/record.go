@@ -0,0 +1,85 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+// Record layout, all integers big endian:
+//
+//	length    uint32  payload length in bytes
+//	crc       uint32  CRC32C of offset, timestamp and payload
+//	offset    int64   offset of the record within its topic
+//	timestamp int64   append time in Unix nanoseconds
+//	payload   []byte  JSON encoded message
+const recordHeaderSize = 24
+
+// maxPayloadSize bounds the length field so a corrupt header cannot make
+// the reader allocate an arbitrarily large buffer
+const maxPayloadSize = 2 * protocol.MaxBodySize
+
+// ErrCorruptRecord is returned when a record fails validation
+var ErrCorruptRecord = errors.New("wal: corrupt record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// record is a single entry in a segment file
+type record struct {
+	offset    int64
+	timestamp int64
+	payload   []byte
+}
+
+// size returns the number of bytes the record takes on disk
+func (r record) size() int64 {
+	return recordHeaderSize + int64(len(r.payload))
+}
+
+// encode serializes the record in the on-disk format
+func (r record) encode() []byte {
+	buf := make([]byte, r.size())
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(r.payload)))
+	binary.BigEndian.PutUint64(buf[8:], uint64(r.offset))
+	binary.BigEndian.PutUint64(buf[16:], uint64(r.timestamp))
+	copy(buf[recordHeaderSize:], r.payload)
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(buf[8:], crcTable))
+	return buf
+}
+
+// readRecord reads and validates the next record from reader.
+// It returns io.EOF at a clean end of input, io.ErrUnexpectedEOF if the
+// input ends inside a record and ErrCorruptRecord if the record is invalid.
+func readRecord(reader io.Reader) (record, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return record{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:])
+	if length > maxPayloadSize {
+		return record{}, ErrCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			return record{}, io.ErrUnexpectedEOF
+		}
+		return record{}, err
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[8:], crcTable), crcTable, payload)
+	if crc != binary.BigEndian.Uint32(header[4:]) {
+		return record{}, ErrCorruptRecord
+	}
+
+	return record{
+		offset:    int64(binary.BigEndian.Uint64(header[8:])),
+		timestamp: int64(binary.BigEndian.Uint64(header[16:])),
+		payload:   payload,
+	}, nil
+}
@@ -0,0 +1,120 @@
+package wal
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// RetentionPolicy limits how much of a topic's log is kept.
+// Zero fields are unlimited. Data is deleted a whole segment at a time and
+// the active segment is never deleted, so a topic may temporarily hold more
+// than its limits allow.
+type RetentionPolicy struct {
+	// MaxAge deletes segments whose newest record is older than this
+	MaxAge time.Duration
+	// MaxBytes deletes the oldest segments while the log stays at least
+	// this large without them
+	MaxBytes int64
+	// MaxMessages deletes the oldest segments while the log keeps at least
+	// this many messages without them
+	MaxMessages int64
+}
+
+// EnforceRetention deletes the segments that fall outside each topic's
+// retention policy. Compacted topics are left to the compactor.
+func (w *WAL) EnforceRetention() error {
+	now := time.Now()
+	for _, t := range w.snapshot() {
+		if t.config.CleanupPolicy == CleanupPolicyCompact {
+			continue
+		}
+		for i, p := range t.partitions {
+			p.mu.Lock()
+			deleted, err := p.retain(t.config.Retention, now)
+			p.mu.Unlock()
+			for _, s := range deleted {
+				log.Printf("WAL: retention deleted segment %s of topic %s partition %d\n", filepath.Base(s.logPath), t.name, i)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StartCleaner enforces retention every interval in a background goroutine
+// until the returned stop function is called
+func (w *WAL) StartCleaner(interval time.Duration) (stop func()) {
+	return runEvery(interval, func() {
+		if err := w.EnforceRetention(); err != nil {
+			log.Printf("WAL: error enforcing retention: %v\n", err)
+		}
+	})
+}
+
+// runEvery calls fn every interval in a background goroutine until the
+// returned stop function is called
+func runEvery(interval time.Duration, fn func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// retain removes the oldest segments of the log that violate policy and
+// returns them
+func (p *partitionLog) retain(policy RetentionPolicy, now time.Time) ([]*segment, error) {
+	if p.closed.Load() {
+		return nil, nil // The topic was deleted
+	}
+
+	var size int64
+	for _, s := range p.segments {
+		size += s.size
+	}
+	messages := p.nextOffset() - p.startOffset()
+
+	var deleted []*segment
+	defer func() {
+		// Readers stop seeing the deleted segments before their logs are
+		// closed
+		p.publish()
+		for _, s := range deleted {
+			if err := s.close(); err != nil {
+				log.Printf("WAL: error closing deleted segment %s: %v\n", s.logPath, err)
+			}
+		}
+	}()
+	for len(p.segments) > 1 {
+		oldest := p.segments[0]
+		count := p.segments[1].baseOffset - oldest.baseOffset
+
+		expired := policy.MaxAge > 0 && now.Sub(time.Unix(0, oldest.maxTime)) > policy.MaxAge
+		tooLarge := policy.MaxBytes > 0 && size-oldest.size >= policy.MaxBytes
+		tooMany := policy.MaxMessages > 0 && messages-count >= policy.MaxMessages
+		if !expired && !tooLarge && !tooMany {
+			break
+		}
+
+		if err := oldest.remove(); err != nil {
+			return deleted, err
+		}
+		p.segments = p.segments[1:]
+		size -= oldest.size
+		messages -= count
+		deleted = append(deleted, oldest)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,434 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+const (
+	logSuffix      = ".log"
+	indexSuffix    = ".index"
+	indexEntrySize = 8
+)
+
+// indexEntry maps an offset, relative to the segment's base offset, to the
+// byte position of its record in the segment's log file
+type indexEntry struct {
+	relOffset uint32
+	position  uint32
+}
+
+// segment is a contiguous range of a topic's log stored in its own file,
+// named after the offset of its first record. Its fields are guarded by the
+// partition's lock, while readers use the published view.
+type segment struct {
+	baseOffset    int64
+	nextOffset    int64
+	size          int64
+	logPath       string
+	indexPath     string
+	timeIndexPath string
+	file          *os.File // the log, kept open for appends and reads
+	index         []indexEntry
+	timeIndex     []int64 // newest timestamp up to the record of each index entry
+	lastIndexed   int64   // position of the most recently indexed record
+	maxTime       int64   // timestamp of the newest record, in Unix nanoseconds
+	view          atomic.Pointer[segmentView]
+}
+
+// segmentView is the part of a segment readers see. A new view is published
+// once appended records are complete, so reads don't take the partition's
+// lock and never see a partial record. The index shares its backing array
+// with the segment's, which only ever writes past the view's entries.
+type segmentView struct {
+	file       *os.File
+	size       int64
+	nextOffset int64
+	index      []indexEntry
+}
+
+// publish makes the segment's current state visible to readers
+func (s *segment) publish() {
+	s.view.Store(s.current())
+}
+
+// current returns a view of the segment's current state
+func (s *segment) current() *segmentView {
+	return &segmentView{file: s.file, size: s.size, nextOffset: s.nextOffset, index: s.index}
+}
+
+// openLog opens a segment's log for appending and reading
+func openLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+}
+
+// segmentName returns the zero-padded file name stem for a base offset
+func segmentName(baseOffset int64) string {
+	return fmt.Sprintf("%020d", baseOffset)
+}
+
+// newSegment creates an empty segment starting at baseOffset
+func newSegment(dir string, baseOffset int64) (*segment, error) {
+	s := &segment{
+		baseOffset:    baseOffset,
+		nextOffset:    baseOffset,
+		logPath:       filepath.Join(dir, segmentName(baseOffset)+logSuffix),
+		indexPath:     filepath.Join(dir, segmentName(baseOffset)+indexSuffix),
+		timeIndexPath: filepath.Join(dir, segmentName(baseOffset)+timeIndexSuffix),
+	}
+	for _, path := range []string{s.indexPath, s.timeIndexPath} {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := file.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := openLog(s.logPath)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	s.publish()
+	return s, nil
+}
+
+// openSegment loads an existing segment, reading its sparse indexes and
+// validating the records after the last indexed one. An incomplete or
+// corrupt tail left by a crash is truncated back to the last good record.
+func openSegment(dir string, baseOffset int64) (*segment, error) {
+	s := &segment{
+		baseOffset:    baseOffset,
+		logPath:       filepath.Join(dir, segmentName(baseOffset)+logSuffix),
+		indexPath:     filepath.Join(dir, segmentName(baseOffset)+indexSuffix),
+		timeIndexPath: filepath.Join(dir, segmentName(baseOffset)+timeIndexSuffix),
+	}
+
+	file, err := openLog(s.logPath)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.publish()
+	return s, nil
+}
+
+// load reads the segment's indexes and recovers the end of its log
+func (s *segment) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = info.Size()
+
+	if err := s.loadIndex(); err != nil {
+		return err
+	}
+	if err := s.loadTimeIndex(); err != nil {
+		return err
+	}
+
+	position, offset := int64(0), s.baseOffset
+	if n := len(s.index); n > 0 {
+		position = int64(s.index[n-1].position)
+		offset = s.baseOffset + int64(s.index[n-1].relOffset)
+	}
+	if n := len(s.timeIndex); n > 0 {
+		s.maxTime = s.timeIndex[n-1]
+	}
+	s.nextOffset = offset
+	end, err := s.scan(position, func(rec record, _ int64) bool {
+		s.nextOffset = rec.offset + 1
+		s.maxTime = max(s.maxTime, rec.timestamp)
+		return true
+	})
+	if errors.Is(err, ErrCorruptRecord) || errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Printf("WAL: truncating %s from %d to %d bytes after invalid record: %v\n", s.logPath, s.size, end, err)
+		return s.truncate(end)
+	}
+	return err
+}
+
+// loadIndex reads the segment's index file, ignoring entries that point
+// past the end of the log
+func (s *segment) loadIndex() error {
+	data, err := os.ReadFile(s.indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.index = s.index[:0]
+	for i := 0; i+indexEntrySize <= len(data); i += indexEntrySize {
+		entry := indexEntry{
+			relOffset: binary.BigEndian.Uint32(data[i:]),
+			position:  binary.BigEndian.Uint32(data[i+4:]),
+		}
+		if int64(entry.position) >= s.size {
+			break
+		}
+		s.index = append(s.index, entry)
+		s.lastIndexed = int64(entry.position)
+	}
+	return nil
+}
+
+// encodeIndex serializes index entries in the index file format
+func encodeIndex(entries []indexEntry) []byte {
+	buf := make([]byte, len(entries)*indexEntrySize)
+	for i, entry := range entries {
+		binary.BigEndian.PutUint32(buf[i*indexEntrySize:], entry.relOffset)
+		binary.BigEndian.PutUint32(buf[i*indexEntrySize+4:], entry.position)
+	}
+	return buf
+}
+
+// lookup returns the byte position and offset of the closest record at or
+// before offset in a segment's index
+func lookup(index []indexEntry, baseOffset, offset int64) (position int64, startOffset int64) {
+	rel := offset - baseOffset
+	i := sort.Search(len(index), func(i int) bool {
+		return int64(index[i].relOffset) > rel
+	})
+	if i == 0 {
+		return 0, baseOffset
+	}
+	entry := index[i-1]
+	return int64(entry.position), baseOffset + int64(entry.relOffset)
+}
+
+// scan calls fn for each record starting at position, which must be the
+// start of a record. Scanning stops when fn returns false, at the end of the
+// log or at the first invalid record. It returns the position of the record
+// it stopped at.
+func (s *segment) scan(position int64, fn func(rec record, position int64) bool) (int64, error) {
+	return scanRecords(io.NewSectionReader(s.file, position, s.size-position), position, fn)
+}
+
+// scan calls fn for each record in the view starting at position, like
+// segment.scan
+func (v *segmentView) scan(position int64, fn func(rec record, position int64) bool) (int64, error) {
+	return scanRecords(io.NewSectionReader(v.file, position, v.size-position), position, fn)
+}
+
+// scanRecords calls fn for each record read from r, which starts at
+// position in the log
+func scanRecords(r io.Reader, position int64, fn func(rec record, position int64) bool) (int64, error) {
+	reader := bufio.NewReader(r)
+	for {
+		rec, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			return position, nil
+		}
+		if err != nil {
+			return position, err
+		}
+		if !fn(rec, position) {
+			return position, nil
+		}
+		position += rec.size()
+	}
+}
+
+// truncate cuts the log back to size bytes and drops index entries that
+// pointed past it
+func (s *segment) truncate(size int64) error {
+	if err := os.Truncate(s.logPath, size); err != nil {
+		return err
+	}
+	s.size = size
+
+	s.lastIndexed = 0
+	for i, entry := range s.index {
+		if int64(entry.position) >= size {
+			s.index = s.index[:i]
+			break
+		}
+		s.lastIndexed = int64(entry.position)
+	}
+	if err := os.Truncate(s.indexPath, int64(len(s.index))*indexEntrySize); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(s.timeIndex) > len(s.index) {
+		s.timeIndex = s.timeIndex[:len(s.index)]
+	}
+	if err := os.Truncate(s.timeIndexPath, int64(len(s.timeIndex))*timeIndexEntrySize); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// write appends records to the log in a single write, adding an index entry
+// once indexInterval bytes have been written since the last one. The log is
+// not synced; call sync once the records should be durable.
+func (s *segment) write(recs []record, indexInterval int64) error {
+	position := s.size
+	newest := s.maxTime
+	var buf []byte
+	for _, rec := range recs {
+		newest = max(newest, rec.timestamp)
+		if position-s.lastIndexed >= indexInterval {
+			if err := s.appendIndex(rec, position, newest); err != nil {
+				s.dropIndex()
+				return err
+			}
+		}
+		buf = append(buf, rec.encode()...)
+		position += rec.size()
+	}
+
+	if _, err := s.file.Write(buf); err != nil {
+		// Drop whatever part of the records made it to disk, and the index
+		// entries pointing at them
+		if truncErr := s.truncate(s.size); truncErr != nil {
+			log.Printf("WAL: error truncating partial write in %s: %v\n", s.logPath, truncErr)
+		}
+		return err
+	}
+
+	s.size = position
+	s.nextOffset = recs[len(recs)-1].offset + 1
+	s.maxTime = newest
+	return nil
+}
+
+// dropIndex removes index entries added for records that were not written
+func (s *segment) dropIndex() {
+	if err := s.truncate(s.size); err != nil {
+		log.Printf("WAL: error dropping index entries in %s: %v\n", s.indexPath, err)
+	}
+}
+
+// sync flushes the log to disk. It may run without the partition's lock.
+func (s *segment) sync() error {
+	return s.view.Load().file.Sync()
+}
+
+// segmentEnd is the end of a segment's log, remembered to undo appends
+type segmentEnd struct {
+	size       int64
+	nextOffset int64
+	maxTime    int64
+}
+
+// end returns the current end of the log
+func (s *segment) end() segmentEnd {
+	return segmentEnd{size: s.size, nextOffset: s.nextOffset, maxTime: s.maxTime}
+}
+
+// undo removes everything appended to the log after end
+func (s *segment) undo(end segmentEnd) error {
+	if err := s.truncate(end.size); err != nil {
+		return err
+	}
+	s.nextOffset = end.nextOffset
+	s.maxTime = end.maxTime
+	return nil
+}
+
+// close closes the segment's log. Reads still using it fail with
+// os.ErrClosed.
+func (s *segment) close() error {
+	return s.file.Close()
+}
+
+// remove deletes the segment's files
+func (s *segment) remove() error {
+	if err := os.Remove(s.logPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.timeIndexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// appendIndex records position as the position of rec in the log, and
+// newest as the newest timestamp up to rec in the time index
+func (s *segment) appendIndex(rec record, position, newest int64) error {
+	entry := indexEntry{
+		relOffset: uint32(rec.offset - s.baseOffset),
+		position:  uint32(position),
+	}
+
+	// Each time index entry belongs to the offset index entry at the same
+	// position. It is written first, and entries past the end of the offset
+	// index are ignored on load. Segments written before the time index
+	// existed have none.
+	indexTime := len(s.timeIndex) == len(s.index)
+	if indexTime {
+		if err := s.writeTimeIndexEntry(len(s.timeIndex), newest); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(s.indexPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(encodeIndex([]indexEntry{entry})); err != nil {
+		return err
+	}
+
+	s.index = append(s.index, entry)
+	if indexTime {
+		s.timeIndex = append(s.timeIndex, newest)
+	}
+	s.lastIndexed = position
+	return nil
+}
+
+// read returns the message stored at offset, or nil if the segment does
+// not hold it. It reads the published view, without the partition's lock.
+func (s *segment) read(offset int64) (*protocol.Message, error) {
+	v := s.view.Load()
+	if offset < s.baseOffset || offset >= v.nextOffset {
+		return nil, nil
+	}
+
+	var found *record
+	position, _ := lookup(v.index, s.baseOffset, offset)
+	_, err := v.scan(position, func(rec record, _ int64) bool {
+		if rec.offset < offset {
+			return true
+		}
+		found = &rec
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, nil
+	}
+
+	var msg protocol.Message
+	if err := json.Unmarshal(found.payload, &msg); err != nil {
+		return nil, err
+	}
+	msg.ID = uint32(found.offset)
+	msg.TimestampMs = time.Unix(0, found.timestamp).UnixMilli()
+	return &msg, nil
+}
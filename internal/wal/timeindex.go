@@ -0,0 +1,103 @@
+package wal
+
+import (
+	"encoding/binary"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	timeIndexSuffix    = ".timeindex"
+	timeIndexEntrySize = 8
+)
+
+// loadTimeIndex reads the segment's time index file, keeping only the
+// entries that belong to an entry of the offset index
+func (s *segment) loadTimeIndex() error {
+	data, err := os.ReadFile(s.timeIndexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.timeIndex = s.timeIndex[:0]
+	for i := 0; i+timeIndexEntrySize <= len(data) && len(s.timeIndex) < len(s.index); i += timeIndexEntrySize {
+		s.timeIndex = append(s.timeIndex, int64(binary.BigEndian.Uint64(data[i:])))
+	}
+	return nil
+}
+
+// encodeTimeIndex serializes timestamps in the time index file format
+func encodeTimeIndex(timestamps []int64) []byte {
+	buf := make([]byte, len(timestamps)*timeIndexEntrySize)
+	for i, timestamp := range timestamps {
+		binary.BigEndian.PutUint64(buf[i*timeIndexEntrySize:], uint64(timestamp))
+	}
+	return buf
+}
+
+// writeTimeIndexEntry writes the i-th entry of the time index file,
+// overwriting anything left there by an earlier failed write
+func (s *segment) writeTimeIndexEntry(i int, timestamp int64) error {
+	file, err := os.OpenFile(s.timeIndexPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteAt(encodeTimeIndex([]int64{timestamp}), int64(i)*timeIndexEntrySize)
+	return err
+}
+
+// offsetForTime returns the offset of the first record with a timestamp at
+// or after timestamp, reporting false if the segment has none
+func (s *segment) offsetForTime(timestamp int64) (int64, bool, error) {
+	if s.nextOffset == s.baseOffset || s.maxTime < timestamp {
+		return 0, false, nil
+	}
+
+	// Every record up to an entry with an older timestamp is older too, so
+	// scanning can start at the last such entry
+	i := sort.Search(len(s.timeIndex), func(i int) bool {
+		return s.timeIndex[i] >= timestamp
+	})
+	var position int64
+	if i > 0 {
+		position = int64(s.index[i-1].position)
+	}
+
+	offset, found := int64(0), false
+	_, err := s.scan(position, func(rec record, _ int64) bool {
+		if rec.timestamp < timestamp {
+			return true
+		}
+		offset, found = rec.offset, true
+		return false
+	})
+	return offset, found, err
+}
+
+// offsetForTime returns the offset of the first record with a timestamp at
+// or after timestamp, or the next offset if every record is older
+func (p *partitionLog) offsetForTime(timestamp int64) (int64, error) {
+	for _, s := range p.segments {
+		offset, found, err := s.offsetForTime(timestamp)
+		if err != nil || found {
+			return offset, err
+		}
+	}
+	return p.nextOffset(), nil
+}
+
+// OffsetForTime returns the offset of the first message appended to a
+// partition at or after t, or the partition's next offset if there is none
+func (w *WAL) OffsetForTime(topic string, partition int, t time.Time) (int64, error) {
+	p, err := w.partition(topic, partition)
+	if err != nil || p == nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.offsetForTime(t.UnixNano())
+}
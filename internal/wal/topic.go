@@ -0,0 +1,106 @@
+package wal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// topic is the set of partition logs of a topic. Partition i is stored in
+// the directory <walDir>/<topic>/<i>.
+type topic struct {
+	partitions []*partitionLog
+}
+
+// createTopic creates the directories and initial segments of a topic with
+// the given number of partitions, whose logs are synced with syncFile
+func createTopic(dir string, partitions int, syncFile func(*os.File) error) (*topic, error) {
+	t := &topic{}
+	for i := 0; i < partitions; i++ {
+		p, err := openPartitionLog(partitionDir(dir, i))
+		if err != nil {
+			return nil, err
+		}
+		p.syncFile = syncFile
+		t.partitions = append(t.partitions, p)
+	}
+	return t, nil
+}
+
+// openTopic loads the partitions of a topic stored in dir
+func openTopic(dir string, syncFile func(*os.File) error) (*topic, error) {
+	if err := migrateUnpartitioned(dir); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := strconv.Atoi(entry.Name()); err == nil {
+			count++
+		}
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("wal: topic directory %s has no partitions", dir)
+	}
+
+	// Partitions are numbered from zero, so a gap means a missing directory
+	for i := 0; i < count; i++ {
+		if _, err := os.Stat(partitionDir(dir, i)); err != nil {
+			return nil, fmt.Errorf("wal: topic directory %s is missing partition %d", dir, i)
+		}
+	}
+	return createTopic(dir, count, syncFile)
+}
+
+// migrateUnpartitioned moves the segments of a topic written before
+// partitions existed into partition 0
+func migrateUnpartitioned(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && (strings.HasSuffix(name, logSuffix) || strings.HasSuffix(name, indexSuffix)) {
+			files = append(files, name)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	target := partitionDir(dir, 0)
+	if err := os.MkdirAll(target, os.ModePerm); err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(target, name)); err != nil {
+			return err
+		}
+	}
+	log.Printf("WAL: moved %d files of %s into partition 0\n", len(files), dir)
+	return nil
+}
+
+// topicDir returns the directory holding a topic's partitions
+func topicDir(walDir, topic string) string {
+	return filepath.Join(walDir, topic)
+}
+
+// partitionDir returns the directory holding a partition's segments
+func partitionDir(topicDir string, partition int) string {
+	return filepath.Join(topicDir, strconv.Itoa(partition))
+}
@@ -1,108 +1,444 @@
 package wal
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"os"
-	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/tiagomorais/simple-message-broker/internal/protocol"
 )
 
-// WAL represents a Write-Ahead Log for message persistence
+// Default values used for zero fields in Options
+const (
+	DefaultSegmentBytes       = 64 * 1024 * 1024
+	DefaultIndexIntervalBytes = 4096
+)
+
+// Options configures how a WAL lays out its files
+type Options struct {
+	// SegmentBytes is the size at which a topic's active segment is closed
+	// and a new one started
+	SegmentBytes int64
+	// IndexIntervalBytes is the number of log bytes between two entries of
+	// a segment's sparse offset index
+	IndexIntervalBytes int64
+	// DefaultTopicConfig applies to topics without their own configuration
+	DefaultTopicConfig TopicConfig
+	// SyncFile syncs the log of a segment to disk. Nil means
+	// (*os.File).Sync; tests set it to delay or fail syncs.
+	SyncFile func(*os.File) error
+}
+
+var (
+	// ErrOffsetOutOfRange is returned when reading an offset that has been
+	// deleted by retention
+	ErrOffsetOutOfRange = errors.New("wal: offset is before the start of the log")
+	// ErrTopicExists is returned when creating a topic that already exists
+	ErrTopicExists = errors.New("wal: topic already exists")
+	// ErrInvalidPartition is returned for a partition the topic doesn't have
+	ErrInvalidPartition = errors.New("wal: partition does not exist")
+	// ErrUnknownTopic is returned when deleting a topic that doesn't exist
+	ErrUnknownTopic = errors.New("wal: topic does not exist")
+	// ErrPartitionClosed is returned when appending to a partition whose
+	// topic was deleted, or after the WAL was closed
+	ErrPartitionClosed = errors.New("wal: partition is closed")
+	// ErrPartialBatch is returned when the sync of some partitions of a
+	// batch failed after the messages of others were stored, so appending
+	// the batch again would store those twice
+	ErrPartialBatch = errors.New("wal: batch partially stored")
+)
+
+// WAL represents a Write-Ahead Log for message persistence.
+// Each topic is split into partitions, each stored as a directory of
+// segment files with a sparse index mapping offsets to byte positions.
+// Partitions are appended to independently of each other.
 type WAL struct {
-	dir string
-	mu  sync.Mutex
+	dir     string
+	opts    Options
+	mu      sync.RWMutex // guards topics and configs
+	topics  map[string]*topic
+	configs map[string]TopicConfig
 }
 
-// NewWAL creates a new WAL instance with the specified directory
-func NewWAL(dir string) (*WAL, error) {
+// NewWAL creates a new WAL instance with the specified directory, loading
+// any topics already stored in it. Records left incomplete or corrupt at
+// the end of a segment by a crash are truncated away.
+func NewWAL(dir string, opts Options) (*WAL, error) {
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		return nil, err
 	}
-	return &WAL{dir: dir}, nil
+
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = DefaultSegmentBytes
+	}
+	if opts.IndexIntervalBytes <= 0 {
+		opts.IndexIntervalBytes = DefaultIndexIntervalBytes
+	}
+
+	w := &WAL{
+		dir:     dir,
+		opts:    opts,
+		topics:  make(map[string]*topic),
+		configs: make(map[string]TopicConfig),
+	}
+
+	if err := migrateLegacyLogs(dir, opts); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		t, err := openTopic(topicDir(dir, entry.Name()), opts.SyncFile)
+		if err != nil {
+			return nil, err
+		}
+		w.topics[entry.Name()] = t
+	}
+
+	return w, nil
 }
 
-// Append writes a message to the WAL and returns the assigned ID
-func (w *WAL) Append(msg protocol.Message) (uint32, error) {
+// CreateTopic creates a topic with the given configuration.
+// It returns ErrTopicExists if the topic already exists, and an error
+// wrapping protocol.ErrInvalidTopic if its name is invalid.
+func (w *WAL) CreateTopic(name string, cfg TopicConfig) error {
+	if err := protocol.ValidateTopic(name); err != nil {
+		return err
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	walPath := filepath.Join(w.dir, msg.Topic+".log")
+	if _, ok := w.topics[name]; ok {
+		return ErrTopicExists
+	}
+	w.configs[name] = cfg
+	return w.createTopic(name)
+}
 
-	// Count existing messages to determine the next ID
-	nextID, err := w.countMessages(walPath)
-	if err != nil {
-		return 0, err
+// DeleteTopic deletes a topic with all of its messages. Its configuration
+// is dropped too, so a topic created again with the same name starts empty
+// with the default configuration. Appends to the topic that are under way
+// fail with ErrPartitionClosed. It returns ErrUnknownTopic if the topic
+// doesn't exist.
+func (w *WAL) DeleteTopic(name string) error {
+	// Holding the lock until the files are gone keeps the topic from being
+	// created again on top of them
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t, ok := w.topics[name]
+	if !ok {
+		return ErrUnknownTopic
 	}
+	delete(w.topics, name)
+	delete(w.configs, name)
+	for _, p := range t.partitions {
+		if err := p.close(); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(topicDir(w.dir, name))
+}
 
-	// Assign the auto-generated ID to the message
-	msg.ID = nextID
+// Topics returns the names of every topic, sorted
+func (w *WAL) Topics() []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
 
-	// Open the file for appending, creating it if it doesn't exist
-	file, err := os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return 0, err
+	names := make([]string, 0, len(w.topics))
+	for name := range w.topics {
+		names = append(names, name)
 	}
-	defer file.Close()
+	sort.Strings(names)
+	return names
+}
 
-	line, err := json.Marshal(msg)
+// HasTopic reports whether a topic exists
+func (w *WAL) HasTopic(name string) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	_, ok := w.topics[name]
+	return ok
+}
+
+// createTopic creates a topic with the configuration in effect for it.
+// Names that don't follow the topic name grammar are rejected, so topic
+// directories always stay inside the WAL's. The caller must hold the write
+// lock.
+func (w *WAL) createTopic(name string) error {
+	if err := protocol.ValidateTopic(name); err != nil {
+		return err
+	}
+	t, err := createTopic(topicDir(w.dir, name), w.topicConfig(name).Partitions, w.opts.SyncFile)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	if _, err := file.Write(append(line, '\n')); err != nil {
-		return 0, err
+	w.topics[name] = t
+	return nil
+}
+
+// Partitions returns the number of partitions of a topic. Topics that
+// don't exist yet report the number they will be created with.
+func (w *WAL) Partitions(topic string) int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if t, ok := w.topics[topic]; ok {
+		return len(t.partitions)
 	}
+	return w.topicConfig(topic).Partitions
+}
 
-	// Sync to ensure durability
-	if err := file.Sync(); err != nil {
+// Append writes a message to its partition and returns the assigned ID.
+// The topic is created on its first message.
+func (w *WAL) Append(msg protocol.Message) (uint32, error) {
+	offsets, err := w.AppendBatch([]protocol.Message{msg})
+	if err != nil {
 		return 0, err
 	}
-
-	return nextID, nil
+	return uint32(offsets[0]), nil
 }
 
-// ReadAt reads a message from the WAL at the specified offset
-func (w *WAL) ReadAt(topic string, offset int64) (*protocol.Message, error) {
-	walPath := filepath.Join(w.dir, topic+".log")
-	file, err := os.Open(walPath)
+// AppendBatch writes messages, which may belong to several topics and
+// partitions, and returns the offset assigned to each. Topics are created on
+// their first message. The messages of each partition are written together:
+// if any write fails, none of the batch is kept.
+//
+// Each topic's durability policy decides when its messages are synced to
+// disk. In DurabilityAlways mode readers only see the messages once they are
+// synced, and AppendBatch returns once they are, sharing the sync with
+// concurrent appends to the same partitions. If the sync fails the messages
+// are removed from the partition and the error is returned; if other
+// partitions of the batch kept theirs, the error wraps ErrPartialBatch.
+func (w *WAL) AppendBatch(msgs []protocol.Message) ([]int64, error) {
+	// Group the messages by partition, keeping their order
+	var batches []*partitionBatch
+	byPartition := make(map[*partitionLog]*partitionBatch)
+	for i, msg := range msgs {
+		p, err := w.partitionForAppend(msg.Topic, msg.Partition)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := byPartition[p]
+		if !ok {
+			b = &partitionBatch{p: p, durability: w.TopicConfig(msg.Topic).Durability}
+			byPartition[p] = b
+			batches = append(batches, b)
+		}
+		b.indexes = append(b.indexes, i)
+	}
+
+	offsets := make([]int64, len(msgs))
+	commits, err := w.writeBatch(msgs, batches, offsets)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	var currentLine int64
-	for scanner.Scan() {
-		if currentLine == offset {
-			var msg protocol.Message
-			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+	// Wait for the syncs outside the partition locks, so other appends
+	// can join them
+	failed := 0
+	for _, cm := range commits {
+		if syncErr := cm.wait(); syncErr != nil {
+			failed++
+			err = syncErr
+		}
+	}
+	switch {
+	case failed == 0:
+		return offsets, nil
+	case failed < len(batches):
+		return nil, fmt.Errorf("%w: %v", ErrPartialBatch, err)
+	default:
+		return nil, err
+	}
+}
+
+// partitionBatch is the part of a batch appended to one partition
+type partitionBatch struct {
+	p          *partitionLog
+	durability DurabilityPolicy
+	indexes    []int // of the messages in the batch
+}
+
+// writeBatch writes the messages of each partition batch, storing their
+// offsets, and returns the syncs to wait for. It undoes every write if one
+// fails.
+func (w *WAL) writeBatch(msgs []protocol.Message, batches []*partitionBatch, offsets []int64) ([]*commit, error) {
+	// Lock the partitions in a fixed order so concurrent batches can't
+	// deadlock
+	sort.Slice(batches, func(i, j int) bool { return batches[i].p.dir < batches[j].p.dir })
+	for _, b := range batches {
+		b.p.mu.Lock()
+		defer b.p.mu.Unlock()
+	}
+	for _, b := range batches {
+		if b.p.closed.Load() {
+			return nil, ErrPartitionClosed
+		}
+	}
+
+	type written struct {
+		s   *segment
+		end segmentEnd
+	}
+	var done []written
+	undo := func() {
+		for _, d := range done {
+			if err := d.s.undo(d.end); err != nil {
+				log.Printf("WAL: error undoing batch in %s: %v\n", d.s.logPath, err)
+			}
+		}
+	}
+
+	now := time.Now().UnixNano()
+	for _, b := range batches {
+		if err := b.p.roll(w.opts.SegmentBytes); err != nil {
+			undo()
+			return nil, err
+		}
+
+		// Assign the next offsets in the partition as the message IDs. The
+		// append time is kept in the records, and added to the messages on
+		// read.
+		offset := b.p.nextOffset()
+		recs := make([]record, len(b.indexes))
+		for j, i := range b.indexes {
+			msg := msgs[i]
+			msg.ID = uint32(offset)
+			msg.TimestampMs = 0
+
+			payload, err := json.Marshal(msg)
+			if err != nil {
+				undo()
 				return nil, err
 			}
-			return &msg, nil
+			recs[j] = record{offset: offset, timestamp: now, payload: payload}
+			offsets[i] = offset
+			offset++
 		}
-		currentLine++
+
+		s := b.p.active()
+		end := s.end()
+		if err := s.write(recs, w.opts.IndexIntervalBytes); err != nil {
+			undo()
+			return nil, err
+		}
+		done = append(done, written{s: s, end: end})
 	}
 
-	return nil, nil // No message at this offset
+	// Make the batch visible to readers only once all of it is written, or
+	// in DurabilityAlways mode once it is synced
+	var commits []*commit
+	for i, b := range batches {
+		if cm := b.p.written(done[i].s, done[i].end, len(b.indexes), b.durability); cm != nil {
+			commits = append(commits, cm)
+		}
+	}
+	return commits, nil
 }
 
-// countMessages counts the number of messages in a WAL file
-func (w *WAL) countMessages(walPath string) (uint32, error) {
-	file, err := os.Open(walPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return 0, nil
+// ReadAt reads a message from a partition at the specified offset. If
+// compaction removed that offset, the next message after it is returned.
+// It returns ErrOffsetOutOfRange if the offset has been deleted. Reads
+// don't wait for appends to the partition, and only see the messages of
+// appends that have completed.
+func (w *WAL) ReadAt(topic string, partition int, offset int64) (*protocol.Message, error) {
+	p, err := w.partition(topic, partition)
+	if err != nil || p == nil {
+		return nil, err // No messages for this topic
+	}
+	return p.read(offset)
+}
+
+// StartOffset returns the offset of the oldest message still stored in a
+// partition
+func (w *WAL) StartOffset(topic string, partition int) int64 {
+	p, err := w.partition(topic, partition)
+	if err != nil || p == nil {
+		return 0
+	}
+	return p.published()[0].baseOffset
+}
+
+// NextOffset returns the offset the next message appended to a partition
+// will get
+func (w *WAL) NextOffset(topic string, partition int) int64 {
+	p, err := w.partition(topic, partition)
+	if err != nil || p == nil {
+		return 0
+	}
+	segments := p.published()
+	return segments[len(segments)-1].view.Load().nextOffset
+}
+
+// Size returns the number of bytes stored in a partition's log
+func (w *WAL) Size(topic string, partition int) int64 {
+	p, err := w.partition(topic, partition)
+	if err != nil || p == nil {
+		return 0
+	}
+	var size int64
+	for _, s := range p.published() {
+		size += s.view.Load().size
+	}
+	return size
+}
+
+// Close closes the files of every topic. The WAL must not be used
+// afterwards.
+func (w *WAL) Close() error {
+	for _, t := range w.snapshot() {
+		for _, p := range t.partitions {
+			if err := p.close(); err != nil {
+				return err
+			}
 		}
-		return 0, err
 	}
-	defer file.Close()
+	return nil
+}
+
+// partition returns the log of a partition, or nil if the topic doesn't
+// exist
+func (w *WAL) partition(topic string, partition int) (*partitionLog, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	t, ok := w.topics[topic]
+	if !ok {
+		return nil, nil
+	}
+	if partition < 0 || partition >= len(t.partitions) {
+		return nil, ErrInvalidPartition
+	}
+	return t.partitions[partition], nil
+}
 
-	var count uint32
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		count++
+// partitionForAppend returns the log of a partition, creating the topic if
+// it doesn't exist
+func (w *WAL) partitionForAppend(topic string, partition int) (*partitionLog, error) {
+	p, err := w.partition(topic, partition)
+	if err != nil || p != nil {
+		return p, err
+	}
+
+	w.mu.Lock()
+	if _, ok := w.topics[topic]; !ok {
+		err = w.createTopic(topic)
+	}
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
 	}
-	return count, scanner.Err()
+	return w.partition(topic, partition)
 }
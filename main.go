@@ -3,8 +3,10 @@ package main
 import (
 	"log"
 	"net"
+	"time"
 
 	"github.com/tiagomorais/simple-message-broker/internal/broker"
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
 	"github.com/tiagomorais/simple-message-broker/internal/storage"
 	"github.com/tiagomorais/simple-message-broker/internal/wal"
 )
@@ -12,24 +14,85 @@ import (
 const (
 	walDir      = "./wal/"
 	offsetsFile = "offsets.json"
+	topicsFile  = "topics.json"
 	listenAddr  = ":8080"
+
+	segmentBytes       = 64 * 1024 * 1024
+	indexIntervalBytes = 4096
+
+	defaultPartitions = 1
+
+	// retentionMaxAge is the default age limit of a topic's messages. Zero
+	// means no limit, so existing data is kept unless a topic sets one.
+	retentionMaxAge        = 0
+	retentionCheckInterval = 5 * time.Minute
+
+	tombstoneRetention = 24 * time.Hour
+	compactionInterval = 10 * time.Minute
+
+	maxDeliveries = 10
+
+	// durability is when appends are synced to disk, see wal.DurabilityPolicy
+	durability = wal.DurabilityAlways
+	// syncInterval is the longest appends wait for a sync in interval mode
+	syncInterval = wal.DefaultSyncInterval
+	// syncMessages is the number of appends between syncs in messages mode
+	syncMessages = wal.DefaultSyncMessages
+
+	// autoCreateTopics creates topics on their first publish. Without it
+	// topics must be created with CREATE_TOPIC.
+	autoCreateTopics = true
+
+	// writeTimeout closes the connections of clients that stop reading
+	writeTimeout = 30 * time.Second
 )
 
 func main() {
 	// Initialize WAL
-	w, err := wal.NewWAL(walDir)
+	w, err := wal.NewWAL(walDir, wal.Options{
+		SegmentBytes:       segmentBytes,
+		IndexIntervalBytes: indexIntervalBytes,
+		DefaultTopicConfig: wal.TopicConfig{
+			Partitions:         defaultPartitions,
+			Retention:          wal.RetentionPolicy{MaxAge: retentionMaxAge},
+			CleanupPolicy:      wal.CleanupPolicyDelete,
+			TombstoneRetention: tombstoneRetention,
+			MaxDeliveries:      maxDeliveries,
+			Durability:         wal.DurabilityPolicy{Mode: durability, Interval: syncInterval, Messages: syncMessages},
+		},
+	})
 	if err != nil {
 		log.Fatalf("Error creating WAL: %v\n", err)
 	}
+	defer w.Close()
 
 	// Initialize offset store
 	offsetStore := storage.NewOffsetStore(offsetsFile)
-	if err := offsetStore.Load(); err != nil {
+	if err := offsetStore.Load(protocol.DefaultGroup); err != nil {
 		log.Printf("Error loading offsets: %v\n", err)
 	}
 
-	// Create broker
-	b := broker.NewBroker(w, offsetStore)
+	// Load the stored topic settings. Starting without them would apply
+	// the default retention to every topic.
+	topicStore := storage.NewTopicStore(topicsFile)
+	if err := topicStore.Load(); err != nil {
+		log.Fatalf("Error loading topic settings: %v\n", err)
+	}
+
+	// Create broker, which applies the stored topic settings to the WAL
+	b := broker.NewBroker(w, offsetStore, broker.Options{
+		DisableAutoCreate: !autoCreateTopics,
+		Topics:            topicStore,
+		WriteTimeout:      writeTimeout,
+	})
+
+	// Delete old segments in the background
+	stopCleaner := w.StartCleaner(retentionCheckInterval)
+	defer stopCleaner()
+
+	// Compact topics with the compact cleanup policy in the background
+	stopCompactor := w.StartCompactor(compactionInterval)
+	defer stopCompactor()
 
 	// Start server
 	//nolint:gosec // G102: Intentionally bind to all interfaces for message broker accessibility
@@ -2,17 +2,29 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/tiagomorais/simple-message-broker/internal/broker"
 	"github.com/tiagomorais/simple-message-broker/internal/protocol"
 	"github.com/tiagomorais/simple-message-broker/internal/storage"
+	"github.com/tiagomorais/simple-message-broker/internal/wal"
+	"github.com/tiagomorais/simple-message-broker/pkg/client"
 )
 
 func TestOffsetStore(t *testing.T) {
@@ -21,8 +33,9 @@ func TestOffsetStore(t *testing.T) {
 
 	// Create store and set values
 	store := storage.NewOffsetStore(testFile)
-	store.Set("topic1", 10)
-	store.Set("topic2", 25)
+	store.Set("billing", "topic1", 0, 10)
+	store.Set("billing", "topic2", 1, 25)
+	store.Set("analytics", "topic1", 0, 3)
 
 	// Save to disk
 	if err := store.Save(); err != nil {
@@ -31,31 +44,2532 @@ func TestOffsetStore(t *testing.T) {
 
 	// Create new store and load
 	store2 := storage.NewOffsetStore(testFile)
+	if err := store2.Load(protocol.DefaultGroup); err != nil {
+		t.Fatalf("Error loading offsets: %v", err)
+	}
+
+	// Compare
+	expected := map[string]int64{"billing/topic1": 10, "billing/topic2": 25, "analytics/topic1": 3}
+	actual := map[string]int64{
+		"billing/topic1":   store2.Get("billing", "topic1", 0),
+		"billing/topic2":   store2.Get("billing", "topic2", 1),
+		"analytics/topic1": store2.Get("analytics", "topic1", 0),
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Loaded offsets do not match. Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestOffsetStoreLegacyFile(t *testing.T) {
+	testFile := filepath.Join(t.TempDir(), "offsets.json")
+	if err := os.WriteFile(testFile, []byte(`{"topic1": 7, "topic2": 0}`), 0644); err != nil {
+		t.Fatalf("Error writing legacy offsets: %v", err)
+	}
+
+	store := storage.NewOffsetStore(testFile)
+	if err := store.Load(protocol.DefaultGroup); err != nil {
+		t.Fatalf("Error loading legacy offsets: %v", err)
+	}
+
+	if got := store.Get(protocol.DefaultGroup, "topic1", 0); got != 7 {
+		t.Errorf("Expected legacy offset 7 in the default group, got %d", got)
+	}
+}
+
+func TestUpgradeFromLegacyFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "wal"), os.ModePerm); err != nil {
+		t.Fatalf("Error creating WAL directory: %v", err)
+	}
+
+	// A baseline broker's files: orders consumed up to offset 3 of 5, and
+	// an offset on audit past the end of its log
+	var legacy []byte
+	for i := 0; i < 5; i++ {
+		legacy = append(legacy, fmt.Sprintf(`{"topic":"orders","message":"m%d","id":%d}`+"\n", i, i)...)
+	}
+	files := map[string]string{
+		"wal/orders.log": string(legacy),
+		"wal/audit.log":  `{"topic":"audit","message":"a0","id":0}` + "\n",
+		"offsets.json":   `{"orders": 3, "audit": 32}`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+
+	tb := startTestBrokerIn(t, dir, broker.Options{})
+	conn := tb.dial(t)
+
+	// The default group resumes where the baseline broker left off
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "orders"})
+	for _, content := range []string{"m3", "m4"} {
+		msg := expectMessage(t, conn, content)
+		writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "orders", Offset: int64(msg.ID)})
+	}
+
+	// and an offset past the end of the log doesn't skip new messages
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "audit"})
+	awaitHandled(t, conn)
+	if got := tb.offsets.Get(protocol.DefaultGroup, "audit", 0); got != 1 {
+		t.Errorf("Expected the audit offset to be moved back to 1, got %d", got)
+	}
+	publisher := tb.dial(t)
+	writeFrame(t, publisher, protocol.MessageTypePublish, protocol.Message{Topic: "audit", Message: "a1"})
+	msg := expectMessage(t, conn, "a1")
+	if msg.ID != 1 {
+		t.Errorf("Expected a1 at offset 1, got %d", msg.ID)
+	}
+}
+
+func TestOffsetIncrement(t *testing.T) {
+	store := storage.NewOffsetStore("")
+
+	store.Set("group", "test", 0, 5)
+	newOffset := store.Increment("group", "test", 0)
+
+	if newOffset != 6 {
+		t.Errorf("Expected offset 6, got %d", newOffset)
+	}
+	if other := store.Get("other", "test", 0); other != 0 {
+		t.Errorf("Expected other group to be unaffected, got offset %d", other)
+	}
+}
+
+func TestTopicStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "topics.json")
+
+	store := storage.NewTopicStore(path)
+	orders := storage.TopicMetadata{
+		TopicConfig: protocol.TopicConfig{Partitions: 3, RetentionMs: 60000, CleanupPolicy: "delete", MaxMessageBytes: 1024, Durability: "interval", SyncIntervalMs: 200},
+		ACLs:        []protocol.ACLBinding{{Principal: "billing", Operation: "subscribe", Permission: "allow"}},
+	}
+	if err := store.Put("orders", orders); err != nil {
+		t.Fatalf("Error storing topic: %v", err)
+	}
+	if err := store.Put("audit", storage.TopicMetadata{TopicConfig: protocol.TopicConfig{Partitions: 1}}); err != nil {
+		t.Fatalf("Error storing topic: %v", err)
+	}
+	if err := store.Delete("audit"); err != nil {
+		t.Fatalf("Error deleting topic: %v", err)
+	}
+
+	// Settings are reloaded by a new store, and no temporary file is left
+	store2 := storage.NewTopicStore(path)
 	if err := store2.Load(); err != nil {
+		t.Fatalf("Error loading topics: %v", err)
+	}
+	if got := store2.All(); !reflect.DeepEqual(got, map[string]storage.TopicMetadata{"orders": orders}) {
+		t.Errorf("Expected only orders with %+v, got %+v", orders, got)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error listing directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the topics file, got %v", entries)
+	}
+
+	// A failed write leaves the store as it was
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Error removing topics file: %v", err)
+	}
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatalf("Error blocking temporary file: %v", err)
+	}
+	if err := store2.Put("audit", storage.TopicMetadata{TopicConfig: protocol.TopicConfig{Partitions: 1}}); err == nil {
+		t.Fatalf("Expected an error storing a topic")
+	}
+	if _, ok := store2.Get("audit"); ok {
+		t.Errorf("Expected the failed change to be discarded")
+	}
+	if got, _ := store2.Get("orders"); !reflect.DeepEqual(got, orders) {
+		t.Errorf("Expected orders to be kept, got %+v", got)
+	}
+
+	// A missing file is an empty store, a corrupt one an error
+	if err := storage.NewTopicStore(filepath.Join(dir, "missing.json")).Load(); err != nil {
+		t.Errorf("Expected no error for a missing file, got %v", err)
+	}
+	if err := os.WriteFile(path, []byte(`{"orders": `), 0644); err != nil {
+		t.Fatalf("Error writing topics file: %v", err)
+	}
+	if err := storage.NewTopicStore(path).Load(); err == nil {
+		t.Errorf("Expected an error loading a corrupt file")
+	}
+}
+
+func TestWALSegments(t *testing.T) {
+	dir := t.TempDir()
+	opts := wal.Options{SegmentBytes: 1024, IndexIntervalBytes: 128}
+
+	w, err := wal.NewWAL(dir, opts)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+
+	const count = 200
+	for i := 0; i < count; i++ {
+		id, err := w.Append(protocol.Message{Topic: "segmented", Message: fmt.Sprintf("message %d", i)})
+		if err != nil {
+			t.Fatalf("Error appending message %d: %v", i, err)
+		}
+		if id != uint32(i) {
+			t.Fatalf("Expected ID %d, got %d", i, id)
+		}
+	}
+
+	segments, err := filepath.Glob(filepath.Join(dir, "segmented", "0", "*.log"))
+	if err != nil {
+		t.Fatalf("Error listing segments: %v", err)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("Expected the log to roll into several segments, got %d", len(segments))
+	}
+
+	// Reopen to make sure offsets are recovered from the segment indexes
+	w, err = wal.NewWAL(dir, opts)
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+
+	for _, offset := range []int64{0, 1, 57, 128, count - 1} {
+		msg, err := w.ReadAt("segmented", 0, offset)
+		if err != nil {
+			t.Fatalf("Error reading offset %d: %v", offset, err)
+		}
+		expected := fmt.Sprintf("message %d", offset)
+		if msg == nil || msg.Message != expected || int64(msg.ID) != offset {
+			t.Errorf("Offset %d: expected %q, got %+v", offset, expected, msg)
+		}
+	}
+
+	if msg, err := w.ReadAt("segmented", 0, count); err != nil || msg != nil {
+		t.Errorf("Expected no message past the end of the log, got %+v (err %v)", msg, err)
+	}
+
+	id, err := w.Append(protocol.Message{Topic: "segmented", Message: "after reopen"})
+	if err != nil {
+		t.Fatalf("Error appending after reopen: %v", err)
+	}
+	if id != count {
+		t.Errorf("Expected ID %d after reopen, got %d", count, id)
+	}
+}
+
+func TestWALAppendBatch(t *testing.T) {
+	dir := t.TempDir()
+	opts := wal.Options{SegmentBytes: 1024, IndexIntervalBytes: 128}
+	w, err := wal.NewWAL(dir, opts)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+	if err := w.CreateTopic("orders", wal.TopicConfig{Partitions: 2}); err != nil {
+		t.Fatalf("Error creating topic: %v", err)
+	}
+
+	// Batches spanning topics and partitions get consecutive offsets in
+	// each partition, in the order of the batch
+	var batch []protocol.Message
+	for i := 0; i < 40; i++ {
+		batch = append(batch, protocol.Message{Topic: "orders", Partition: i % 2, Message: fmt.Sprintf("order %d", i)})
+	}
+	batch = append(batch, protocol.Message{Topic: "audit", Message: "audit 0"})
+	offsets, err := w.AppendBatch(batch)
+	if err != nil {
+		t.Fatalf("Error appending batch: %v", err)
+	}
+	for i, offset := range offsets[:40] {
+		if offset != int64(i/2) {
+			t.Fatalf("Message %d: expected offset %d, got %d", i, i/2, offset)
+		}
+	}
+	if offsets[40] != 0 {
+		t.Errorf("Expected offset 0 in the new topic, got %d", offsets[40])
+	}
+
+	// A batch that fails to write leaves no message behind, even in the
+	// partitions written before the failure. The first batch filled the
+	// active segment of partition 1, so the next append to it starts a new
+	// segment, which can't be created once the directory is removed.
+	if err := os.RemoveAll(filepath.Join(dir, "orders", "1")); err != nil {
+		t.Fatalf("Error removing partition: %v", err)
+	}
+	_, err = w.AppendBatch([]protocol.Message{
+		{Topic: "audit", Message: "audit 1"},
+		{Topic: "orders", Partition: 0, Message: "lost"},
+		{Topic: "orders", Partition: 1, Message: "lost"},
+	})
+	if err == nil {
+		t.Fatalf("Expected an error writing to a removed partition")
+	}
+	if next := w.NextOffset("audit", 0); next != 1 {
+		t.Errorf("Expected the failed batch to be undone in audit, next offset is %d", next)
+	}
+	if next := w.NextOffset("orders", 0); next != 20 {
+		t.Errorf("Expected the failed batch to be undone in orders, next offset is %d", next)
+	}
+
+	// The batch is read back after reopening, through the segment indexes
+	w, err = wal.NewWAL(dir, opts)
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	for _, offset := range []int64{0, 7, 19} {
+		msg, err := w.ReadAt("orders", 0, offset)
+		if err != nil {
+			t.Fatalf("Error reading offset %d: %v", offset, err)
+		}
+		expected := fmt.Sprintf("order %d", offset*2)
+		if msg == nil || msg.Message != expected {
+			t.Errorf("Offset %d: expected %q, got %+v", offset, expected, msg)
+		}
+	}
+	if msg, err := w.ReadAt("orders", 0, 20); err != nil || msg != nil {
+		t.Errorf("Expected no message past the end of the log, got %+v (err %v)", msg, err)
+	}
+}
+
+func TestWALDurability(t *testing.T) {
+	// Slow syncs let concurrent appends pile up behind the running one
+	w, err := wal.NewWAL(t.TempDir(), wal.Options{SyncFile: func(f *os.File) error {
+		time.Sleep(5 * time.Millisecond)
+		return f.Sync()
+	}})
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+	w.SetTopicConfig("always", wal.TopicConfig{Durability: wal.DurabilityPolicy{Mode: wal.DurabilityAlways}})
+	w.SetTopicConfig("os", wal.TopicConfig{Durability: wal.DurabilityPolicy{Mode: wal.DurabilityOS}})
+	w.SetTopicConfig("messages", wal.TopicConfig{Durability: wal.DurabilityPolicy{Mode: wal.DurabilityMessages, Messages: 10}})
+	w.SetTopicConfig("interval", wal.TopicConfig{Durability: wal.DurabilityPolicy{Mode: wal.DurabilityInterval, Interval: 20 * time.Millisecond}})
+
+	// Concurrent appends in always mode share syncs, and each returns once
+	// its own message is synced
+	const count = 50
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := w.Append(protocol.Message{Topic: "always", Message: "m"}); err != nil {
+				t.Errorf("Error appending: %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	syncs := w.Syncs()
+	if syncs < 1 || syncs >= count {
+		t.Fatalf("Expected fewer than %d syncs for %d concurrent appends, got %d", count, count, syncs)
+	}
+
+	// The operating system is left to write the log
+	for i := 0; i < count; i++ {
+		if _, err := w.Append(protocol.Message{Topic: "os", Message: "m"}); err != nil {
+			t.Fatalf("Error appending: %v", err)
+		}
+	}
+	if got := w.Syncs(); got != syncs {
+		t.Errorf("Expected no syncs in os mode, got %d", got-syncs)
+	}
+
+	// Every 10 messages trigger a background sync
+	for i := 0; i < 9; i++ {
+		if _, err := w.Append(protocol.Message{Topic: "messages", Message: "m"}); err != nil {
+			t.Fatalf("Error appending: %v", err)
+		}
+	}
+	if got := w.Syncs(); got != syncs {
+		t.Errorf("Expected no sync before 10 messages, got %d", got-syncs)
+	}
+	if _, err := w.Append(protocol.Message{Topic: "messages", Message: "m"}); err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	waitForSyncs(t, w, syncs+1)
+	syncs = w.Syncs()
+
+	// Written partitions are synced once the interval has passed
+	if _, err := w.Append(protocol.Message{Topic: "interval", Message: "m"}); err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	waitForSyncs(t, w, syncs+1)
+}
+
+func TestWALSyncVisibility(t *testing.T) {
+	type syncCall struct {
+		name   string
+		result chan error
+	}
+	syncs := make(chan syncCall)
+	w, err := wal.NewWAL(t.TempDir(), wal.Options{SyncFile: func(f *os.File) error {
+		call := syncCall{name: f.Name(), result: make(chan error)}
+		syncs <- call
+		if err := <-call.result; err != nil {
+			return err
+		}
+		return f.Sync()
+	}})
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+	defer w.Close()
+
+	done := make(chan error, 1)
+	appendAsync := func(msgs ...protocol.Message) {
+		go func() {
+			_, err := w.AppendBatch(msgs)
+			done <- err
+		}()
+	}
+
+	// An append is not visible to readers until its sync completes
+	appendAsync(protocol.Message{Topic: "orders", Message: "m0"})
+	call := <-syncs
+	if next := w.NextOffset("orders", 0); next != 0 {
+		t.Errorf("Expected the append to be invisible during its sync, got next offset %d", next)
+	}
+	if msg, err := w.ReadAt("orders", 0, 0); err != nil || msg != nil {
+		t.Errorf("Expected no message during the sync, got %+v (err %v)", msg, err)
+	}
+	call.result <- nil
+	if err := <-done; err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	if msg, err := w.ReadAt("orders", 0, 0); err != nil || msg == nil || msg.Message != "m0" {
+		t.Fatalf("Expected m0 after the sync, got %+v (err %v)", msg, err)
+	}
+
+	// A failed sync removes the message, and its offset is reused
+	appendAsync(protocol.Message{Topic: "orders", Message: "lost"})
+	(<-syncs).result <- errors.New("disk failure")
+	if err := <-done; err == nil {
+		t.Fatalf("Expected the failed sync to be returned")
+	}
+	if next := w.NextOffset("orders", 0); next != 1 {
+		t.Errorf("Expected the failed append to be removed, got next offset %d", next)
+	}
+	appendAsync(protocol.Message{Topic: "orders", Message: "m1"})
+	(<-syncs).result <- nil
+	if err := <-done; err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	if msg, err := w.ReadAt("orders", 0, 1); err != nil || msg == nil || msg.Message != "m1" {
+		t.Fatalf("Expected m1 at offset 1, got %+v (err %v)", msg, err)
+	}
+
+	// A batch stored in some partitions but not others is reported as
+	// partially stored, so it isn't appended again
+	appendAsync(protocol.Message{Topic: "orders", Message: "m2"}, protocol.Message{Topic: "audit", Message: "a0"})
+	for i := 0; i < 2; i++ {
+		call := <-syncs
+		if strings.Contains(call.name, "audit") {
+			call.result <- errors.New("disk failure")
+		} else {
+			call.result <- nil
+		}
+	}
+	if err := <-done; !errors.Is(err, wal.ErrPartialBatch) {
+		t.Fatalf("Expected ErrPartialBatch, got %v", err)
+	}
+	if next := w.NextOffset("orders", 0); next != 3 {
+		t.Errorf("Expected m2 to be stored, got next offset %d", next)
+	}
+	if next := w.NextOffset("audit", 0); next != 0 {
+		t.Errorf("Expected a0 to be removed, got next offset %d", next)
+	}
+}
+
+func TestWALConcurrentReads(t *testing.T) {
+	w, err := wal.NewWAL(t.TempDir(), wal.Options{SegmentBytes: 1024, IndexIntervalBytes: 128})
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+	w.SetTopicConfig("reads", wal.TopicConfig{
+		Retention:  wal.RetentionPolicy{MaxMessages: 200},
+		Durability: wal.DurabilityPolicy{Mode: wal.DurabilityOS},
+	})
+	if _, err := w.Append(protocol.Message{Topic: "reads", Message: "message 0"}); err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+
+	// Readers racing appends and retention see whole messages, or learn
+	// that retention deleted them
+	const count = 2000
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int64(0); ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Mostly read the newest messages, which are being appended
+				next := w.NextOffset("reads", 0)
+				offset := next - 1 - i%min(next, 300)
+				msg, err := w.ReadAt("reads", 0, offset)
+				if errors.Is(err, wal.ErrOffsetOutOfRange) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("Error reading offset %d: %v", offset, err)
+					return
+				}
+				if expected := fmt.Sprintf("message %d", offset); msg == nil || msg.Message != expected {
+					t.Errorf("Offset %d: expected %q, got %+v", offset, expected, msg)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i < count; i++ {
+		if _, err := w.Append(protocol.Message{Topic: "reads", Message: fmt.Sprintf("message %d", i)}); err != nil {
+			t.Fatalf("Error appending message %d: %v", i, err)
+		}
+		if i%100 == 0 {
+			if err := w.EnforceRetention(); err != nil {
+				t.Fatalf("Error enforcing retention: %v", err)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// waitForSyncs waits until the WAL has synced at least want times
+func waitForSyncs(t *testing.T, w *wal.WAL, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for w.Syncs() < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d syncs, got %d", want, w.Syncs())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	tests := []struct {
+		name     string
+		corrupt  func(data []byte) []byte
+		expected int
+	}{
+		{
+			name:     "torn header",
+			corrupt:  func(data []byte) []byte { return append(data, 0x00, 0x00, 0x01) },
+			expected: 5,
+		},
+		{
+			name: "torn payload",
+			corrupt: func(data []byte) []byte {
+				return append(data, 0x00, 0x00, 0x00, 0x40, 0xDE, 0xAD, 0xBE, 0xEF, 0x01, 0x02)
+			},
+			expected: 5,
+		},
+		{
+			name: "flipped payload byte",
+			corrupt: func(data []byte) []byte {
+				data[len(data)-2] ^= 0xFF
+				return data
+			},
+			expected: 4,
+		},
+		{
+			name: "garbage length",
+			corrupt: func(data []byte) []byte {
+				garbage := make([]byte, 32)
+				for i := range garbage {
+					garbage[i] = 0xFF
+				}
+				return append(data, garbage...)
+			},
+			expected: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := wal.NewWAL(dir, wal.Options{})
+			if err != nil {
+				t.Fatalf("Error creating WAL: %v", err)
+			}
+			for i := 0; i < 5; i++ {
+				if _, err := w.Append(protocol.Message{Topic: "recovery", Message: fmt.Sprintf("message %d", i)}); err != nil {
+					t.Fatalf("Error appending message %d: %v", i, err)
+				}
+			}
+
+			segment := filepath.Join(dir, "recovery", "0", "00000000000000000000.log")
+			data, err := os.ReadFile(segment)
+			if err != nil {
+				t.Fatalf("Error reading segment: %v", err)
+			}
+			if err := os.WriteFile(segment, tt.corrupt(data), 0644); err != nil {
+				t.Fatalf("Error corrupting segment: %v", err)
+			}
+
+			w, err = wal.NewWAL(dir, wal.Options{})
+			if err != nil {
+				t.Fatalf("Error reopening WAL: %v", err)
+			}
+
+			for i := 0; i < tt.expected; i++ {
+				msg, err := w.ReadAt("recovery", 0, int64(i))
+				if err != nil || msg == nil || msg.Message != fmt.Sprintf("message %d", i) {
+					t.Fatalf("Offset %d: expected intact message, got %+v (err %v)", i, msg, err)
+				}
+			}
+
+			id, err := w.Append(protocol.Message{Topic: "recovery", Message: "after recovery"})
+			if err != nil {
+				t.Fatalf("Error appending after recovery: %v", err)
+			}
+			if id != uint32(tt.expected) {
+				t.Errorf("Expected ID %d after recovery, got %d", tt.expected, id)
+			}
+			msg, err := w.ReadAt("recovery", 0, int64(id))
+			if err != nil || msg == nil || msg.Message != "after recovery" {
+				t.Errorf("Expected appended message after recovery, got %+v (err %v)", msg, err)
+			}
+		})
+	}
+}
+
+func TestWALLegacyLog(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	if err := os.MkdirAll(filepath.Join(dir, "orders~migrating", "0"), os.ModePerm); err != nil {
+		t.Fatalf("Error creating leftover directory: %v", err)
+	}
+
+	// The original format: one JSON message per line, the last one cut
+	// short by a crash
+	var legacy []byte
+	for i := 0; i < 5; i++ {
+		legacy = append(legacy, fmt.Sprintf(`{"topic":"orders","message":"m%d","id":%d}`+"\n", i, i)...)
+	}
+	legacy = append(legacy, `{"topic":"orders","mess`...)
+	if err := os.WriteFile(filepath.Join(dir, "orders.log"), legacy, 0644); err != nil {
+		t.Fatalf("Error writing legacy log: %v", err)
+	}
+
+	for _, restart := range []bool{false, true} {
+		w, err := wal.NewWAL(dir, wal.Options{SegmentBytes: 64})
+		if err != nil {
+			t.Fatalf("Error opening WAL: %v", err)
+		}
+		if topics := w.Topics(); !reflect.DeepEqual(topics, []string{"orders"}) {
+			t.Errorf("Restart %t: expected topic orders, got %v", restart, topics)
+		}
+		if next := w.NextOffset("orders", 0); next != 5 {
+			t.Errorf("Restart %t: expected next offset 5, got %d", restart, next)
+		}
+		for i := 0; i < 5; i++ {
+			msg, err := w.ReadAt("orders", 0, int64(i))
+			if err != nil || msg == nil || msg.Message != fmt.Sprintf("m%d", i) || msg.ID != uint32(i) {
+				t.Errorf("Restart %t: expected m%d at offset %d, got %+v (err %v)", restart, i, i, msg, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Error closing WAL: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error listing WAL directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "orders" {
+		t.Errorf("Expected only the converted topic in the WAL directory, got %v", entries)
+	}
+}
+
+func TestWALRetention(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.NewWAL(dir, wal.Options{SegmentBytes: 512})
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		if _, err := w.Append(protocol.Message{Topic: "retained", Message: fmt.Sprintf("message %d", i)}); err != nil {
+			t.Fatalf("Error appending message %d: %v", i, err)
+		}
+	}
+
+	w.SetTopicConfig("retained", wal.TopicConfig{Retention: wal.RetentionPolicy{MaxMessages: 30}})
+	if err := w.EnforceRetention(); err != nil {
+		t.Fatalf("Error enforcing retention: %v", err)
+	}
+
+	start := w.StartOffset("retained", 0)
+	if start == 0 || count-start < 30 {
+		t.Fatalf("Expected retention to keep at least 30 of %d messages, log starts at %d", count, start)
+	}
+
+	if _, err := w.ReadAt("retained", 0, start-1); !errors.Is(err, wal.ErrOffsetOutOfRange) {
+		t.Errorf("Expected ErrOffsetOutOfRange below the log start, got %v", err)
+	}
+	msg, err := w.ReadAt("retained", 0, start)
+	if err != nil || msg == nil || int64(msg.ID) != start {
+		t.Errorf("Expected message at log start %d, got %+v (err %v)", start, msg, err)
+	}
+
+	// Everything but the active segment is older than a nanosecond
+	w.SetTopicConfig("retained", wal.TopicConfig{Retention: wal.RetentionPolicy{MaxAge: time.Nanosecond}})
+	if err := w.EnforceRetention(); err != nil {
+		t.Fatalf("Error enforcing retention: %v", err)
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "retained", "0", "*.log"))
+	if err != nil {
+		t.Fatalf("Error listing segments: %v", err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("Expected only the active segment to remain, got %d segments", len(segments))
+	}
+
+	// The log start survives a restart
+	start = w.StartOffset("retained", 0)
+	w, err = wal.NewWAL(dir, wal.Options{SegmentBytes: 512})
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	if got := w.StartOffset("retained", 0); got != start {
+		t.Errorf("Expected log start %d after reopen, got %d", start, got)
+	}
+}
+
+func TestWALTimeIndex(t *testing.T) {
+	dir := t.TempDir()
+	opts := wal.Options{SegmentBytes: 1024, IndexIntervalBytes: 128}
+
+	w, err := wal.NewWAL(dir, opts)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+
+	// Note the time before each batch of messages, spread over several
+	// segments
+	const batches, batchSize = 4, 30
+	var marks []time.Time
+	for batch := 0; batch < batches; batch++ {
+		time.Sleep(2 * time.Millisecond)
+		marks = append(marks, time.Now())
+		time.Sleep(2 * time.Millisecond)
+		for i := 0; i < batchSize; i++ {
+			if _, err := w.Append(protocol.Message{Topic: "timed", Message: fmt.Sprint(batch)}); err != nil {
+				t.Fatalf("Error appending message: %v", err)
+			}
+		}
+	}
+
+	check := func() {
+		t.Helper()
+		for batch, mark := range marks {
+			offset, err := w.OffsetForTime("timed", 0, mark)
+			if err != nil {
+				t.Fatalf("Error looking up time: %v", err)
+			}
+			if offset != int64(batch*batchSize) {
+				t.Errorf("Expected batch %d to start at offset %d, got %d", batch, batch*batchSize, offset)
+			}
+		}
+		offset, err := w.OffsetForTime("timed", 0, time.Now())
+		if err != nil || offset != batches*batchSize {
+			t.Errorf("Expected offset %d for a time after every message, got %d (err %v)", batches*batchSize, offset, err)
+		}
+	}
+	check()
+
+	// The time index is read back from disk
+	w, err = wal.NewWAL(dir, opts)
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	check()
+}
+
+func TestWALCompaction(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.NewWAL(dir, wal.Options{SegmentBytes: 256, IndexIntervalBytes: 64})
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+	w.SetTopicConfig("state", wal.TopicConfig{CleanupPolicy: wal.CleanupPolicyCompact, TombstoneRetention: time.Hour})
+
+	// Ten versions of three entities, then a tombstone for one of them
+	for i := 0; i < 30; i++ {
+		msg := protocol.Message{Topic: "state", Key: fmt.Sprintf("entity-%d", i%3), Message: fmt.Sprintf("version %d", i/3)}
+		if _, err := w.Append(msg); err != nil {
+			t.Fatalf("Error appending message %d: %v", i, err)
+		}
+	}
+	if _, err := w.Append(protocol.Message{Topic: "state", Key: "entity-0"}); err != nil {
+		t.Fatalf("Error appending tombstone: %v", err)
+	}
+	// Padding so every keyed record sits in an inactive segment
+	for i := 0; i < 10; i++ {
+		if _, err := w.Append(protocol.Message{Topic: "state", Message: "padding"}); err != nil {
+			t.Fatalf("Error appending padding: %v", err)
+		}
+	}
+
+	if err := w.Compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+
+	readAll := func(w *wal.WAL) map[string]string {
+		latest := make(map[string]string)
+		for offset := int64(0); ; {
+			msg, err := w.ReadAt("state", 0, offset)
+			if err != nil {
+				t.Fatalf("Error reading offset %d: %v", offset, err)
+			}
+			if msg == nil {
+				return latest
+			}
+			if msg.Key != "" {
+				if _, seen := latest[msg.Key]; seen {
+					t.Errorf("Key %s survived compaction more than once", msg.Key)
+				}
+				latest[msg.Key] = msg.Message
+			}
+			offset = int64(msg.ID) + 1
+		}
+	}
+
+	// The tombstone is within its grace period, so it is still visible
+	expected := map[string]string{"entity-0": "", "entity-1": "version 9", "entity-2": "version 9"}
+	if latest := readAll(w); !reflect.DeepEqual(expected, latest) {
+		t.Errorf("Expected %v after compaction, got %v", expected, latest)
+	}
+
+	w.SetTopicConfig("state", wal.TopicConfig{CleanupPolicy: wal.CleanupPolicyCompact, TombstoneRetention: time.Nanosecond})
+	if err := w.Compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+
+	// Reopen to make sure the rewritten segments and indexes load
+	w, err = wal.NewWAL(dir, wal.Options{SegmentBytes: 256, IndexIntervalBytes: 64})
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	expected = map[string]string{"entity-1": "version 9", "entity-2": "version 9"}
+	if latest := readAll(w); !reflect.DeepEqual(expected, latest) {
+		t.Errorf("Expected %v after the tombstone expired, got %v", expected, latest)
+	}
+}
+
+func TestConsumerGroups(t *testing.T) {
+	tb := startTestBroker(t)
+
+	billing := tb.dial(t)
+	writeFrame(t, billing, protocol.MessageTypePublish, protocol.Message{Topic: "orders", Message: "order 1"})
+	writeFrame(t, billing, protocol.MessageTypePublish, protocol.Message{Topic: "orders", Message: "order 2"})
+	writeFrame(t, billing, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "orders", Group: "billing"})
+	expectMessage(t, billing, "order 1")
+	writeFrame(t, billing, protocol.MessageTypeAck, protocol.Ack{Topic: "orders", Offset: 0})
+	expectMessage(t, billing, "order 2")
+
+	// A second group starts from the beginning of the topic
+	analytics := tb.dial(t)
+	writeFrame(t, analytics, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "orders", Group: "analytics"})
+	expectMessage(t, analytics, "order 1")
+
+	if got := tb.offsets.Get("billing", "orders", 0); got != 1 {
+		t.Errorf("Expected billing at offset 1, got %d", got)
+	}
+	if got := tb.offsets.Get("analytics", "orders", 0); got != 0 {
+		t.Errorf("Expected analytics at offset 0, got %d", got)
+	}
+}
+
+func TestCompetingConsumers(t *testing.T) {
+	tb := startTestBroker(t)
+
+	publisher := tb.dial(t)
+	for i := 0; i < 4; i++ {
+		writeFrame(t, publisher, protocol.MessageTypePublish, protocol.Message{Topic: "jobs", Message: fmt.Sprintf("job %d", i)})
+	}
+
+	// Shared members compete for the messages of a topic with a single
+	// partition. Each holds one unacknowledged message at a time, so the
+	// first two jobs go to different members.
+	worker1 := tb.dial(t)
+	writeFrame(t, worker1, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "jobs", Group: "workers", Mode: protocol.SubscriptionModeShared})
+	expectMessage(t, worker1, "job 0")
+
+	worker2 := tb.dial(t)
+	writeFrame(t, worker2, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "jobs", Group: "workers", Mode: protocol.SubscriptionModeShared})
+	msg := expectMessage(t, worker2, "job 1")
+
+	// The group's members must all share
+	queued := tb.dial(t)
+	writeFrame(t, queued, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "jobs", Group: "workers"})
+	if e := expectError(t, queued, protocol.ErrorCodeBadRequest); !e.Fatal {
+		t.Errorf("Expected a fatal error, got %+v", e)
+	}
+
+	// worker1 goes away without acknowledging job 0, so worker2 gets it
+	worker1.Close()
+
+	received := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		writeFrame(t, worker2, protocol.MessageTypeAck, protocol.Ack{Topic: "jobs", Partition: msg.Partition, Offset: int64(msg.ID)})
+		messageType, body := readFrame(t, worker2)
+		if messageType != protocol.MessageTypeMessage {
+			t.Fatalf("Expected MESSAGE frame, got type %d: %s", messageType, body)
+		}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatalf("Error decoding message: %v", err)
+		}
+		if received[msg.Message] {
+			t.Fatalf("Received %q twice", msg.Message)
+		}
+		received[msg.Message] = true
+	}
+
+	expected := map[string]bool{"job 0": true, "job 2": true, "job 3": true}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("Expected worker2 to receive %v, got %v", expected, received)
+	}
+}
+
+func TestMoreMembersThanPartitions(t *testing.T) {
+	tb := startTestBroker(t)
+	if err := tb.wal.CreateTopic("tasks", wal.TopicConfig{Partitions: 2}); err != nil {
+		t.Fatalf("Error creating topic: %v", err)
+	}
+
+	workers := make([]*testConn, 3)
+	for i := range workers {
+		workers[i] = tb.dial(t)
+		writeFrame(t, workers[i], protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "tasks", Group: "workers", Prefetch: 100})
+		awaitHandled(t, workers[i])
+	}
+
+	publisher := tb.dial(t)
+	for i := 0; i < 5; i++ {
+		for key := 0; key < 6; key++ {
+			writeFrame(t, publisher, protocol.MessageTypePublish, protocol.Message{Topic: "tasks", Key: fmt.Sprintf("k%d", key), Message: fmt.Sprint(i)})
+		}
+	}
+	awaitHandled(t, publisher)
+
+	// Each partition goes to one of the first two members, which receive
+	// the messages of each key in order
+	owner := make(map[string]int)
+	last := make(map[string]int)
+	for i, worker := range workers[:2] {
+		for n := tb.wal.NextOffset("tasks", i); n > 0; n-- {
+			messageType, body := readFrame(t, worker)
+			if messageType != protocol.MessageTypeMessage {
+				t.Fatalf("Expected MESSAGE frame, got type %d: %s", messageType, body)
+			}
+			var msg protocol.Message
+			if err := json.Unmarshal(body, &msg); err != nil {
+				t.Fatalf("Error decoding message: %v", err)
+			}
+			if w, ok := owner[msg.Key]; ok && w != i {
+				t.Fatalf("Key %s was delivered to workers %d and %d", msg.Key, w, i)
+			}
+			owner[msg.Key] = i
+			seq, _ := strconv.Atoi(msg.Message)
+			if prev, ok := last[msg.Key]; ok && seq != prev+1 {
+				t.Fatalf("Key %s delivered out of order: %d after %d", msg.Key, seq, prev)
+			}
+			last[msg.Key] = seq
+		}
+	}
+	if len(last) != 6 {
+		t.Errorf("Expected messages of 6 keys, got %v", last)
+	}
+
+	// The extra member waits for a partition
+	awaitHandled(t, workers[2])
+	workers[0].Close()
+	if n := tb.wal.NextOffset("tasks", 0); n > 0 {
+		messageType, body := readFrame(t, workers[2])
+		if messageType != protocol.MessageTypeMessage {
+			t.Fatalf("Expected MESSAGE frame, got type %d: %s", messageType, body)
+		}
+	}
+}
+
+func TestPartitionRouting(t *testing.T) {
+	tb := startTestBroker(t)
+	if err := tb.wal.CreateTopic("events", wal.TopicConfig{Partitions: 3}); err != nil {
+		t.Fatalf("Error creating topic: %v", err)
+	}
+
+	conn := tb.dial(t)
+	const rounds, keys = 3, 4
+	for round := 0; round < rounds; round++ {
+		for key := 0; key < keys; key++ {
+			msg := protocol.Message{Topic: "events", Key: fmt.Sprintf("user-%d", key), Message: fmt.Sprint(round)}
+			writeFrame(t, conn, protocol.MessageTypePublish, msg)
+		}
+	}
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "events"})
+
+	partitionOf := make(map[string]int)
+	lastRound := make(map[string]string)
+	for i := 0; i < rounds*keys; i++ {
+		messageType, body := readFrame(t, conn)
+		if messageType != protocol.MessageTypeMessage {
+			t.Fatalf("Expected MESSAGE frame, got type %d: %s", messageType, body)
+		}
+		var msg protocol.Message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatalf("Error decoding message: %v", err)
+		}
+
+		if partition, ok := partitionOf[msg.Key]; ok && partition != msg.Partition {
+			t.Errorf("Key %s was routed to partitions %d and %d", msg.Key, partition, msg.Partition)
+		}
+		partitionOf[msg.Key] = msg.Partition
+		if msg.Message < lastRound[msg.Key] {
+			t.Errorf("Key %s delivered round %s after round %s", msg.Key, msg.Message, lastRound[msg.Key])
+		}
+		lastRound[msg.Key] = msg.Message
+
+		writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "events", Partition: msg.Partition, Offset: int64(msg.ID)})
+	}
+}
+
+func TestBroadcastSubscriptions(t *testing.T) {
+	tb := startTestBroker(t)
+
+	// Frames on one connection are handled in order, so publishing on the
+	// subscriber's own connection orders the publish around the subscription.
+	// Messages published before a broadcast subscription are not delivered.
+	listener1 := tb.dial(t)
+	writeFrame(t, listener1, protocol.MessageTypePublish, protocol.Message{Topic: "invalidations", Message: "old"})
+	writeFrame(t, listener1, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "invalidations", Mode: protocol.SubscriptionModeBroadcast})
+	writeFrame(t, listener1, protocol.MessageTypePublish, protocol.Message{Topic: "invalidations", Message: "event 1"})
+	first := expectMessage(t, listener1, "event 1")
+
+	listener2 := tb.dial(t)
+	writeFrame(t, listener2, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "invalidations", Mode: protocol.SubscriptionModeBroadcast})
+	writeFrame(t, listener2, protocol.MessageTypePublish, protocol.Message{Topic: "invalidations", Message: "event 2"})
+	expectMessage(t, listener2, "event 2")
+
+	// listener1 sees event 2 as well once it acknowledges event 1
+	writeFrame(t, listener1, protocol.MessageTypeAck, protocol.Ack{Topic: "invalidations", Offset: int64(first.ID)})
+	expectMessage(t, listener1, "event 2")
+
+	// Broadcast subscribers do not move any consumer group
+	if got := tb.offsets.Get(protocol.DefaultGroup, "invalidations", 0); got != 0 {
+		t.Errorf("Expected default group offset 0, got %d", got)
+	}
+}
+
+func TestRedelivery(t *testing.T) {
+	tb := startTestBroker(t)
+
+	conn := tb.dial(t)
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Message{Topic: "emails", Message: "welcome"})
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Message{Topic: "emails", Message: "reminder"})
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "emails", VisibilityTimeoutMs: 100})
+
+	expectDelivery := func(content string, redeliveries int) protocol.Message {
+		t.Helper()
+		msg := expectMessage(t, conn, content)
+		if msg.Redeliveries != redeliveries {
+			t.Fatalf("Expected %d redeliveries of %q, got %d", redeliveries, content, msg.Redeliveries)
+		}
+		return msg
+	}
+
+	// Without an ACK the message comes back once the visibility timeout expires
+	msg := expectDelivery("welcome", 0)
+	msg = expectDelivery("welcome", 1)
+
+	// A NACK without a delay redelivers it at once
+	writeFrame(t, conn, protocol.MessageTypeNack, protocol.Nack{Topic: "emails", Offset: int64(msg.ID)})
+	msg = expectDelivery("welcome", 2)
+
+	// A NACK with a delay holds it back while later messages are delivered
+	const delay = 300 * time.Millisecond
+	start := time.Now()
+	writeFrame(t, conn, protocol.MessageTypeNack, protocol.Nack{Topic: "emails", Offset: int64(msg.ID), DelayMs: delay.Milliseconds()})
+	msg = expectDelivery("reminder", 0)
+	writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "emails", Offset: int64(msg.ID)})
+
+	msg = expectDelivery("welcome", 3)
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("Expected redelivery after %v, got it after %v", delay, elapsed)
+	}
+	writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "emails", Offset: int64(msg.ID)})
+}
+
+func TestDeadLetterTopic(t *testing.T) {
+	tb := startTestBroker(t)
+	tb.wal.SetTopicConfig("payments", wal.TopicConfig{MaxDeliveries: 2})
+
+	conn := tb.dial(t)
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Message{Topic: "payments", Key: "order-1", Message: "poison"})
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Message{Topic: "payments", Message: "valid"})
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "payments"})
+
+	// The poison message is rejected as many times as the topic allows
+	var published int64
+	for i := 0; i < 2; i++ {
+		msg := expectMessage(t, conn, "poison")
+		published = msg.TimestampMs
+		writeFrame(t, conn, protocol.MessageTypeNack, protocol.Nack{Topic: "payments", Offset: int64(msg.ID), Reason: "cannot parse amount"})
+	}
+
+	// after which the group moves on to the next message
+	msg := expectMessage(t, conn, "valid")
+	writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "payments", Offset: int64(msg.ID)})
+
+	inspector := tb.dial(t)
+	writeFrame(t, inspector, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "payments" + wal.DeadLetterSuffix, Group: "on-call"})
+	dead := expectMessage(t, inspector, "poison")
+	expected := &protocol.DeadLetter{
+		Topic:       "payments",
+		Partition:   0,
+		Offset:      0,
+		TimestampMs: published,
+		Group:       protocol.DefaultGroup,
+		Deliveries:  2,
+		Reason:      "cannot parse amount",
+	}
+	if dead.Key != "order-1" || !reflect.DeepEqual(dead.DeadLetter, expected) {
+		t.Errorf("Expected dead letter with key order-1 and %+v, got key %s and %+v", expected, dead.Key, dead.DeadLetter)
+	}
+
+	// The poison message no longer holds the group's position back
+	awaitHandled(t, conn)
+	if got := tb.offsets.Get(protocol.DefaultGroup, "payments", 0); got != 2 {
+		t.Errorf("Expected group offset 2, got %d", got)
+	}
+}
+
+func TestBroadcastMaxDeliveries(t *testing.T) {
+	tb := startTestBroker(t)
+	tb.wal.SetTopicConfig("alerts", wal.TopicConfig{MaxDeliveries: 2})
+
+	listener := tb.dial(t)
+	writeFrame(t, listener, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "alerts", Mode: protocol.SubscriptionModeBroadcast})
+	awaitHandled(t, listener)
+
+	publisher := tb.dial(t)
+	writeFrame(t, publisher, protocol.MessageTypePublish, protocol.Message{Topic: "alerts", Message: "poison"})
+	writeFrame(t, publisher, protocol.MessageTypePublish, protocol.Message{Topic: "alerts", Message: "valid"})
+
+	// A listener that keeps rejecting a message drops it and moves on
+	for i := 0; i < 2; i++ {
+		msg := expectMessage(t, listener, "poison")
+		writeFrame(t, listener, protocol.MessageTypeNack, protocol.Nack{Topic: "alerts", Offset: int64(msg.ID)})
+	}
+	msg := expectMessage(t, listener, "valid")
+	writeFrame(t, listener, protocol.MessageTypeAck, protocol.Ack{Topic: "alerts", Offset: int64(msg.ID)})
+	awaitHandled(t, listener)
+
+	// without a copy in the shared dead-letter topic
+	if tb.wal.HasTopic("alerts" + wal.DeadLetterSuffix) {
+		t.Errorf("Expected no dead-letter topic for a broadcast subscriber, next offset is %d", tb.wal.NextOffset("alerts"+wal.DeadLetterSuffix, 0))
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	tb := startTestBroker(t)
+
+	conn := tb.dial(t)
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "logs", Prefetch: 3})
+	for i := 0; i < 5; i++ {
+		writeFrame(t, conn, protocol.MessageTypePublish, protocol.Message{Topic: "logs", Message: fmt.Sprint(i)})
+	}
+
+	// Frames are handled in order, so the acknowledgement of a later publish
+	// arrives after every message the broker was willing to send
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "barrier"}, RequestAck: true})
+	var window []protocol.Message
+	for i := 0; i < 3; i++ {
+		window = append(window, expectMessage(t, conn, fmt.Sprint(i)))
+	}
+	if messageType, body := readFrame(t, conn); messageType != protocol.MessageTypePublishAck {
+		t.Fatalf("Expected PUBLISH_ACK after a full window, got type %d: %s", messageType, body)
+	}
+
+	// Each ACK makes room for one more message
+	writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "logs", Offset: int64(window[1].ID)})
+	expectMessage(t, conn, "3")
+	writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "logs", Offset: int64(window[0].ID)})
+	expectMessage(t, conn, "4")
+}
+
+func TestStalledConsumer(t *testing.T) {
+	tb := startTestBrokerWithOptions(t, broker.Options{WriteTimeout: 500 * time.Millisecond})
+
+	// A member that stops reading doesn't hold up publishes to its topic
+	stalled := tb.dial(t)
+	writeFrame(t, stalled, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "bulk", Group: "workers", Prefetch: 1000})
+	awaitHandled(t, stalled)
+
+	publisher := tb.dial(t)
+	content := strings.Repeat("x", 256<<10)
+	for i := 0; i < 100; i++ {
+		writeFrame(t, publisher, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "bulk", Message: content}, RequestAck: true})
+		if messageType, body := readFrame(t, publisher); messageType != protocol.MessageTypePublishAck {
+			t.Fatalf("Expected PUBLISH_ACK frame, got type %d: %s", messageType, body)
+		}
+	}
+
+	// Its connection is closed once writing to it times out, and its
+	// messages go to the rest of the group
+	worker := tb.dial(t)
+	writeFrame(t, worker, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "bulk", Group: "workers"})
+	if msg := expectMessage(t, worker, content); msg.ID != 0 {
+		t.Errorf("Expected offset 0, got %d", msg.ID)
+	}
+}
+
+func TestAckValidation(t *testing.T) {
+	tb := startTestBroker(t)
+
+	conn := tb.dial(t)
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "metrics", Prefetch: 5})
+	for i := 0; i < 6; i++ {
+		writeFrame(t, conn, protocol.MessageTypePublish, protocol.Message{Topic: "metrics", Message: fmt.Sprint(i)})
+	}
+	for i := 0; i < 5; i++ {
+		expectMessage(t, conn, fmt.Sprint(i))
+	}
+
+	expectError := func(ack protocol.Ack) {
+		t.Helper()
+		writeFrame(t, conn, protocol.MessageTypeAck, ack)
+		if messageType, body := readFrame(t, conn); messageType != protocol.MessageTypeError {
+			t.Fatalf("Expected error frame for %+v, got type %d: %s", ack, messageType, body)
+		}
+	}
+
+	// Selective acknowledgement of offsets 1, 2 and 4
+	writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "metrics", Ranges: []protocol.AckRange{{From: 1, To: 2}, {From: 4, To: 4}}})
+	expectMessage(t, conn, "5")
+
+	// Duplicated and undelivered offsets are rejected
+	expectError(protocol.Ack{Topic: "metrics", Offset: 2})
+	expectError(protocol.Ack{Topic: "metrics", Offset: 6})
+	expectError(protocol.Ack{Topic: "metrics", Offset: 1, Cumulative: true, Partition: 3})
+
+	// A cumulative acknowledgement covers the remaining offsets
+	writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "metrics", Offset: 5, Cumulative: true})
+	awaitHandled(t, conn)
+	if got := tb.offsets.Get(protocol.DefaultGroup, "metrics", 0); got != 6 {
+		t.Errorf("Expected group offset 6, got %d", got)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	tb := startTestBroker(t)
+
+	conn := tb.dial(t)
+	publish := func(content string) {
+		writeFrame(t, conn, protocol.MessageTypePublish, protocol.Message{Topic: "deploys", Message: content})
+	}
+	consume := func(content string) {
+		t.Helper()
+		msg := expectMessage(t, conn, content)
+		writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "deploys", Offset: int64(msg.ID)})
+	}
+
+	publish("v1")
+	publish("v2")
+	time.Sleep(5 * time.Millisecond)
+	deployed := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	publish("v3")
+
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "deploys"})
+	consume("v1")
+	consume("v2")
+	consume("v3")
+
+	seek := func(s protocol.Seek) {
+		s.Topic = "deploys"
+		writeFrame(t, conn, protocol.MessageTypeSeek, s)
+	}
+
+	// Messages are left unacknowledged, so that nothing else is delivered
+	// before the next seek drops them
+	seek(protocol.Seek{Position: protocol.SeekEarliest})
+	expectMessage(t, conn, "v1")
+	seek(protocol.Seek{Position: protocol.SeekTimestamp, TimestampMs: deployed.UnixMilli() + 1})
+	expectMessage(t, conn, "v3")
+	seek(protocol.Seek{Position: protocol.SeekOffset, Offset: 1})
+	consume("v2")
+	consume("v3")
+
+	// Offsets outside the log are rejected
+	seek(protocol.Seek{Position: protocol.SeekOffset, Offset: 10})
+	if messageType, body := readFrame(t, conn); messageType != protocol.MessageTypeError {
+		t.Fatalf("Expected error frame, got type %d: %s", messageType, body)
+	}
+
+	// Groups without members are moved too
+	other := tb.dial(t)
+	writeFrame(t, other, protocol.MessageTypeSeek, protocol.Seek{Topic: "deploys", Group: "audit", Position: protocol.SeekLatest})
+	awaitHandled(t, other)
+	publish("v4")
+	consume("v4")
+	writeFrame(t, other, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "deploys", Group: "audit"})
+	expectMessage(t, other, "v4")
+}
+
+func TestMessageMetadata(t *testing.T) {
+	tb := startTestBroker(t)
+
+	sent := protocol.Message{
+		Topic:               "telemetry",
+		Key:                 "device-7",
+		Headers:             map[string]string{"trace-id": "abc123", "schema": "v2"},
+		ContentType:         "application/x-protobuf",
+		Payload:             []byte{0x08, 0x96, 0x01, 0x00, 0xff, 0xfe},
+		ProducerTimestampMs: 1700000000000,
+	}
+	before := time.Now().UnixMilli()
+
+	conn := tb.dial(t)
+	writeFrame(t, conn, protocol.MessageTypePublish, sent)
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "telemetry"})
+	received := expectMessage(t, conn, "")
+
+	if received.TimestampMs < before || received.TimestampMs > time.Now().UnixMilli() {
+		t.Errorf("Expected an append timestamp after %d, got %d", before, received.TimestampMs)
+	}
+	if received.IsTombstone() {
+		t.Errorf("Expected a keyed message with only a binary payload not to be a tombstone")
+	}
+	received.TimestampMs = 0
+	if !reflect.DeepEqual(received, sent) {
+		t.Errorf("Expected %+v, got %+v", sent, received)
+	}
+}
+
+func TestPublishAck(t *testing.T) {
+	tb := startTestBroker(t)
+	if err := tb.wal.CreateTopic("orders", wal.TopicConfig{Partitions: 2}); err != nil {
+		t.Fatalf("Error creating topic: %v", err)
+	}
+
+	conn := tb.dial(t)
+	publish := func(content string, requestAck bool) {
+		pub := protocol.Publish{Message: protocol.Message{Topic: "orders", Message: content}, RequestAck: requestAck}
+		writeFrame(t, conn, protocol.MessageTypePublish, pub)
+	}
+	expectAck := func() protocol.PublishAck {
+		t.Helper()
+		messageType, body := readFrame(t, conn)
+		if messageType != protocol.MessageTypePublishAck {
+			t.Fatalf("Expected PUBLISH_ACK frame, got type %d: %s", messageType, body)
+		}
+		var ack protocol.PublishAck
+		if err := json.Unmarshal(body, &ack); err != nil {
+			t.Fatalf("Error decoding publish ack: %v", err)
+		}
+		return ack
+	}
+
+	// Messages without a key alternate between the partitions, and only
+	// publishes that ask for it are acknowledged
+	publish("first", true)
+	publish("second", false)
+	publish("third", true)
+	expected := []protocol.PublishAck{
+		{Topic: "orders", Partition: 0, Offset: 0},
+		{Topic: "orders", Partition: 0, Offset: 1},
+	}
+	for _, want := range expected {
+		if got := expectAck(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	}
+
+	// Closing the WAL makes the next write fail
+	tb.wal.Close()
+	publish("lost", true)
+	ack := expectAck()
+	if ack.Error == nil || ack.Error.Code != protocol.ErrorCodeStorage {
+		t.Errorf("Expected a %s error, got %+v", protocol.ErrorCodeStorage, ack)
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	tb := startTestBroker(t)
+	if err := tb.wal.CreateTopic("orders", wal.TopicConfig{Partitions: 2}); err != nil {
+		t.Fatalf("Error creating topic: %v", err)
+	}
+
+	conn := tb.dial(t)
+	hello(t, conn, protocol.CodecBinary)
+	expectAck := func() protocol.PublishBatchAck {
+		t.Helper()
+		messageType, body := readFrame(t, conn)
+		if messageType != protocol.MessageTypePublishBatchAck {
+			t.Fatalf("Expected PUBLISH_BATCH_ACK frame, got type %d: %s", messageType, body)
+		}
+		var ack protocol.PublishBatchAck
+		if err := conn.codec.Unmarshal(body, &ack); err != nil {
+			t.Fatalf("Error decoding publish batch ack: %v", err)
+		}
+		return ack
+	}
+
+	// Messages without a key stay together in one partition of their topic,
+	// and the ack returns the range of offsets in each partition
+	key := "customer-1"
+	keyed := protocol.PartitionForKey(key, 2)
+	writeFrame(t, conn, protocol.MessageTypePublishBatch, protocol.PublishBatch{
+		Messages: []protocol.Message{
+			{Topic: "orders", Message: "first"},
+			{Topic: "audit", Message: "audit"},
+			{Topic: "orders", Message: "second"},
+			{Topic: "orders", Key: key, Message: "keyed"},
+		},
+		RequestAck: true,
+	})
+	ack := expectAck()
+	if ack.Error != nil || len(ack.Partitions) != 4 {
+		t.Fatalf("Unexpected ack %+v", ack)
+	}
+	orders := ack.Partitions[0]
+	if ack.Partitions[2] != orders || ack.Partitions[3] != keyed {
+		t.Errorf("Expected partitions [%d 0 %d %d], got %v", orders, orders, keyed, ack.Partitions)
+	}
+	expected := []protocol.OffsetRange{
+		{Topic: "orders", Partition: orders, FirstOffset: 0, LastOffset: 1},
+		{Topic: "audit", Partition: 0, FirstOffset: 0, LastOffset: 0},
+	}
+	if keyed == orders {
+		expected[0].LastOffset = 2
+	} else {
+		expected = append(expected, protocol.OffsetRange{Topic: "orders", Partition: keyed, FirstOffset: 0, LastOffset: 0})
+	}
+	if !reflect.DeepEqual(ack.Ranges, expected) {
+		t.Errorf("Expected ranges %+v, got %+v", expected, ack.Ranges)
+	}
+
+	// Subscribers receive the messages of a batch like any other
+	sub := tb.dial(t)
+	writeFrame(t, sub, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "audit"})
+	expectMessage(t, sub, "audit")
+
+	// Empty batches are rejected
+	writeFrame(t, conn, protocol.MessageTypePublishBatch, protocol.PublishBatch{RequestAck: true})
+	expectError(t, conn, protocol.ErrorCodeBadRequest)
+
+	// A batch that can't be stored fails as a whole
+	tb.wal.Close()
+	writeFrame(t, conn, protocol.MessageTypePublishBatch, protocol.PublishBatch{
+		Messages: []protocol.Message{{Topic: "audit", Message: "lost"}, {Topic: "orders", Message: "lost"}},
+	})
+	if e := expectError(t, conn, protocol.ErrorCodeStorage); !e.Retryable {
+		t.Errorf("Expected a retryable error, got %+v", e)
+	}
+	if next := tb.wal.NextOffset("audit", 0); next != 1 {
+		t.Errorf("Expected nothing stored in audit, next offset is %d", next)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	bodies := []any{
+		&protocol.Message{
+			Topic:               "orders",
+			Partition:           3,
+			Key:                 "customer-1",
+			Headers:             map[string]string{"trace": "abc", "empty": ""},
+			ContentType:         "application/octet-stream",
+			Message:             "text",
+			Payload:             []byte{0, 1, 2, 255},
+			ID:                  42,
+			TimestampMs:         1700000000000,
+			ProducerTimestampMs: -1,
+			Redeliveries:        2,
+			DeadLetter:          &protocol.DeadLetter{Topic: "orders", Partition: 1, Offset: 7, Group: "billing", Deliveries: 10, Reason: "boom"},
+		},
+		&protocol.Publish{Message: protocol.Message{Topic: "orders", Message: "hi"}, RequestAck: true},
+		&protocol.PublishAck{Topic: "orders", Partition: 1, Offset: 9, Error: &protocol.Error{Code: protocol.ErrorCodeStorage, Message: "disk full"}},
+		&protocol.Subscription{Topic: "orders", Group: "billing", Mode: protocol.SubscriptionModeQueue, VisibilityTimeoutMs: 500, Prefetch: 8},
+		&protocol.Ack{Topic: "orders", Partition: 2, Offset: 5, Cumulative: true, Ranges: []protocol.AckRange{{From: 0, To: 3}, {From: 5, To: 5}}},
+		&protocol.Nack{Topic: "orders", Partition: 2, Offset: 5, DelayMs: 1000, Reason: "retry"},
+		&protocol.Seek{Topic: "orders", Group: "billing", Partitions: []int{0, 2}, Position: protocol.SeekTimestamp, TimestampMs: 1700000000000},
+		&protocol.Hello{Version: protocol.Version, Codecs: []string{protocol.CodecBinary, protocol.CodecJSON}},
+		&protocol.PublishBatch{Messages: []protocol.Message{{Topic: "orders", Message: "a"}, {Topic: "audit", Key: "k"}}, RequestAck: true},
+		&protocol.PublishBatchAck{Ranges: []protocol.OffsetRange{{Topic: "orders", Partition: 1, FirstOffset: 4, LastOffset: 9}}, Partitions: []int{1, 0, 1}},
+		&protocol.CreateTopic{Topic: "orders", Config: protocol.TopicConfig{Partitions: 3, RetentionMs: -1, RetentionBytes: 1 << 30, CleanupPolicy: "compact", TombstoneRetentionMs: 60000, MaxMessageBytes: 512, Durability: "interval", SyncIntervalMs: 200, SyncMessages: 100, MaxDeliveries: 5, DeadLetterTopic: "orders.failed"},
+			ACLs: []protocol.ACLBinding{{Principal: "billing", Operation: protocol.ACLOperationSubscribe, Permission: protocol.ACLPermissionAllow}}},
+		&protocol.DeleteTopic{Topic: "orders"},
+		&protocol.DescribeTopic{Topic: "orders"},
+		&protocol.TopicList{Topics: []protocol.TopicInfo{{
+			Topic:       "orders",
+			Config:      protocol.TopicConfig{Partitions: 2, RetentionMessages: 100, CleanupPolicy: "delete"},
+			SizeBytes:   4096,
+			Partitions:  []protocol.PartitionInfo{{Partition: 0, StartOffset: 0, NextOffset: 3, SizeBytes: 1024}, {Partition: 1, StartOffset: 5, NextOffset: 9, SizeBytes: 3072}},
+			Subscribers: []protocol.SubscriberInfo{{Mode: "broadcast", Members: 1, Offsets: []int64{3, 9}}, {Group: "billing", Mode: "queue", Members: 2, Offsets: []int64{0, 7}}},
+			ACLs:        []protocol.ACLBinding{{Principal: "audit", Operation: protocol.ACLOperationPublish, Permission: protocol.ACLPermissionDeny}},
+		}}},
+		&protocol.Message{},
+	}
+
+	for _, codec := range []protocol.Codec{protocol.JSON, protocol.Binary} {
+		for _, body := range bodies {
+			data, err := codec.Marshal(body)
+			if err != nil {
+				t.Fatalf("%s: error encoding %T: %v", codec.Name(), body, err)
+			}
+			decoded := reflect.New(reflect.TypeOf(body).Elem()).Interface()
+			if err := codec.Unmarshal(data, decoded); err != nil {
+				t.Fatalf("%s: error decoding %T: %v", codec.Name(), body, err)
+			}
+			if !reflect.DeepEqual(decoded, body) {
+				t.Errorf("%s: expected %+v, got %+v", codec.Name(), body, decoded)
+			}
+		}
+	}
+
+	// Truncated bodies are rejected rather than decoded partially
+	data, err := protocol.Binary.Marshal(bodies[0])
+	if err != nil {
+		t.Fatalf("Error encoding message: %v", err)
+	}
+	var msg protocol.Message
+	if err := protocol.Binary.Unmarshal(data[:len(data)-1], &msg); !errors.Is(err, protocol.ErrInvalidBinary) {
+		t.Errorf("Expected ErrInvalidBinary for a truncated body, got %v", err)
+	}
+}
+
+func TestHello(t *testing.T) {
+	tb := startTestBroker(t)
+
+	// Frame bodies use the first codec both sides support
+	consumer := tb.dial(t)
+	hello(t, consumer, "msgpack", protocol.CodecBinary, protocol.CodecJSON)
+	if consumer.codec != protocol.Binary {
+		t.Fatalf("Expected the binary codec, got %s", consumer.codec.Name())
+	}
+	writeFrame(t, consumer, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "orders"})
+
+	// A connection that skips HELLO keeps using JSON
+	producer := tb.dial(t)
+	sent := protocol.Message{
+		Topic:   "orders",
+		Headers: map[string]string{"trace": "abc"},
+		Message: "binary",
+		Payload: []byte{0, 255},
+	}
+	writeFrame(t, producer, protocol.MessageTypePublish, protocol.Publish{Message: sent})
+
+	received := expectMessage(t, consumer, "binary")
+	if !reflect.DeepEqual(received.Headers, sent.Headers) || !reflect.DeepEqual(received.Payload, sent.Payload) {
+		t.Errorf("Expected %+v, got %+v", sent, received)
+	}
+	writeFrame(t, consumer, protocol.MessageTypeAck, protocol.Ack{Topic: "orders", Offset: int64(received.ID)})
+
+	// HELLO is only accepted as the first frame
+	late := tb.dial(t)
+	writeFrame(t, late, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "payments"})
+	writeFrame(t, late, protocol.MessageTypeHello, protocol.Hello{Version: protocol.Version, Codecs: []string{protocol.CodecBinary}})
+	if messageType, body := readFrame(t, late); messageType != protocol.MessageTypeError {
+		t.Fatalf("Expected error frame, got type %d: %s", messageType, body)
+	}
+
+	// Connections offering no supported codec are refused
+	unknown := tb.dial(t)
+	writeFrame(t, unknown, protocol.MessageTypeHello, protocol.Hello{Version: protocol.Version, Codecs: []string{"msgpack"}})
+	if messageType, body := readFrame(t, unknown); messageType != protocol.MessageTypeError {
+		t.Fatalf("Expected error frame, got type %d: %s", messageType, body)
+	}
+}
+
+func TestProtocolVersions(t *testing.T) {
+	tb := startTestBroker(t)
+
+	// HELLO reports the broker's release and features, and switches the
+	// connection to the version 2 layout
+	consumer := tb.dial(t)
+	reply := hello(t, consumer)
+	if reply.Version != protocol.FrameVersion2 || reply.ServerVersion == "" || !slices.Contains(reply.Features, protocol.FeatureBinaryCodec) {
+		t.Errorf("Unexpected HELLO reply %+v", reply)
+	}
+	writeFrame(t, consumer, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "orders"})
+
+	// Replies carry the correlation ID of their request
+	producer := tb.dial(t)
+	hello(t, producer)
+	writeFrame(t, producer, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "orders", Message: "v2"}, RequestAck: true})
+	header, body := readFrameHeader(t, producer)
+	if header.Type != protocol.MessageTypePublishAck || header.CorrelationID != producer.lastID || header.Flags&protocol.FlagResponse == 0 {
+		t.Errorf("Expected PUBLISH_ACK for request %d, got %+v: %s", producer.lastID, header, body)
+	}
+
+	// MESSAGE and ACK have distinct types
+	header, body = readFrameHeader(t, consumer)
+	if header.Type != protocol.MessageTypeMessage || header.Version != protocol.FrameVersion2 {
+		t.Fatalf("Expected version 2 MESSAGE frame, got %+v: %s", header, body)
+	}
+
+	// Clients that speak version 1 keep its layout, and legacy clients that
+	// skip HELLO get MESSAGE frames with ACK's type
+	for _, legacy := range []bool{false, true} {
+		conn := tb.dial(t)
+		if !legacy {
+			if reply := helloVersion(t, conn, protocol.FrameVersion1); reply.Version != protocol.FrameVersion1 {
+				t.Fatalf("Expected version 1, got %d", reply.Version)
+			}
+		}
+		writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "orders", Group: fmt.Sprintf("legacy-%t", legacy)})
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatalf("Error setting read deadline: %v", err)
+		}
+		raw := make([]byte, protocol.HeaderSizeV1)
+		if _, err := io.ReadFull(conn.reader, raw); err != nil {
+			t.Fatalf("Error reading frame header: %v", err)
+		}
+		if raw[0] != protocol.MessageTypeMessageV1 {
+			t.Errorf("Expected frame type %#x, got %#x", protocol.MessageTypeMessageV1, raw[0])
+		}
+	}
+}
+
+func TestErrorFrames(t *testing.T) {
+	tb := startTestBroker(t)
+	conn := tb.dial(t)
+	hello(t, conn, protocol.CodecBinary)
+
+	// Request errors name the failed request and leave the connection open
+	expectRequestError := func(code string) protocol.Error {
+		t.Helper()
+		e := expectError(t, conn, code)
+		if e.CorrelationID != conn.lastID || e.Fatal {
+			t.Errorf("Expected a non-fatal error for request %d, got %+v", conn.lastID, e)
+		}
+		return e
+	}
+	writeRawFrame(t, conn, 0x42, nil)
+	expectRequestError(protocol.ErrorCodeUnknownType)
+	writeRawFrame(t, conn, protocol.MessageTypePublish, []byte{0xFF})
+	expectRequestError(protocol.ErrorCodeBadRequest)
+	writeRawFrame(t, conn, protocol.MessageTypePublish, make([]byte, protocol.MaxBodySize+1))
+	expectRequestError(protocol.ErrorCodeFrameTooLarge)
+	writeFrame(t, conn, protocol.MessageTypeAck, protocol.Ack{Topic: "orders"})
+	expectRequestError(protocol.ErrorCodeNotSubscribed)
+	writeFrame(t, conn, protocol.MessageTypeSeek, protocol.Seek{Topic: "orders", Position: "middle"})
+	expectRequestError(protocol.ErrorCodeBadRequest)
+
+	// Storage failures are retryable, and reported even without request_ack
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "orders", Message: "first"}})
+	awaitHandled(t, conn)
+	tb.wal.Close()
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "orders", Message: "lost"}})
+	if e := expectRequestError(protocol.ErrorCodeStorage); !e.Retryable {
+		t.Errorf("Expected a retryable error, got %+v", e)
+	}
+
+	// Fatal errors are followed by the broker closing the connection
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "payments"})
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "payments"})
+	if e := expectError(t, conn, protocol.ErrorCodeAlreadySubscribed); !e.Fatal || e.Retryable {
+		t.Errorf("Expected a fatal error, got %+v", e)
+	}
+	if _, err := conn.reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestTopicNames(t *testing.T) {
+	tb := startTestBroker(t)
+	conn := tb.dial(t)
+
+	// Names that could escape the WAL directory are rejected before
+	// anything is written
+	for _, topic := range []string{"../escape", "a/b", "..", "", "orders\x00"} {
+		writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: topic, Message: "m"}, RequestAck: true})
+		if e := expectError(t, conn, protocol.ErrorCodeInvalidTopic); e.Retryable || e.Fatal {
+			t.Errorf("Topic %q: expected a non-retryable error, got %+v", topic, e)
+		}
+	}
+	entries, err := os.ReadDir(tb.dir)
+	if err != nil {
+		t.Fatalf("Error listing broker directory: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "wal" {
+			t.Errorf("Unexpected file %s outside the WAL directory", entry.Name())
+		}
+	}
+
+	// One invalid name rejects the whole batch
+	writeFrame(t, conn, protocol.MessageTypePublishBatch, protocol.PublishBatch{
+		Messages:   []protocol.Message{{Topic: "orders", Message: "m"}, {Topic: "../orders", Message: "m"}},
+		RequestAck: true,
+	})
+	expectError(t, conn, protocol.ErrorCodeInvalidTopic)
+	if next := tb.wal.NextOffset("orders", 0); next != 0 {
+		t.Errorf("Expected nothing stored, next offset is %d", next)
+	}
+
+	// Subscribing to an invalid name closes the connection
+	writeFrame(t, conn, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "../orders"})
+	if e := expectError(t, conn, protocol.ErrorCodeInvalidTopic); !e.Fatal {
+		t.Errorf("Expected a fatal error, got %+v", e)
+	}
+
+	if err := tb.wal.CreateTopic("/etc/orders", wal.TopicConfig{}); !errors.Is(err, protocol.ErrInvalidTopic) {
+		t.Errorf("Expected ErrInvalidTopic creating a topic, got %v", err)
+	}
+
+	// Every topic leaves room for the name of its dead-letter topic
+	long := strings.Repeat("a", protocol.MaxTopicLength-len(wal.DeadLetterSuffix))
+	for _, topic := range []string{long, long + wal.DeadLetterSuffix} {
+		if err := protocol.ValidateTopic(topic); err != nil {
+			t.Errorf("Expected topic of %d characters to be valid, got %v", len(topic), err)
+		}
+	}
+	for _, topic := range []string{long + "a", long + "a" + wal.DeadLetterSuffix, long + wal.DeadLetterSuffix + wal.DeadLetterSuffix} {
+		if err := protocol.ValidateTopic(topic); !errors.Is(err, protocol.ErrInvalidTopic) {
+			t.Errorf("Expected ErrInvalidTopic for a topic of %d characters, got %v", len(topic), err)
+		}
+	}
+}
+
+func TestDeadLetterChain(t *testing.T) {
+	tb := startTestBroker(t)
+	topic := strings.Repeat("a", protocol.MaxTopicLength-len(wal.DeadLetterSuffix)) + wal.DeadLetterSuffix
+	tb.wal.SetTopicConfig(topic, wal.TopicConfig{MaxDeliveries: 1})
+
+	publisher := tb.dial(t)
+	writeFrame(t, publisher, protocol.MessageTypePublish, protocol.Message{Topic: topic, Message: "poison"})
+	writeFrame(t, publisher, protocol.MessageTypePublish, protocol.Message{Topic: topic, Message: "valid"})
+	awaitHandled(t, publisher)
+
+	consumer := tb.dial(t)
+	writeFrame(t, consumer, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: topic, Group: "ops"})
+
+	// The topic's dead-letter topic would have an invalid name, so the
+	// message is dropped instead of being delivered forever
+	msg := expectMessage(t, consumer, "poison")
+	writeFrame(t, consumer, protocol.MessageTypeNack, protocol.Nack{Topic: topic, Offset: int64(msg.ID), Reason: "still broken"})
+	msg = expectMessage(t, consumer, "valid")
+	writeFrame(t, consumer, protocol.MessageTypeAck, protocol.Ack{Topic: topic, Offset: int64(msg.ID)})
+	awaitHandled(t, consumer)
+
+	if committed := tb.offsets.Get("ops", topic, 0); committed != 2 {
+		t.Errorf("Expected the group to be past both messages, committed offset is %d", committed)
+	}
+}
+
+func TestTopicAdmin(t *testing.T) {
+	tb := startTestBrokerWithOptions(t, broker.Options{DisableAutoCreate: true})
+	conn := tb.dial(t)
+
+	// Topics must be created before they are published to
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "orders", Message: "m"}, RequestAck: true})
+	expectError(t, conn, protocol.ErrorCodeUnknownTopic)
+	writeFrame(t, conn, protocol.MessageTypePublishBatch, protocol.PublishBatch{Messages: []protocol.Message{{Topic: "orders", Message: "m"}}})
+	expectError(t, conn, protocol.ErrorCodeUnknownTopic)
+	if tb.wal.HasTopic("orders") {
+		t.Fatalf("Expected the topic not to be created on publish")
+	}
+
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{
+		Topic:  "orders",
+		Config: protocol.TopicConfig{Partitions: 3, RetentionMs: -1, RetentionMessages: 1000, CleanupPolicy: wal.CleanupPolicyCompact, Durability: wal.DurabilityMessages, SyncMessages: 50},
+	})
+	created := expectTopicList(t, conn)
+	want := protocol.TopicConfig{
+		Partitions:        3,
+		RetentionMessages: 1000,
+		CleanupPolicy:     wal.CleanupPolicyCompact,
+		Durability:        wal.DurabilityMessages,
+		SyncIntervalMs:    wal.DefaultSyncInterval.Milliseconds(),
+		SyncMessages:      50,
+		DeadLetterTopic:   "orders" + wal.DeadLetterSuffix,
+	}
+	if len(created) != 1 || created[0].Config != want || len(created[0].Partitions) != 3 {
+		t.Fatalf("Expected orders with config %+v and 3 partitions, got %+v", want, created)
+	}
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{Topic: "orders"})
+	expectError(t, conn, protocol.ErrorCodeTopicExists)
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{Topic: "audit", Config: protocol.TopicConfig{CleanupPolicy: "shred"}})
+	expectError(t, conn, protocol.ErrorCodeBadRequest)
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{Topic: "audit", Config: protocol.TopicConfig{Durability: "never"}})
+	expectError(t, conn, protocol.ErrorCodeBadRequest)
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{Topic: "audit", Config: protocol.TopicConfig{SyncIntervalMs: -1}})
+	expectError(t, conn, protocol.ErrorCodeBadRequest)
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{Topic: "audit", Config: protocol.TopicConfig{DeadLetterTopic: "../audit"}})
+	expectError(t, conn, protocol.ErrorCodeBadRequest)
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{Topic: "audit", Config: protocol.TopicConfig{DeadLetterTopic: "audit"}})
+	expectError(t, conn, protocol.ErrorCodeBadRequest)
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{Topic: "audit"})
+	expectTopicList(t, conn)
+
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "orders", Key: "k", Message: "m"}, RequestAck: true})
+	if messageType, body := readFrame(t, conn); messageType != protocol.MessageTypePublishAck {
+		t.Fatalf("Expected PUBLISH_ACK frame, got type %d: %s", messageType, body)
+	}
+
+	writeRawFrame(t, conn, protocol.MessageTypeListTopics, nil)
+	listed := expectTopicList(t, conn)
+	if len(listed) != 2 || listed[0].Topic != "audit" || listed[1].Topic != "orders" {
+		t.Fatalf("Expected audit and orders, got %+v", listed)
+	}
+	if listed[1].SizeBytes == 0 || listed[1].Config != want {
+		t.Errorf("Expected orders to report its size and config, got %+v", listed[1])
+	}
+
+	// Describe reports the partitions' offsets and the subscribers'
+	// positions
+	consumer := tb.dial(t)
+	writeFrame(t, consumer, protocol.MessageTypeSubscribe, protocol.Subscription{Topic: "orders", Group: "billing"})
+	expectMessage(t, consumer, "m")
+	writeFrame(t, conn, protocol.MessageTypeDescribeTopic, protocol.DescribeTopic{Topic: "orders"})
+	described := expectTopicList(t, conn)[0]
+	var next int64
+	for _, p := range described.Partitions {
+		next += p.NextOffset
+	}
+	if next != 1 || described.SizeBytes == 0 {
+		t.Errorf("Expected one stored message, got %+v", described.Partitions)
+	}
+	if len(described.Subscribers) != 1 {
+		t.Fatalf("Expected one subscriber, got %+v", described.Subscribers)
+	}
+	if sub := described.Subscribers[0]; sub.Group != "billing" || sub.Members != 1 || len(sub.Offsets) != 3 {
+		t.Errorf("Expected group billing with one member on 3 partitions, got %+v", sub)
+	}
+
+	// Topics with subscribers can't be deleted
+	writeFrame(t, conn, protocol.MessageTypeDeleteTopic, protocol.DeleteTopic{Topic: "orders"})
+	expectError(t, conn, protocol.ErrorCodeTopicInUse)
+	consumer.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		writeFrame(t, conn, protocol.MessageTypeDescribeTopic, protocol.DescribeTopic{Topic: "orders"})
+		if len(expectTopicList(t, conn)[0].Subscribers) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Subscriber still listed after disconnecting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Deleting removes the messages and the groups' offsets
+	writeFrame(t, conn, protocol.MessageTypeDeleteTopic, protocol.DeleteTopic{Topic: "orders"})
+	if deleted := expectTopicList(t, conn); len(deleted) != 1 || deleted[0].Topic != "orders" {
+		t.Errorf("Expected orders to be deleted, got %+v", deleted)
+	}
+	if _, err := os.Stat(filepath.Join(tb.dir, "wal", "orders")); !os.IsNotExist(err) {
+		t.Errorf("Expected the topic's directory to be removed, got %v", err)
+	}
+	offsets, err := os.ReadFile(filepath.Join(tb.dir, "offsets.json"))
+	if err != nil {
+		t.Fatalf("Error reading offsets: %v", err)
+	}
+	if strings.Contains(string(offsets), "orders") {
+		t.Errorf("Expected the offsets on orders to be deleted, got %s", offsets)
+	}
+
+	writeFrame(t, conn, protocol.MessageTypeDescribeTopic, protocol.DescribeTopic{Topic: "orders"})
+	expectError(t, conn, protocol.ErrorCodeUnknownTopic)
+	writeFrame(t, conn, protocol.MessageTypeDeleteTopic, protocol.DeleteTopic{Topic: "orders"})
+	expectError(t, conn, protocol.ErrorCodeUnknownTopic)
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "orders", Message: "m"}, RequestAck: true})
+	expectError(t, conn, protocol.ErrorCodeUnknownTopic)
+
+	// A topic created again starts empty, with the defaults
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{Topic: "orders"})
+	if recreated := expectTopicList(t, conn)[0]; len(recreated.Partitions) != 1 || recreated.Partitions[0].NextOffset != 0 {
+		t.Errorf("Expected an empty topic with one partition, got %+v", recreated)
+	}
+}
+
+func TestTopicSettingsPersist(t *testing.T) {
+	topicsFile := filepath.Join(t.TempDir(), "topics.json")
+	tb := startTestBrokerWithOptions(t, broker.Options{Topics: storage.NewTopicStore(topicsFile)})
+	conn := tb.dial(t)
+
+	// ACL bindings are checked and stored with the topic
+	acls := []protocol.ACLBinding{{Principal: "billing", Operation: protocol.ACLOperationSubscribe, Permission: protocol.ACLPermissionAllow}}
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{
+		Topic: "orders",
+		ACLs:  []protocol.ACLBinding{{Principal: "billing", Operation: "read", Permission: protocol.ACLPermissionAllow}},
+	})
+	expectError(t, conn, protocol.ErrorCodeBadRequest)
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{
+		Topic:  "orders",
+		Config: protocol.TopicConfig{Partitions: 2, RetentionMs: -1, RetentionBytes: 4096, MaxMessageBytes: 8, Durability: wal.DurabilityMessages, SyncMessages: 5, MaxDeliveries: 3, DeadLetterTopic: "orders.failed"},
+		ACLs:   acls,
+	})
+	if created := expectTopicList(t, conn); len(created) != 1 || !reflect.DeepEqual(created[0].ACLs, acls) {
+		t.Fatalf("Expected orders with ACL bindings %+v, got %+v", acls, created)
+	}
+
+	// Messages over the topic's limit are rejected
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "orders", Message: "too long a message"}, RequestAck: true})
+	if e := expectError(t, conn, protocol.ErrorCodeMessageTooLarge); e.Retryable {
+		t.Errorf("Expected a non-retryable error, got %+v", e)
+	}
+	writeFrame(t, conn, protocol.MessageTypePublishBatch, protocol.PublishBatch{
+		Messages: []protocol.Message{{Topic: "orders", Message: "short"}, {Topic: "orders", Payload: make([]byte, 9)}},
+	})
+	expectError(t, conn, protocol.ErrorCodeMessageTooLarge)
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "orders", Message: "short"}, RequestAck: true})
+	if messageType, body := readFrame(t, conn); messageType != protocol.MessageTypePublishAck {
+		t.Fatalf("Expected PUBLISH_ACK frame, got type %d: %s", messageType, body)
+	}
+	want := tb.wal.TopicConfig("orders")
+
+	// Topics created by a publish are stored too
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "events", Message: "m"}, RequestAck: true})
+	if messageType, body := readFrame(t, conn); messageType != protocol.MessageTypePublishAck {
+		t.Fatalf("Expected PUBLISH_ACK frame, got type %d: %s", messageType, body)
+	}
+
+	// Deleting a topic deletes its settings
+	writeFrame(t, conn, protocol.MessageTypeCreateTopic, protocol.CreateTopic{Topic: "audit"})
+	expectTopicList(t, conn)
+	writeFrame(t, conn, protocol.MessageTypeDeleteTopic, protocol.DeleteTopic{Topic: "audit"})
+	expectTopicList(t, conn)
+
+	// A broker started on the same files keeps the settings topics set,
+	// and applies its new defaults to the others
+	if err := tb.wal.Close(); err != nil {
+		t.Fatalf("Error closing WAL: %v", err)
+	}
+	defaults := wal.TopicConfig{
+		Retention:     wal.RetentionPolicy{MaxMessages: 500},
+		MaxDeliveries: 10,
+		Durability:    wal.DurabilityPolicy{Mode: wal.DurabilityInterval, Interval: 200 * time.Millisecond, Messages: wal.DefaultSyncMessages},
+	}
+	want.Retention.MaxMessages = defaults.Retention.MaxMessages
+	want.Durability.Interval = defaults.Durability.Interval
+	w, err := wal.NewWAL(filepath.Join(tb.dir, "wal"), wal.Options{DefaultTopicConfig: defaults})
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	defer w.Close()
+	topics := storage.NewTopicStore(topicsFile)
+	if err := topics.Load(); err != nil {
+		t.Fatalf("Error loading topics: %v", err)
+	}
+	broker.NewBroker(w, tb.offsets, broker.Options{Topics: topics})
+	if got := w.TopicConfig("orders"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected settings %+v after restart, got %+v", want, got)
+	}
+	if got := w.Partitions("orders"); got != 2 {
+		t.Errorf("Expected 2 partitions after restart, got %d", got)
+	}
+	if md, _ := topics.Get("orders"); !reflect.DeepEqual(md.ACLs, acls) {
+		t.Errorf("Expected ACL bindings %+v after restart, got %+v", acls, md.ACLs)
+	}
+	if md, ok := topics.Get("events"); !ok || !reflect.DeepEqual(md, storage.TopicMetadata{TopicConfig: protocol.TopicConfig{Partitions: 1}}) {
+		t.Errorf("Expected only the partitions of events to be stored, got %+v", md)
+	}
+	if got := w.TopicConfig("events"); got.Retention != defaults.Retention || got.Durability != defaults.Durability || got.MaxDeliveries != defaults.MaxDeliveries {
+		t.Errorf("Expected events to use the new defaults, got %+v", got)
+	}
+	if _, ok := topics.Get("audit"); ok {
+		t.Errorf("Expected the settings of audit to be deleted")
+	}
+}
+
+func TestClient(t *testing.T) {
+	tb := startTestBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	producer, err := client.NewProducer(ctx, tb.addr, client.ProducerOptions{BatchSize: 16})
+	if err != nil {
+		t.Fatalf("Error creating producer: %v", err)
+	}
+	defer producer.Close()
+
+	// Synchronous publishes return where the message was stored
+	result, err := producer.Publish(ctx, client.Message{Topic: "orders", Message: "sync"})
+	if err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if result != (client.PublishResult{Topic: "orders", Partition: 0, Offset: 0}) {
+		t.Errorf("Unexpected publish result %+v", result)
+	}
+
+	// Batches are stored together and return each message's offset
+	results, err := producer.PublishBatch(ctx, []client.Message{
+		{Topic: "audit", Message: "a"},
+		{Topic: "audit", Message: "b"},
+	})
+	if err != nil {
+		t.Fatalf("Error publishing batch: %v", err)
+	}
+	if len(results) != 2 || results[0].Offset != 0 || results[1].Offset != 1 {
+		t.Errorf("Unexpected batch results %+v", results)
+	}
+
+	// Asynchronous publishes are batched and confirmed through callbacks
+	const count = 50
+	var mu sync.Mutex
+	offsets := make(map[int64]bool)
+	for i := 0; i < count; i++ {
+		err := producer.PublishAsync(ctx, client.Message{Topic: "orders", Message: fmt.Sprintf("async-%d", i)}, func(r client.PublishResult, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				t.Errorf("Error publishing asynchronously: %v", err)
+			}
+			offsets[r.Offset] = true
+		})
+		if err != nil {
+			t.Fatalf("Error queueing message: %v", err)
+		}
+	}
+	if err := producer.Flush(ctx); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	mu.Lock()
+	if len(offsets) != count {
+		t.Errorf("Expected %d distinct offsets, got %d", count, len(offsets))
+	}
+	mu.Unlock()
+
+	consumer, err := client.NewConsumer(ctx, tb.addr, client.ConsumerOptions{Topic: "orders", Group: "billing", Prefetch: 8})
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	defer consumer.Close()
+
+	expected := []string{"sync"}
+	for i := 0; i < count; i++ {
+		expected = append(expected, fmt.Sprintf("async-%d", i))
+	}
+	for _, content := range expected {
+		msg, err := consumer.Next(ctx)
+		if err != nil {
+			t.Fatalf("Error receiving message: %v", err)
+		}
+		if msg.Message != content {
+			t.Fatalf("Expected message %q, got %q", content, msg.Message)
+		}
+		if err := consumer.Ack(ctx, msg); err != nil {
+			t.Fatalf("Error acknowledging: %v", err)
+		}
+	}
+
+	// Messages given back are delivered again
+	if _, err := producer.Publish(ctx, client.Message{Topic: "orders", Message: "retry"}); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	msg := <-consumer.Messages()
+	if err := consumer.Nack(ctx, msg, 0, "try again"); err != nil {
+		t.Fatalf("Error giving back message: %v", err)
+	}
+	msg = <-consumer.Messages()
+	if msg.Message != "retry" || msg.Redeliveries != 1 {
+		t.Errorf("Expected redelivery of %q, got %+v", "retry", msg)
+	}
+
+	// Waiting calls return when their context is done
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if _, err := consumer.Next(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Closed clients fail every call
+	consumer.Close()
+	if _, err := consumer.Next(ctx); !errors.Is(err, client.ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	producer.Close()
+	if _, err := producer.Publish(ctx, client.Message{Topic: "orders"}); !errors.Is(err, client.ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err := producer.PublishAsync(ctx, client.Message{Topic: "orders"}, nil); !errors.Is(err, client.ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	tb := startTestBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := client.Options{MinBackoff: 10 * time.Millisecond, OnError: func(error) {}}
+	producer, err := client.NewProducer(ctx, tb.addr, client.ProducerOptions{Options: opts})
+	if err != nil {
+		t.Fatalf("Error creating producer: %v", err)
+	}
+	defer producer.Close()
+	consumer, err := client.NewConsumer(ctx, tb.addr, client.ConsumerOptions{Options: opts, Topic: "orders"})
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	defer consumer.Close()
+
+	// publish retries messages whose connection dropped before the broker
+	// answered
+	publish := func(content string) {
+		t.Helper()
+		for {
+			_, err := producer.Publish(ctx, client.Message{Topic: "orders", Message: content})
+			if err == nil {
+				return
+			}
+			if !errors.Is(err, client.ErrDisconnected) {
+				t.Fatalf("Error publishing: %v", err)
+			}
+		}
+	}
+	expect := func(content string) client.Message {
+		t.Helper()
+		msg, err := consumer.Next(ctx)
+		if err != nil {
+			t.Fatalf("Error receiving message: %v", err)
+		}
+		if msg.Message != content {
+			t.Fatalf("Expected message %q, got %q", content, msg.Message)
+		}
+		return msg
+	}
+
+	publish("before")
+	expect("before")
+
+	// Both clients reconnect, and the consumer gets the message it didn't
+	// acknowledge again
+	tb.disconnectAll()
+	publish("after")
+	msg := expect("before")
+	if err := consumer.Ack(ctx, msg); err != nil {
+		t.Fatalf("Error acknowledging: %v", err)
+	}
+	expect("after")
+}
+
+func TestClientFatalError(t *testing.T) {
+	tb := startTestBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A rejected subscription is returned by NewConsumer
+	_, err := client.NewConsumer(ctx, tb.addr, client.ConsumerOptions{Topic: "../orders"})
+	var e *client.Error
+	if !errors.As(err, &e) || e.Code != protocol.ErrorCodeInvalidTopic || !e.Fatal {
+		t.Fatalf("Expected a fatal invalid_topic error, got %v", err)
+	}
+
+	// A broker that accepts the first subscription and rejects it after
+	// the connection drops is not reconnected to again
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+	writeReply := func(conn net.Conn, messageType byte, correlationID uint32, v any) {
+		body, _ := json.Marshal(v)
+		header := protocol.Header{Version: protocol.FrameVersion2, Type: messageType, Flags: protocol.FlagResponse, CorrelationID: correlationID, Length: uint32(len(body))}
+		conn.Write(append(protocol.AppendHeader(nil, header), body...))
+	}
+	serve := func(conn net.Conn, accept bool) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		header, err := protocol.ReadHeader(reader, protocol.FrameVersion1)
+		if err != nil {
+			return
+		}
+		io.CopyN(io.Discard, reader, int64(header.Length))
+		body, _ := json.Marshal(protocol.Hello{Version: protocol.FrameVersion2, Codec: protocol.CodecJSON})
+		conn.Write(append(protocol.AppendHeader(nil, protocol.Header{Version: protocol.FrameVersion1, Type: protocol.MessageTypeHello, Length: uint32(len(body))}), body...))
+		for {
+			header, err := protocol.ReadHeader(reader, protocol.FrameVersion2)
+			if err != nil {
+				return
+			}
+			io.CopyN(io.Discard, reader, int64(header.Length))
+			switch header.Type {
+			case protocol.MessageTypeSubscribe:
+				if !accept {
+					writeReply(conn, protocol.MessageTypeError, header.CorrelationID, protocol.Error{Code: protocol.ErrorCodeBadRequest, Message: "rejected", Fatal: true})
+					return
+				}
+			case protocol.MessageTypeDescribeTopic:
+				writeReply(conn, protocol.MessageTypeTopicList, header.CorrelationID, protocol.TopicList{})
+				return
+			}
+		}
+	}
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn, accepted.Add(1) == 1)
+		}
+	}()
+
+	errs := make(chan error, 10)
+	opts := client.Options{Codec: protocol.CodecJSON, MinBackoff: 10 * time.Millisecond, OnError: func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}}
+	consumer, err := client.NewConsumer(ctx, listener.Addr().String(), client.ConsumerOptions{Options: opts, Topic: "orders"})
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	defer consumer.Close()
+	if _, err := consumer.Next(ctx); !errors.Is(err, client.ErrClosed) {
+		t.Fatalf("Expected the consumer to stop, got %v", err)
+	}
+	for reported := false; !reported; {
+		select {
+		case err := <-errs:
+			reported = errors.As(err, &e) && e.Fatal
+		case <-ctx.Done():
+			t.Fatalf("Expected the fatal error to be reported")
+		}
+	}
+	if err := consumer.Ack(ctx, client.Message{Topic: "orders"}); !errors.As(err, &e) || !e.Fatal {
+		t.Errorf("Expected calls to return the fatal error, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("Expected no reconnection after the fatal error, got %d connections", n)
+	}
+}
+
+// testBroker is a broker served on a random local port
+type testBroker struct {
+	dir     string
+	addr    string
+	wal     *wal.WAL
+	offsets *storage.OffsetStore
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{} // server side of the open connections
+}
+
+// startTestBroker runs a broker backed by a temporary directory until the
+// test finishes
+func startTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	return startTestBrokerWithOptions(t, broker.Options{})
+}
+
+// startTestBrokerWithOptions runs a broker configured with opts until the
+// test finishes
+func startTestBrokerWithOptions(t *testing.T, opts broker.Options) *testBroker {
+	t.Helper()
+	return startTestBrokerIn(t, t.TempDir(), opts)
+}
+
+// startTestBrokerIn runs a broker on the WAL and offsets stored in dir until
+// the test finishes
+func startTestBrokerIn(t *testing.T, dir string, opts broker.Options) *testBroker {
+	t.Helper()
+
+	w, err := wal.NewWAL(filepath.Join(dir, "wal"), wal.Options{})
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+	offsets := storage.NewOffsetStore(filepath.Join(dir, "offsets.json"))
+	if err := offsets.Load(protocol.DefaultGroup); err != nil {
 		t.Fatalf("Error loading offsets: %v", err)
 	}
+	b := broker.NewBroker(w, offsets, opts)
 
-	// Compare
-	expected := map[string]int64{"topic1": 10, "topic2": 25}
-	actual := map[string]int64{
-		"topic1": store2.Get("topic1"),
-		"topic2": store2.Get("topic2"),
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
 	}
 
-	if !reflect.DeepEqual(expected, actual) {
-		t.Errorf("Loaded offsets do not match. Expected %v, got %v", expected, actual)
+	// Client connections are closed first, as their cleanups are registered
+	// later, and the handlers must finish before the directory is removed
+	var handlers sync.WaitGroup
+	accepting := make(chan struct{})
+	t.Cleanup(func() {
+		listener.Close()
+		<-accepting
+		handlers.Wait()
+		w.Close()
+	})
+
+	tb := &testBroker{dir: dir, addr: listener.Addr().String(), wal: w, offsets: offsets, conns: make(map[net.Conn]struct{})}
+	go func() {
+		defer close(accepting)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			tb.mu.Lock()
+			tb.conns[conn] = struct{}{}
+			tb.mu.Unlock()
+
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				b.HandleConnection(conn)
+				tb.mu.Lock()
+				delete(tb.conns, conn)
+				tb.mu.Unlock()
+			}()
+		}
+	}()
+
+	return tb
+}
+
+// disconnectAll closes every open connection from the broker's side
+func (tb *testBroker) disconnectAll() {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	for conn := range tb.conns {
+		conn.Close()
 	}
 }
 
-func TestOffsetIncrement(t *testing.T) {
-	store := storage.NewOffsetStore("")
+// testConn is a client connection to a test broker
+type testConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	version byte
+	codec   protocol.Codec
+	lastID  uint32 // correlation ID of the last frame sent
+}
 
-	store.Set("test", 5)
-	newOffset := store.Increment("test")
+func (tb *testBroker) dial(t *testing.T) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", tb.addr)
+	if err != nil {
+		t.Fatalf("Error connecting to broker: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{Conn: conn, reader: bufio.NewReader(conn), version: protocol.FrameVersion1, codec: protocol.JSON}
+}
 
-	if newOffset != 6 {
-		t.Errorf("Expected offset 6, got %d", newOffset)
+// hello agrees on the newest protocol version and the codec of conn's frame
+// bodies, returning the broker's reply
+func hello(t *testing.T, conn *testConn, codecs ...string) protocol.Hello {
+	t.Helper()
+	return helloVersion(t, conn, protocol.Version, codecs...)
+}
+
+// helloVersion agrees on a protocol version up to version and the codec of
+// conn's frame bodies, returning the broker's reply
+func helloVersion(t *testing.T, conn *testConn, version int, codecs ...string) protocol.Hello {
+	t.Helper()
+	writeFrame(t, conn, protocol.MessageTypeHello, protocol.Hello{Version: version, Codecs: codecs})
+	messageType, body := readFrame(t, conn)
+	if messageType != protocol.MessageTypeHello {
+		t.Fatalf("Expected HELLO frame, got type %d: %s", messageType, body)
+	}
+	var reply protocol.Hello
+	if err := json.Unmarshal(body, &reply); err != nil {
+		t.Fatalf("Error decoding HELLO: %v", err)
+	}
+	codec, ok := protocol.CodecByName(reply.Codec)
+	if !ok {
+		t.Fatalf("Broker chose unknown codec %q", reply.Codec)
+	}
+	conn.version = byte(reply.Version)
+	conn.codec = codec
+	return reply
+}
+
+// writeFrame sends v, encoded with the connection's codec, in a frame of the
+// given type with the next correlation ID. HELLO frames always use the
+// version 1 layout and JSON.
+func writeFrame(t *testing.T, conn *testConn, messageType byte, v any) {
+	t.Helper()
+	codec := conn.codec
+	if messageType == protocol.MessageTypeHello {
+		codec = protocol.JSON
+	}
+	body, err := codec.Marshal(v)
+	if err != nil {
+		t.Fatalf("Error marshalling frame body: %v", err)
+	}
+	writeRawFrame(t, conn, messageType, body)
+}
+
+// writeRawFrame sends body in a frame of the given type with the next
+// correlation ID
+func writeRawFrame(t *testing.T, conn *testConn, messageType byte, body []byte) {
+	t.Helper()
+	version := conn.version
+	if messageType == protocol.MessageTypeHello {
+		version = protocol.FrameVersion1
+	}
+	conn.lastID++
+	frame := protocol.AppendHeader(nil, protocol.Header{
+		Version:       version,
+		Type:          messageType,
+		CorrelationID: conn.lastID,
+		Length:        uint32(len(body)),
+	})
+	if _, err := conn.Write(append(frame, body...)); err != nil {
+		t.Fatalf("Error writing frame: %v", err)
+	}
+}
+
+// readFrame reads the next frame sent by the broker
+func readFrame(t *testing.T, conn *testConn) (byte, []byte) {
+	t.Helper()
+	header, body := readFrameHeader(t, conn)
+	return header.Type, body
+}
+
+// readFrameHeader reads the next frame sent by the broker, returning its
+// header. MESSAGE frames on version 1 connections, which share ACK's type,
+// are reported with the MESSAGE type.
+func readFrameHeader(t *testing.T, conn *testConn) (protocol.Header, []byte) {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Error setting read deadline: %v", err)
+	}
+	header, err := protocol.ReadHeader(conn.reader, conn.version)
+	if err != nil {
+		t.Fatalf("Error reading frame header: %v", err)
+	}
+	body := make([]byte, header.Length)
+	if _, err := io.ReadFull(conn.reader, body); err != nil {
+		t.Fatalf("Error reading frame body: %v", err)
+	}
+	if header.Version == protocol.FrameVersion1 && header.Type == protocol.MessageTypeMessageV1 {
+		header.Type = protocol.MessageTypeMessage
+	}
+	return header, body
+}
+
+// awaitHandled waits until the broker has handled every frame sent on conn
+// so far, using the acknowledgement of a publish to an unrelated topic
+func awaitHandled(t *testing.T, conn *testConn) {
+	t.Helper()
+	writeFrame(t, conn, protocol.MessageTypePublish, protocol.Publish{Message: protocol.Message{Topic: "barrier"}, RequestAck: true})
+	if messageType, body := readFrame(t, conn); messageType != protocol.MessageTypePublishAck {
+		t.Fatalf("Expected PUBLISH_ACK frame, got type %d: %s", messageType, body)
+	}
+}
+
+// expectError reads the next frame and checks it is an ERROR with the
+// given code
+func expectError(t *testing.T, conn *testConn, code string) protocol.Error {
+	t.Helper()
+	messageType, body := readFrame(t, conn)
+	if messageType != protocol.MessageTypeError {
+		t.Fatalf("Expected error frame, got type %d: %s", messageType, body)
+	}
+	var e protocol.Error
+	if err := conn.codec.Unmarshal(body, &e); err != nil {
+		t.Fatalf("Error decoding error: %v", err)
+	}
+	if e.Code != code {
+		t.Fatalf("Expected error %s, got %+v", code, e)
+	}
+	return e
+}
+
+// expectTopicList reads the next frame and checks it is a TOPIC_LIST,
+// returning its topics
+func expectTopicList(t *testing.T, conn *testConn) []protocol.TopicInfo {
+	t.Helper()
+	messageType, body := readFrame(t, conn)
+	if messageType != protocol.MessageTypeTopicList {
+		t.Fatalf("Expected TOPIC_LIST frame, got type %d: %s", messageType, body)
+	}
+	var list protocol.TopicList
+	if err := conn.codec.Unmarshal(body, &list); err != nil {
+		t.Fatalf("Error decoding topic list: %v", err)
+	}
+	return list.Topics
+}
+
+// expectMessage reads the next frame and checks it is a MESSAGE with the
+// given content
+func expectMessage(t *testing.T, conn *testConn, content string) protocol.Message {
+	t.Helper()
+	messageType, body := readFrame(t, conn)
+	if messageType != protocol.MessageTypeMessage {
+		t.Fatalf("Expected MESSAGE frame, got type %d: %s", messageType, body)
+	}
+	var msg protocol.Message
+	if err := conn.codec.Unmarshal(body, &msg); err != nil {
+		t.Fatalf("Error decoding message: %v", err)
+	}
+	if msg.Message != content {
+		t.Fatalf("Expected message %q, got %q", content, msg.Message)
+	}
+	return msg
+}
+
+func FuzzValidateTopic(f *testing.F) {
+	for _, seed := range []string{
+		"orders", "orders.dlq", "Orders_2024-01", "..", ".", "...", "../escape", "a/b", "/etc/passwd",
+		"a\\b", "C:orders", "", "\x00", "orders\n", "tópico", strings.Repeat("a", protocol.MaxTopicLength+1),
+		strings.Repeat("a", protocol.MaxTopicLength-len(wal.DeadLetterSuffix)+1),
+	} {
+		f.Add(seed)
 	}
+
+	// Every name accepted by the WAL is a directory inside it
+	f.Fuzz(func(t *testing.T, name string) {
+		root := t.TempDir()
+		dir := filepath.Join(root, "wal")
+		w, err := wal.NewWAL(dir, wal.Options{})
+		if err != nil {
+			t.Fatalf("Error creating WAL: %v", err)
+		}
+		defer w.Close()
+
+		err = protocol.ValidateTopic(name)
+		if err != nil {
+			if !errors.Is(err, protocol.ErrInvalidTopic) {
+				t.Fatalf("Expected ErrInvalidTopic for %q, got %v", name, err)
+			}
+			if err := w.CreateTopic(name, wal.TopicConfig{}); !errors.Is(err, protocol.ErrInvalidTopic) {
+				t.Fatalf("Expected the WAL to reject %q, got %v", name, err)
+			}
+			return
+		}
+
+		if !filepath.IsLocal(name) || filepath.Base(name) != name || len(name) > protocol.MaxTopicLength {
+			t.Fatalf("Accepted topic %q is not a plain file name", name)
+		}
+		if !strings.HasSuffix(name, wal.DeadLetterSuffix) {
+			if err := protocol.ValidateTopic(name + wal.DeadLetterSuffix); err != nil {
+				t.Fatalf("Expected a valid dead-letter topic for %q, got %v", name, err)
+			}
+		}
+		if err := w.CreateTopic(name, wal.TopicConfig{}); err != nil {
+			t.Fatalf("Error creating topic %q: %v", name, err)
+		}
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || !info.IsDir() {
+			t.Fatalf("Expected topic %q in the WAL directory (err %v)", name, err)
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("Expected only the WAL directory in %s, got %v (err %v)", root, entries, err)
+		}
+	})
 }
 
 func BenchmarkPublish(b *testing.B) {
@@ -172,3 +2686,122 @@ func BenchmarkPublishSubscribe(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkTopicScaling appends to an increasing number of topics, each
+// with its own producer, syncing every append. Appends to different topics
+// don't wait for each other's syncs, so their syncs may overlap. It reports
+// the throughput of each run and its ratio to the throughput with one
+// topic, which is only above 1 if the disk and CPUs can sync in parallel.
+func BenchmarkTopicScaling(b *testing.B) {
+	// The throughput with one topic, which the others are reported against
+	var base float64
+	for _, topics := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("topics=%d", topics), func(b *testing.B) {
+			w, err := wal.NewWAL(b.TempDir(), wal.Options{})
+			if err != nil {
+				b.Fatalf("Error creating WAL: %v", err)
+			}
+			defer w.Close()
+
+			var next atomic.Int64
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for i := 0; i < topics; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					msg := protocol.Message{Topic: fmt.Sprintf("topic-%d", i), Message: "hello world"}
+					for next.Add(1) <= int64(b.N) {
+						if _, err := w.Append(msg); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			throughput := float64(b.N) / b.Elapsed().Seconds()
+			b.ReportMetric(throughput, "msgs/s")
+			if topics == 1 {
+				base = throughput
+			}
+			if base > 0 {
+				b.ReportMetric(throughput/base, "x-one-topic")
+			}
+		})
+	}
+}
+
+// BenchmarkCodecs compares the size and speed of the codecs on a typical
+// message
+func BenchmarkCodecs(b *testing.B) {
+	msg := protocol.Message{
+		Topic:               "orders",
+		Partition:           3,
+		Key:                 "customer-12345",
+		Headers:             map[string]string{"trace-id": "4bf92f3577b34da6", "source": "checkout"},
+		ContentType:         "application/octet-stream",
+		Payload:             make([]byte, 256),
+		ID:                  123456,
+		TimestampMs:         1700000000000,
+		ProducerTimestampMs: 1699999999990,
+	}
+
+	for _, codec := range []protocol.Codec{protocol.JSON, protocol.Binary} {
+		data, err := codec.Marshal(&msg)
+		if err != nil {
+			b.Fatalf("Error encoding message: %v", err)
+		}
+
+		b.Run(codec.Name()+"/encode", func(b *testing.B) {
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(data)), "bytes/msg")
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Marshal(&msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(codec.Name()+"/decode", func(b *testing.B) {
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(data)), "bytes/msg")
+			for i := 0; i < b.N; i++ {
+				var decoded protocol.Message
+				if err := codec.Unmarshal(data, &decoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDurability(b *testing.B) {
+	modes := []wal.DurabilityPolicy{
+		{Mode: wal.DurabilityAlways},
+		{Mode: wal.DurabilityInterval, Interval: 10 * time.Millisecond},
+		{Mode: wal.DurabilityMessages, Messages: 100},
+		{Mode: wal.DurabilityOS},
+	}
+	for _, policy := range modes {
+		b.Run(policy.Mode, func(b *testing.B) {
+			w, err := wal.NewWAL(b.TempDir(), wal.Options{DefaultTopicConfig: wal.TopicConfig{Durability: policy}})
+			if err != nil {
+				b.Fatalf("Error creating WAL: %v", err)
+			}
+			msg := protocol.Message{Topic: "bench", Message: "hello world"}
+
+			// Concurrent producers, whose appends share syncs in always mode
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := w.Append(msg); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(w.Syncs())/float64(b.N), "syncs/op")
+		})
+	}
+}
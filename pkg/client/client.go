@@ -0,0 +1,519 @@
+// Package client is a Go client for the message broker.
+//
+// A Producer publishes messages and a Consumer receives the messages of a
+// topic. Each one holds its own connection, which speaks version 2 of the
+// protocol and reconnects with exponential backoff when it drops. Calls
+// that wait on the broker take a context and return when it is done.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+type (
+	// Message is a message published to or received from a topic
+	Message = protocol.Message
+	// Error is an error reported by the broker. Retryable errors may
+	// succeed if the request is sent again.
+	Error = protocol.Error
+)
+
+var (
+	// ErrClosed is returned by calls on a closed producer or consumer
+	ErrClosed = errors.New("client: closed")
+	// ErrDisconnected is returned for requests whose connection was lost
+	// before the broker answered them. They may or may not have been
+	// applied.
+	ErrDisconnected = errors.New("client: connection lost")
+)
+
+// Options configures the connection to the broker
+type Options struct {
+	// Codec is the body codec asked for in HELLO. It defaults to the binary
+	// codec.
+	Codec string
+	// DialTimeout limits each connection attempt, including the HELLO
+	// exchange. It defaults to 5 seconds.
+	DialTimeout time.Duration
+	// MinBackoff and MaxBackoff bound the wait between reconnection
+	// attempts, which doubles after each failed one. They default to 100
+	// milliseconds and 5 seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnError is called with errors not returned by any call, such as
+	// failed reconnection attempts and errors the broker reports for ACKs.
+	// By default they are logged.
+	OnError func(error)
+}
+
+func (o Options) withDefaults() Options {
+	if o.Codec == "" {
+		o.Codec = protocol.CodecBinary
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = 5 * time.Second
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = max(5*time.Second, o.MinBackoff)
+	}
+	if o.OnError == nil {
+		o.OnError = func(err error) {
+			log.Printf("client: %v\n", err)
+		}
+	}
+	return o
+}
+
+// request is a frame to send. onReply, if set, is called exactly once with
+// the broker's reply or the error that prevented getting one.
+type request struct {
+	messageType byte
+	body        any
+	onReply     func(reply)
+}
+
+// reply is the frame answering a request, with the codec to decode it
+type reply struct {
+	header protocol.Header
+	body   []byte
+	codec  protocol.Codec
+	err    error
+}
+
+// connection is a connection to the broker that reconnects when it drops
+type connection struct {
+	addr      string
+	opts      Options
+	onConnect func(ctx context.Context) error // called after each connect
+	onMessage func(msg Message)               // called for each MESSAGE
+
+	ctx    context.Context // done once the connection is closed
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the read loop has stopped
+
+	// writeMu serializes writes to the socket
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	conn    net.Conn // nil while disconnected
+	codec   protocol.Codec
+	ready   chan struct{} // closed once conn is set
+	lastID  uint32
+	pending map[uint32]func(reply)
+	fatal   *Error // set once the broker closes the connection for good
+}
+
+// newConnection returns a connection to the broker at addr, which is
+// opened by start
+func newConnection(addr string, opts Options, onConnect func(context.Context) error, onMessage func(Message)) *connection {
+	c := &connection{
+		addr:      addr,
+		opts:      opts.withDefaults(),
+		onConnect: onConnect,
+		onMessage: onMessage,
+		done:      make(chan struct{}),
+		ready:     make(chan struct{}),
+		pending:   make(map[uint32]func(reply)),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+// start connects to the broker and runs onConnect, returning an error if
+// either fails. Later disconnections are retried in the background.
+func (c *connection) start(ctx context.Context) error {
+	conn, reader, codec, err := c.dial(ctx)
+	if err != nil {
+		c.cancel()
+		return err
+	}
+	c.connected(conn, codec)
+
+	// onConnect may wait for replies, which are read by run
+	go c.run(conn, reader, codec)
+	if err := c.subscribe(ctx); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+// dial opens a socket to the broker and agrees on version 2 of the
+// protocol and the codec
+func (c *connection) dial(ctx context.Context) (net.Conn, *bufio.Reader, protocol.Codec, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.DialTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reader, codec, err := c.hello(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return conn, reader, codec, nil
+}
+
+// hello sends HELLO on a new connection and reads the broker's answer
+func (c *connection) hello(ctx context.Context, conn net.Conn) (*bufio.Reader, protocol.Codec, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	// Closing the socket interrupts the exchange if ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	body, err := json.Marshal(protocol.Hello{Version: protocol.Version, Codecs: []string{c.opts.Codec}})
+	if err != nil {
+		return nil, nil, err
+	}
+	frame := protocol.AppendHeader(nil, protocol.Header{
+		Version: protocol.FrameVersion1,
+		Type:    protocol.MessageTypeHello,
+		Length:  uint32(len(body)),
+	})
+	if _, err := conn.Write(append(frame, body...)); err != nil {
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	header, err := protocol.ReadHeader(reader, protocol.FrameVersion1)
+	if err != nil {
+		return nil, nil, err
+	}
+	body = make([]byte, header.Length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch header.Type {
+	case protocol.MessageTypeHello:
+	case protocol.MessageTypeError:
+		var e Error
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, nil, fmt.Errorf("client: HELLO rejected: %s", body)
+		}
+		return nil, nil, &e
+	default:
+		return nil, nil, fmt.Errorf("client: expected HELLO, got frame type %#x", header.Type)
+	}
+
+	var hello protocol.Hello
+	if err := json.Unmarshal(body, &hello); err != nil {
+		return nil, nil, err
+	}
+	if hello.Version < protocol.FrameVersion2 {
+		return nil, nil, fmt.Errorf("client: broker speaks protocol version %d, version %d is required", hello.Version, protocol.FrameVersion2)
+	}
+	codec, ok := protocol.CodecByName(hello.Codec)
+	if !ok {
+		return nil, nil, fmt.Errorf("client: broker chose unknown codec %q", hello.Codec)
+	}
+	return reader, codec, nil
+}
+
+// connected makes conn the connection used for requests. It reports false
+// if the connection was closed in the meantime.
+func (c *connection) connected(conn net.Conn, codec protocol.Codec) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx.Err() != nil {
+		return false
+	}
+	c.conn = conn
+	c.codec = codec
+	close(c.ready)
+	return true
+}
+
+// subscribe runs onConnect on a new connection
+func (c *connection) subscribe(ctx context.Context) error {
+	if c.onConnect == nil {
+		return nil
+	}
+	return c.onConnect(ctx)
+}
+
+// run reads frames until the connection is closed, reconnecting whenever
+// it drops. A connection the broker closed with a fatal error is not
+// reconnected, since the same requests would be rejected again.
+func (c *connection) run(conn net.Conn, reader *bufio.Reader, codec protocol.Codec) {
+	defer close(c.done)
+	for {
+		err := c.read(reader, codec)
+		if fatal := c.disconnected(conn, err); fatal != nil {
+			c.cancel()
+			return
+		}
+
+		conn, reader, codec = c.reconnect()
+		if conn == nil {
+			return
+		}
+	}
+}
+
+// read handles the frames sent by the broker until reading fails
+func (c *connection) read(reader *bufio.Reader, codec protocol.Codec) error {
+	for {
+		header, err := protocol.ReadHeader(reader, protocol.FrameVersion2)
+		if err != nil {
+			return err
+		}
+		body := make([]byte, header.Length)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return err
+		}
+		c.handle(header, body, codec)
+	}
+}
+
+// handle passes a frame to the request it answers, or to the consumer
+func (c *connection) handle(header protocol.Header, body []byte, codec protocol.Codec) {
+	var e *Error
+	if header.Type == protocol.MessageTypeError {
+		e = &Error{}
+		if err := codec.Unmarshal(body, e); err != nil {
+			c.opts.OnError(fmt.Errorf("client: decoding error frame: %w", err))
+			return
+		}
+		if e.Fatal {
+			c.mu.Lock()
+			c.fatal = e
+			c.mu.Unlock()
+		}
+	}
+
+	if header.Flags&protocol.FlagResponse != 0 {
+		c.mu.Lock()
+		onReply, ok := c.pending[header.CorrelationID]
+		delete(c.pending, header.CorrelationID)
+		c.mu.Unlock()
+		if ok {
+			r := reply{header: header, body: body, codec: codec}
+			if e != nil {
+				r.err = e
+			}
+			onReply(r)
+			return
+		}
+	}
+
+	switch {
+	case e != nil:
+		c.opts.OnError(e)
+	case header.Type == protocol.MessageTypeMessage && c.onMessage != nil:
+		var msg Message
+		if err := codec.Unmarshal(body, &msg); err != nil {
+			c.opts.OnError(fmt.Errorf("client: decoding message: %w", err))
+			return
+		}
+		c.onMessage(msg)
+	}
+}
+
+// disconnected closes a dropped connection and fails the requests still
+// waiting for a reply on it. It returns the fatal error the broker closed
+// the connection with, if any.
+func (c *connection) disconnected(conn net.Conn, err error) *Error {
+	conn.Close()
+
+	c.mu.Lock()
+	c.conn = nil
+	c.ready = make(chan struct{})
+	pending := c.pending
+	c.pending = make(map[uint32]func(reply))
+	fatal := c.fatal
+	c.mu.Unlock()
+
+	var failure error
+	switch {
+	case fatal != nil:
+		failure = fatal
+	case c.ctx.Err() != nil:
+		failure = ErrClosed
+	default:
+		failure = ErrDisconnected
+		c.opts.OnError(fmt.Errorf("client: connection to %s lost: %w", c.addr, err))
+	}
+	for _, onReply := range pending {
+		onReply(reply{err: failure})
+	}
+	return fatal
+}
+
+// reconnect dials the broker until it succeeds or the connection is closed,
+// in which case it returns a nil connection
+func (c *connection) reconnect() (net.Conn, *bufio.Reader, protocol.Codec) {
+	backoff := c.opts.MinBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-c.ctx.Done():
+			return nil, nil, nil
+		}
+
+		conn, reader, codec, err := c.dial(c.ctx)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return nil, nil, nil
+			}
+			c.opts.OnError(fmt.Errorf("client: reconnecting to %s: %w", c.addr, err))
+			backoff = min(2*backoff, c.opts.MaxBackoff)
+			continue
+		}
+
+		if !c.connected(conn, codec) {
+			conn.Close()
+			return nil, nil, nil
+		}
+		// Replies to onConnect are read once this returns
+		go func() {
+			var e *Error
+			if err := c.subscribe(c.ctx); err != nil && (c.ctx.Err() == nil || errors.As(err, &e)) {
+				c.opts.OnError(fmt.Errorf("client: resubscribing to %s: %w", c.addr, err))
+			}
+		}()
+		return conn, reader, codec
+	}
+}
+
+// current returns the connection requests are sent on, waiting for it to
+// be reestablished if it dropped
+func (c *connection) current(ctx context.Context) (net.Conn, protocol.Codec, error) {
+	for {
+		c.mu.Lock()
+		conn, codec, ready, fatal := c.conn, c.codec, c.ready, c.fatal
+		c.mu.Unlock()
+		if c.ctx.Err() != nil {
+			if fatal != nil {
+				return nil, nil, fatal
+			}
+			return nil, nil, ErrClosed
+		}
+		if conn != nil {
+			return conn, codec, nil
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-c.ctx.Done():
+			return nil, nil, ErrClosed
+		}
+	}
+}
+
+// write sends requests to the broker in a single write. Each request's
+// onReply is called once, with the error returned if write fails.
+func (c *connection) write(ctx context.Context, requests ...request) error {
+	err := c.send(ctx, requests)
+	if err != nil {
+		for _, req := range requests {
+			if req.onReply != nil {
+				req.onReply(reply{err: err})
+			}
+		}
+	}
+	return err
+}
+
+// send writes requests, registering those that expect a reply only once
+// nothing can fail before their frames are written
+func (c *connection) send(ctx context.Context, requests []request) error {
+	conn, codec, err := c.current(ctx)
+	if err != nil {
+		return err
+	}
+
+	bodies := make([][]byte, len(requests))
+	for i, req := range requests {
+		if bodies[i], err = codec.Marshal(req.body); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	var buf []byte
+	ids := make([]uint32, len(requests))
+	for i, req := range requests {
+		c.lastID++
+		if c.lastID == 0 {
+			c.lastID++
+		}
+		ids[i] = c.lastID
+		buf = protocol.AppendHeader(buf, protocol.Header{
+			Version:       protocol.FrameVersion2,
+			Type:          req.messageType,
+			CorrelationID: ids[i],
+			Length:        uint32(len(bodies[i])),
+		})
+		buf = append(buf, bodies[i]...)
+	}
+	if c.conn != conn {
+		c.mu.Unlock()
+		return ErrDisconnected
+	}
+	for i, req := range requests {
+		if req.onReply != nil {
+			c.pending[ids[i]] = req.onReply
+		}
+	}
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	_, err = conn.Write(buf)
+	conn.SetWriteDeadline(time.Time{})
+	c.writeMu.Unlock()
+	if err == nil {
+		return nil
+	}
+
+	// Closing the socket makes the read loop reconnect. Requests it already
+	// failed are not failed again.
+	conn.Close()
+	c.mu.Lock()
+	for i, req := range requests {
+		if _, ok := c.pending[ids[i]]; ok || req.onReply == nil {
+			delete(c.pending, ids[i])
+			continue
+		}
+		requests[i].onReply = nil
+	}
+	c.mu.Unlock()
+	return fmt.Errorf("%w: %v", ErrDisconnected, err)
+}
+
+// close closes the connection and waits for its read loop to stop
+func (c *connection) close() error {
+	c.cancel()
+	c.mu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	<-c.done
+	return nil
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+// ConsumerOptions configures a consumer
+type ConsumerOptions struct {
+	Options
+	// Topic is the topic to consume
+	Topic string
+	// Group is the consumer group to join. It defaults to the broker's
+	// default group.
+	Group string
+	// Broadcast subscribes to every message published after the
+	// subscription instead of joining a group
+	Broadcast bool
+	// Shared joins the group in shared mode, where every member consumes
+	// every partition and messages with the same key may be consumed out
+	// of order. Every member of the group must set it.
+	Shared bool
+	// Prefetch is the most unacknowledged messages the broker delivers at a
+	// time. It defaults to the broker's default.
+	Prefetch int
+	// VisibilityTimeout is how long the broker waits for an ACK before
+	// delivering a message again. It defaults to the broker's default.
+	VisibilityTimeout time.Duration
+}
+
+// Consumer receives the messages of a topic. Each message must be
+// acknowledged with Ack, or given back with Nack, before the broker's
+// visibility timeout expires.
+//
+// When the connection drops the consumer subscribes again after
+// reconnecting. Messages it held unacknowledged are delivered again, and
+// ACKs for them sent before the reconnection are rejected. If the broker
+// rejects the subscription with a fatal error the consumer stops, and its
+// Messages channel is closed.
+type Consumer struct {
+	conn     *connection
+	opts     ConsumerOptions
+	messages chan Message
+}
+
+// NewConsumer connects a consumer to the broker at addr and subscribes to
+// opts.Topic, returning the broker's error if it rejects the subscription
+func NewConsumer(ctx context.Context, addr string, opts ConsumerOptions) (*Consumer, error) {
+	c := &Consumer{
+		opts:     opts,
+		messages: make(chan Message, max(opts.Prefetch, 1)),
+	}
+	c.conn = newConnection(addr, opts.Options, c.subscribe, c.deliver)
+	if err := c.conn.start(ctx); err != nil {
+		return nil, err
+	}
+
+	// Nothing is delivered once the read loop has stopped
+	go func() {
+		<-c.conn.done
+		close(c.messages)
+	}()
+	return c, nil
+}
+
+// subscribe sends the consumer's subscription on a new connection and
+// waits for the broker to handle it. The broker only answers a SUBSCRIBE
+// it rejects, so it is followed by a DESCRIBE_TOPIC: frames are handled in
+// order, and a rejected SUBSCRIBE closes the connection before the
+// DESCRIBE_TOPIC is answered.
+func (c *Consumer) subscribe(ctx context.Context) error {
+	sub := protocol.Subscription{
+		Topic:               c.opts.Topic,
+		Group:               c.opts.Group,
+		VisibilityTimeoutMs: c.opts.VisibilityTimeout.Milliseconds(),
+		Prefetch:            c.opts.Prefetch,
+	}
+	switch {
+	case c.opts.Broadcast:
+		sub.Mode = protocol.SubscriptionModeBroadcast
+	case c.opts.Shared:
+		sub.Mode = protocol.SubscriptionModeShared
+	}
+	rejected := make(chan error, 1)
+	handled := make(chan error, 1)
+	err := c.conn.write(ctx,
+		request{messageType: protocol.MessageTypeSubscribe, body: sub, onReply: func(r reply) { rejected <- r.err }},
+		request{messageType: protocol.MessageTypeDescribeTopic, body: protocol.DescribeTopic{Topic: c.opts.Topic}, onReply: func(r reply) { handled <- r.err }},
+	)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-rejected:
+		return err
+	case err := <-handled:
+		// The broker answers the DESCRIBE_TOPIC, even with an error, only
+		// if it accepted the SUBSCRIBE. Otherwise it is failed with the
+		// error the connection was closed with.
+		var e *Error
+		if errors.As(err, &e) && !e.Fatal {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver passes a message from the broker to the consumer's channel,
+// waiting while it is full
+func (c *Consumer) deliver(msg Message) {
+	select {
+	case c.messages <- msg:
+	case <-c.conn.ctx.Done():
+	}
+}
+
+// Messages returns the channel the consumer's messages are delivered on.
+// It is closed when the consumer is closed.
+func (c *Consumer) Messages() <-chan Message {
+	return c.messages
+}
+
+// Next returns the next message, waiting for one to arrive
+func (c *Consumer) Next(ctx context.Context) (Message, error) {
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			return Message{}, ErrClosed
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// Ack acknowledges msg, so it is not delivered again. The broker doesn't
+// confirm ACKs; those it rejects are reported to Options.OnError.
+func (c *Consumer) Ack(ctx context.Context, msg Message) error {
+	ack := protocol.Ack{Topic: msg.Topic, Partition: msg.Partition, Offset: int64(msg.ID)}
+	return c.conn.write(ctx, request{messageType: protocol.MessageTypeAck, body: ack})
+}
+
+// Nack gives msg back to the broker, which delivers it again after delay.
+// reason is recorded if the message is moved to the dead-letter topic.
+func (c *Consumer) Nack(ctx context.Context, msg Message, delay time.Duration, reason string) error {
+	nack := protocol.Nack{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    int64(msg.ID),
+		DelayMs:   delay.Milliseconds(),
+		Reason:    reason,
+	}
+	return c.conn.write(ctx, request{messageType: protocol.MessageTypeNack, body: nack})
+}
+
+// Close closes the consumer's connection. The broker delivers the messages
+// it held unacknowledged to the other members of its group.
+func (c *Consumer) Close() error {
+	return c.conn.close()
+}
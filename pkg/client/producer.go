@@ -0,0 +1,381 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tiagomorais/simple-message-broker/internal/protocol"
+)
+
+// ProducerOptions configures a producer
+type ProducerOptions struct {
+	Options
+	// BatchSize is the most messages published by PublishAsync that are
+	// written to the broker together. It defaults to 100.
+	BatchSize int
+	// Linger is how long messages published by PublishAsync wait for a
+	// batch to fill up. It defaults to 5 milliseconds.
+	Linger time.Duration
+}
+
+// PublishResult is where the broker stored a published message
+type PublishResult struct {
+	Topic     string
+	Partition int
+	Offset    int64
+}
+
+// Producer publishes messages to the broker. It is safe for concurrent use.
+type Producer struct {
+	conn  *connection
+	opts  ProducerOptions
+	queue chan asyncPublish
+	done  chan struct{} // closed once the batching loop has stopped
+
+	// closeMu keeps messages from being queued while Close fails the ones
+	// left in the queue
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu        sync.Mutex
+	unsettled int             // messages published asynchronously and not yet acknowledged
+	idle      []chan struct{} // closed once unsettled drops to zero
+}
+
+// asyncPublish is a message waiting to be written by the batching loop
+type asyncPublish struct {
+	msg      Message
+	callback func(PublishResult, error)
+}
+
+// NewProducer connects a producer to the broker at addr
+func NewProducer(ctx context.Context, addr string, opts ProducerOptions) (*Producer, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Linger <= 0 {
+		opts.Linger = 5 * time.Millisecond
+	}
+
+	p := &Producer{
+		conn:  newConnection(addr, opts.Options, nil, nil),
+		opts:  opts,
+		queue: make(chan asyncPublish, opts.BatchSize),
+		done:  make(chan struct{}),
+	}
+	if err := p.conn.start(ctx); err != nil {
+		return nil, err
+	}
+	go p.run()
+	return p, nil
+}
+
+// Publish publishes msg and waits for the broker to store it. Errors the
+// broker reports are of type *Error. If the connection drops before the
+// broker answers, ErrDisconnected is returned and the message may or may
+// not have been stored.
+func (p *Producer) Publish(ctx context.Context, msg Message) (PublishResult, error) {
+	type result struct {
+		PublishResult
+		err error
+	}
+	results := make(chan result, 1)
+	err := p.conn.write(ctx, publishRequest(msg, func(r PublishResult, err error) {
+		results <- result{r, err}
+	}))
+	if err != nil {
+		return PublishResult{}, err
+	}
+
+	select {
+	case r := <-results:
+		return r.PublishResult, r.err
+	case <-ctx.Done():
+		return PublishResult{}, ctx.Err()
+	}
+}
+
+// PublishBatch publishes msgs in one PUBLISH_BATCH frame and waits for the
+// broker to store them. The broker stores either all of them or none, and
+// the results are in the order of msgs. The batch must fit in one frame.
+func (p *Producer) PublishBatch(ctx context.Context, msgs []Message) ([]PublishResult, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+
+	type result struct {
+		results []PublishResult
+		err     error
+	}
+	results := make(chan result, 1)
+	err := p.conn.write(ctx, publishBatchRequest(msgs, func(r []PublishResult, err error) {
+		results <- result{r, err}
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-results:
+		return r.results, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// PublishAsync queues msg to be published in a PUBLISH_BATCH frame with
+// others, and returns once it is queued. callback, if not nil, is called with the
+// outcome from another goroutine. Flush waits for the queued messages.
+func (p *Producer) PublishAsync(ctx context.Context, msg Message, callback func(PublishResult, error)) error {
+	if callback == nil {
+		callback = func(PublishResult, error) {}
+	}
+
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+
+	p.mu.Lock()
+	p.unsettled++
+	p.mu.Unlock()
+
+	select {
+	case p.queue <- asyncPublish{msg: msg, callback: callback}:
+		return nil
+	case <-ctx.Done():
+		p.settled()
+		return ctx.Err()
+	case <-p.conn.ctx.Done():
+		p.settled()
+		return ErrClosed
+	}
+}
+
+// Flush waits until every message published by PublishAsync so far has been
+// acknowledged or has failed
+func (p *Producer) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	if p.unsettled == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	p.idle = append(p.idle, idle)
+	p.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the producer's connection. Messages that are still queued or
+// waiting for the broker fail with ErrClosed, so call Flush first to wait
+// for them.
+func (p *Producer) Close() error {
+	err := p.conn.close()
+	<-p.done
+
+	p.closeMu.Lock()
+	defer p.closeMu.Unlock()
+	p.closed = true
+	p.fail()
+	return err
+}
+
+// settled records the outcome of a message published asynchronously
+func (p *Producer) settled() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.unsettled--
+	if p.unsettled == 0 {
+		for _, idle := range p.idle {
+			close(idle)
+		}
+		p.idle = nil
+	}
+}
+
+// run writes the messages queued by PublishAsync in batches, until the
+// producer is closed
+func (p *Producer) run() {
+	defer close(p.done)
+	for {
+		var batch []asyncPublish
+		select {
+		case item := <-p.queue:
+			batch = append(batch, item)
+		case <-p.conn.ctx.Done():
+			return
+		}
+
+		linger := time.NewTimer(p.opts.Linger)
+	fill:
+		for len(batch) < p.opts.BatchSize {
+			select {
+			case item := <-p.queue:
+				batch = append(batch, item)
+			case <-linger.C:
+				break fill
+			}
+		}
+		linger.Stop()
+
+		var requests []request
+		for _, chunk := range splitBatch(batch) {
+			requests = append(requests, p.batchRequest(chunk))
+		}
+		// Failures are passed to the callbacks
+		p.conn.write(p.conn.ctx, requests...)
+	}
+}
+
+// batchRequest builds the request publishing a batch of queued messages,
+// which passes each message's outcome to its callback
+func (p *Producer) batchRequest(batch []asyncPublish) request {
+	msgs := make([]Message, len(batch))
+	for i, item := range batch {
+		msgs[i] = item.msg
+	}
+	return publishBatchRequest(msgs, func(results []PublishResult, err error) {
+		for i, item := range batch {
+			if err != nil {
+				item.callback(PublishResult{}, err)
+			} else {
+				item.callback(results[i], nil)
+			}
+			p.settled()
+		}
+	})
+}
+
+// fail fails the messages left in the queue once the producer is closed
+func (p *Producer) fail() {
+	for {
+		select {
+		case item := <-p.queue:
+			item.callback(PublishResult{}, ErrClosed)
+			p.settled()
+		default:
+			return
+		}
+	}
+}
+
+// publishRequest builds the request publishing msg, which passes the
+// broker's acknowledgement to callback
+func publishRequest(msg Message, callback func(PublishResult, error)) request {
+	return request{
+		messageType: protocol.MessageTypePublish,
+		body:        protocol.Publish{Message: msg, RequestAck: true},
+		onReply: func(r reply) {
+			if r.err != nil {
+				callback(PublishResult{}, r.err)
+				return
+			}
+			var ack protocol.PublishAck
+			if err := r.codec.Unmarshal(r.body, &ack); err != nil {
+				callback(PublishResult{}, err)
+				return
+			}
+			if ack.Error != nil {
+				callback(PublishResult{}, ack.Error)
+				return
+			}
+			callback(PublishResult{Topic: ack.Topic, Partition: ack.Partition, Offset: ack.Offset}, nil)
+		},
+	}
+}
+
+// maxBatchBytes bounds the estimated size of the messages written in one
+// PUBLISH_BATCH frame, leaving room under protocol.MaxBodySize for the
+// encoding overhead
+const maxBatchBytes = protocol.MaxBodySize / 2
+
+// splitBatch splits queued messages into batches that fit in a frame
+func splitBatch(batch []asyncPublish) [][]asyncPublish {
+	var (
+		chunks [][]asyncPublish
+		start  int
+		size   int
+	)
+	for i, item := range batch {
+		msgSize := estimatedSize(item.msg)
+		if i > start && size+msgSize > maxBatchBytes {
+			chunks = append(chunks, batch[start:i])
+			start, size = i, 0
+		}
+		size += msgSize
+	}
+	return append(chunks, batch[start:])
+}
+
+// estimatedSize roughly estimates the encoded size of msg
+func estimatedSize(msg Message) int {
+	size := 64 + len(msg.Topic) + len(msg.Key) + len(msg.ContentType) + len(msg.Message) + len(msg.Payload)
+	for name, value := range msg.Headers {
+		size += 8 + len(name) + len(value)
+	}
+	return size
+}
+
+// publishBatchRequest builds the request publishing msgs in one frame,
+// which passes the broker's acknowledgement to callback
+func publishBatchRequest(msgs []Message, callback func([]PublishResult, error)) request {
+	return request{
+		messageType: protocol.MessageTypePublishBatch,
+		body:        protocol.PublishBatch{Messages: msgs, RequestAck: true},
+		onReply: func(r reply) {
+			if r.err != nil {
+				callback(nil, r.err)
+				return
+			}
+			var ack protocol.PublishBatchAck
+			if err := r.codec.Unmarshal(r.body, &ack); err != nil {
+				callback(nil, err)
+				return
+			}
+			if ack.Error != nil {
+				callback(nil, ack.Error)
+				return
+			}
+			callback(batchResults(msgs, ack))
+		},
+	}
+}
+
+// batchResults works out where each message of a batch was stored from the
+// broker's acknowledgement. The messages of each partition were given
+// consecutive offsets in the order of the batch.
+func batchResults(msgs []Message, ack protocol.PublishBatchAck) ([]PublishResult, error) {
+	if len(ack.Partitions) != len(msgs) {
+		return nil, fmt.Errorf("client: PUBLISH_BATCH_ACK has %d partitions for %d messages", len(ack.Partitions), len(msgs))
+	}
+
+	type partition struct {
+		topic string
+		id    int
+	}
+	next := make(map[partition]int64, len(ack.Ranges))
+	for _, rng := range ack.Ranges {
+		next[partition{rng.Topic, rng.Partition}] = rng.FirstOffset
+	}
+
+	results := make([]PublishResult, len(msgs))
+	for i, msg := range msgs {
+		key := partition{msg.Topic, ack.Partitions[i]}
+		offset, ok := next[key]
+		if !ok {
+			return nil, fmt.Errorf("client: PUBLISH_BATCH_ACK has no offsets for partition %d of topic %s", key.id, key.topic)
+		}
+		results[i] = PublishResult{Topic: msg.Topic, Partition: key.id, Offset: offset}
+		next[key] = offset + 1
+	}
+	return results, nil
+}